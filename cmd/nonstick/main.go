@@ -21,6 +21,9 @@ func main() {
 	}
 	app.Version = bi.Main.Version
 	app.Commands = commands.Commands
+	// Values of list flags may contain commas (e.g., scope
+	// descriptions); lists are given by repeating the flag.
+	app.DisableSliceFlagSeparator = true
 
 	if err := app.Run(os.Args); err != nil {
 		log.Error().Err(err).Msg("Command failed")
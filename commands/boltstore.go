@@ -0,0 +1,124 @@
+package commands
+
+import (
+	"bytes"
+	"errors"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var boltBucket = []byte("nonstick")
+
+// boltStore is a kvStore in a BoltDB file. Only one nonstick process
+// may open it at a time.
+type boltStore struct {
+	db *bolt.DB
+
+	mu        sync.Mutex
+	lastSweep time.Time
+}
+
+func newBoltStore(path string) (*boltStore, error) {
+	if path == "" {
+		return nil, errors.New("the bolt session store needs a database file")
+	}
+	db, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(boltBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &boltStore{db: db}, nil
+}
+
+func (b *boltStore) Get(key string) ([]byte, error) {
+	var value []byte
+	err := b.db.View(func(tx *bolt.Tx) error {
+		v, ok := unexpired(tx.Bucket(boltBucket).Get([]byte(key)), time.Now())
+		if !ok {
+			return errNotFound
+		}
+		// Values are only valid during the transaction.
+		value = bytes.Clone(v)
+		return nil
+	})
+	return value, err
+}
+
+func (b *boltStore) Put(key string, value []byte, ttl time.Duration) error {
+	now := time.Now()
+	b.mu.Lock()
+	sweep := now.Sub(b.lastSweep) > sweepInterval
+	if sweep {
+		b.lastSweep = now
+	}
+	b.mu.Unlock()
+	return b.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltBucket)
+		if sweep {
+			var expired [][]byte
+			bucket.ForEach(func(k, v []byte) error {
+				if _, ok := unexpired(v, now); !ok {
+					expired = append(expired, k)
+				}
+				return nil
+			})
+			for _, k := range expired {
+				bucket.Delete(k)
+			}
+		}
+		return bucket.Put([]byte(key), withExpiry(value, ttl))
+	})
+}
+
+func (b *boltStore) Delete(key string) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltBucket).Delete([]byte(key))
+	})
+}
+
+func (b *boltStore) Take(key string) ([]byte, error) {
+	var value []byte
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltBucket)
+		v, ok := unexpired(bucket.Get([]byte(key)), time.Now())
+		if ok {
+			value = bytes.Clone(v)
+		}
+		if err := bucket.Delete([]byte(key)); err != nil {
+			return err
+		}
+		if !ok {
+			return errNotFound
+		}
+		return nil
+	})
+	return value, err
+}
+
+func (b *boltStore) Scan(prefix string) (map[string][]byte, error) {
+	now := time.Now()
+	result := make(map[string][]byte)
+	err := b.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(boltBucket).Cursor()
+		for k, v := c.Seek([]byte(prefix)); k != nil && bytes.HasPrefix(k, []byte(prefix)); k, v = c.Next() {
+			if value, ok := unexpired(v, now); ok {
+				result[string(k)] = bytes.Clone(value)
+			}
+		}
+		return nil
+	})
+	return result, err
+}
+
+func (b *boltStore) Close() error {
+	return b.db.Close()
+}
@@ -0,0 +1,309 @@
+package commands
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// casTicketLifetime is how long a service ticket may be
+	// validated after it is issued.
+	casTicketLifetime = 30 * time.Second
+	// casRenewWindow is how recently the user must have signed in
+	// for a login with `renew` to skip signing in again.
+	casRenewWindow = 2 * time.Minute
+)
+
+// casTicketPrefix prefixes the keys of service tickets in the
+// kvStore.
+const casTicketPrefix = "cas:"
+
+// casTicket is an outstanding service ticket.
+type casTicket struct {
+	Service string
+	UID     string
+	// Renewed is set if the ticket was issued with `renew`, so the
+	// user has just signed in.
+	Renewed bool
+}
+
+// casServer serves the CAS 2.0 and 3.0 protocols, letting
+// applications that use CAS sign users in with nonstick. Users sign
+// in with the IdP's PAM service, into the nonstick session, which
+// then stands in for the CAS single sign-on session. Proxy tickets
+// are not supported.
+type casServer struct {
+	s *server
+	// services are the URL prefixes of the services allowed to
+	// sign in.
+	services []*url.URL
+	// tickets holds the outstanding service tickets, which may be
+	// validated by any nonstick process sharing it.
+	tickets kvStore
+}
+
+// newCasServer returns a CAS server for the services under the given
+// URL prefixes.
+func newCasServer(s *server, services []string, tickets kvStore) (*casServer, error) {
+	c := &casServer{
+		s:       s,
+		tickets: tickets,
+	}
+	for _, service := range services {
+		u, err := url.Parse(service)
+		if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+			return nil, fmt.Errorf("CAS service %q is not an absolute http(s) URL", service)
+		}
+		c.services = append(c.services, u)
+	}
+	return c, nil
+}
+
+// allowed reports whether the service is under one of the registered
+// URL prefixes.
+func (c *casServer) allowed(service string) bool {
+	u, err := url.Parse(service)
+	if err != nil || u.User != nil {
+		return false
+	}
+	for _, prefix := range c.services {
+		if !strings.EqualFold(u.Scheme, prefix.Scheme) || !strings.EqualFold(u.Host, prefix.Host) {
+			continue
+		}
+		if u.Path == prefix.Path || strings.HasPrefix(u.Path, strings.TrimSuffix(prefix.Path, "/")+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// issue returns a new service ticket for the user and service.
+func (c *casServer) issue(service, uid string, renewed bool) (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	id := "ST-" + base64.RawURLEncoding.EncodeToString(b)
+	data, err := json.Marshal(&casTicket{
+		Service: service,
+		UID:     uid,
+		Renewed: renewed,
+	})
+	if err != nil {
+		return "", err
+	}
+	if err := c.tickets.Put(casTicketPrefix+id, data, casTicketLifetime); err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+// redeem returns the service ticket with the given ID, if it is
+// still valid. Either way, it cannot be used again.
+func (c *casServer) redeem(id string) (*casTicket, error) {
+	data, err := c.tickets.Take(casTicketPrefix + id)
+	if errors.Is(err, errNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	t := &casTicket{}
+	if err := json.Unmarshal(data, t); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// fresh reports whether the user signed in within casRenewWindow.
+func (c *casServer) fresh(r *http.Request) bool {
+	ts := c.s.idpSession(r)
+	return ts != nil && time.Since(ts.Created) < casRenewWindow
+}
+
+// withTicket returns the service URL with the ticket added to its
+// query.
+func withTicket(service, ticket string) string {
+	fragment := ""
+	if i := strings.IndexByte(service, '#'); i >= 0 {
+		service, fragment = service[:i], service[i:]
+	}
+	sep := "?"
+	if strings.Contains(service, "?") {
+		sep = "&"
+	}
+	return service + sep + "ticket=" + url.QueryEscape(ticket) + fragment
+}
+
+// login is the CAS credential requestor and acceptor. Users who are
+// signed in are sent back to the service with a ticket; others are
+// asked to sign in first.
+func (c *casServer) login(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	service := q.Get("service")
+	if service == "" {
+		http.Redirect(w, r, "/sso/login", http.StatusSeeOther)
+		return
+	}
+	if !c.allowed(service) {
+		log.Info().Msgf("Rejected CAS login for unknown service %q", service)
+		c.s.respondWithError(w, r, "This application may not sign in with nonstick.")
+		return
+	}
+	renew := q.Has("renew") && q.Get("renew") != "false"
+	gateway := q.Has("gateway") && q.Get("gateway") != "false"
+
+	userinfo := c.s.idpUser(r)
+	if renew && !c.fresh(r) {
+		userinfo = nil
+	}
+	if userinfo == nil {
+		if gateway && !renew {
+			// The service only wanted to know whether the
+			// user is already signed in.
+			http.Redirect(w, r, service, http.StatusSeeOther)
+			return
+		}
+		login := "/sso/login?next=" + url.QueryEscape(r.URL.RequestURI())
+		if renew {
+			login += "&renew=1"
+		}
+		http.Redirect(w, r, login, http.StatusSeeOther)
+		return
+	}
+	ticket, err := c.issue(service, userinfo.Uid, renew)
+	if err != nil {
+		c.s.internalError(w, r, err)
+		return
+	}
+	http.Redirect(w, r, withTicket(service, ticket), http.StatusSeeOther)
+}
+
+// logout signs the user out of nonstick, and so of CAS. If a
+// registered service is given, the user is sent there afterwards.
+func (c *casServer) logout(w http.ResponseWriter, r *http.Request) {
+	if err := c.s.signOut(w, r); err != nil {
+		c.s.internalError(w, r, err)
+		return
+	}
+	// CAS 2.0 names the parameter `url`, CAS 3.0 `service`.
+	service := r.URL.Query().Get("service")
+	if service == "" {
+		service = r.URL.Query().Get("url")
+	}
+	if service != "" && c.allowed(service) {
+		http.Redirect(w, r, service, http.StatusSeeOther)
+		return
+	}
+	c.s.renderTemplate("logged_out", nil, w)
+}
+
+type casResponse struct {
+	XMLName   xml.Name    `xml:"cas:serviceResponse"`
+	Namespace string      `xml:"xmlns:cas,attr"`
+	Success   *casSuccess `xml:"cas:authenticationSuccess,omitempty"`
+	Failure   *casFailure `xml:"cas:authenticationFailure,omitempty"`
+}
+
+type casSuccess struct {
+	User       string         `xml:"cas:user"`
+	Attributes *casAttributes `xml:"cas:attributes,omitempty"`
+}
+
+// casAttributes are the user's attributes, released by CAS 3.0.
+type casAttributes struct {
+	IsFromNewLogin bool     `xml:"cas:isFromNewLogin"`
+	CommonName     string   `xml:"cas:cn,omitempty"`
+	GivenName      string   `xml:"cas:givenName,omitempty"`
+	Surname        string   `xml:"cas:sn,omitempty"`
+	MemberOf       []string `xml:"cas:memberOf"`
+}
+
+type casFailure struct {
+	Code    string `xml:"code,attr"`
+	Message string `xml:",chardata"`
+}
+
+func writeCasResponse(w http.ResponseWriter, resp *casResponse) {
+	resp.Namespace = "http://www.yale.edu/tp/cas"
+	data, err := xml.MarshalIndent(resp, "", "  ")
+	if err != nil {
+		log.Error().Err(err).Msg("Could not encode CAS response")
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	w.Write(data)
+}
+
+func casError(w http.ResponseWriter, code, message string) {
+	log.Info().Msgf("CAS validation failed: %s: %s", code, message)
+	writeCasResponse(w, &casResponse{
+		Failure: &casFailure{Code: code, Message: message},
+	})
+}
+
+func (c *casServer) serviceValidate(w http.ResponseWriter, r *http.Request) {
+	c.validate(w, r, false)
+}
+
+func (c *casServer) p3ServiceValidate(w http.ResponseWriter, r *http.Request) {
+	c.validate(w, r, true)
+}
+
+// validate redeems a service ticket for the user it was issued to,
+// along with their attributes if requested.
+func (c *casServer) validate(w http.ResponseWriter, r *http.Request, attributes bool) {
+	q := r.URL.Query()
+	service, id := q.Get("service"), q.Get("ticket")
+	if service == "" || id == "" {
+		casError(w, "INVALID_REQUEST", "Both service and ticket are required.")
+		return
+	}
+	t, err := c.redeem(id)
+	if err != nil {
+		log.Error().Err(err).Msg("Could not redeem CAS ticket")
+		casError(w, "INTERNAL_ERROR", "Could not look up the ticket.")
+		return
+	}
+	if t == nil {
+		casError(w, "INVALID_TICKET", fmt.Sprintf("Ticket %s not recognized.", id))
+		return
+	}
+	if t.Service != service {
+		casError(w, "INVALID_SERVICE", fmt.Sprintf("Ticket %s was not issued for this service.", id))
+		return
+	}
+	if q.Has("renew") && q.Get("renew") != "false" && !t.Renewed {
+		casError(w, "INVALID_TICKET_SPEC", fmt.Sprintf("Ticket %s was not issued by a new login.", id))
+		return
+	}
+	profile, err := lookupProfile(t.UID)
+	if err != nil {
+		log.Error().Err(err).Msgf("Could not look up subject %q", t.UID)
+		casError(w, "INTERNAL_ERROR", "Could not look up the user.")
+		return
+	}
+	success := &casSuccess{User: profile.Username}
+	if attributes {
+		success.Attributes = &casAttributes{
+			IsFromNewLogin: t.Renewed,
+			CommonName:     profile.Name,
+			GivenName:      profile.GivenName,
+			Surname:        profile.FamilyName,
+			MemberOf:       profile.Groups,
+		}
+	}
+	writeCasResponse(w, &casResponse{Success: success})
+	log.Info().Msgf("Validated CAS ticket for %q to %q", profile.Username, service)
+}
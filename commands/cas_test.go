@@ -0,0 +1,185 @@
+package commands
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestCasServer(t *testing.T) (*server, *casServer) {
+	t.Helper()
+	s := newTestServer(t)
+	c, err := newCasServer(s, []string{"https://app.example/cas/"}, newMemStore())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.cas = c
+	return s, c
+}
+
+func TestNewCasServerInvalid(t *testing.T) {
+	for _, service := range []string{"app.example", "ftp://app.example/", "https:///cas", "://"} {
+		if _, err := newCasServer(nil, []string{service}, newMemStore()); err == nil {
+			t.Errorf("Expected service %q to be rejected", service)
+		}
+	}
+}
+
+func TestCasAllowed(t *testing.T) {
+	_, c := newTestCasServer(t)
+	for _, tc := range []struct {
+		service string
+		want    bool
+	}{
+		{"https://app.example/cas/", true},
+		{"https://app.example/cas/login?x=1", true},
+		{"https://APP.example/cas/", true},
+		{"https://app.example/cas", false},
+		{"https://app.example/cassette", false},
+		{"http://app.example/cas/", false},
+		{"https://other.example/cas/", false},
+		{"https://app.example.evil.example/cas/", false},
+		{"https://user@app.example/cas/", false},
+		{"%", false},
+	} {
+		if got := c.allowed(tc.service); got != tc.want {
+			t.Errorf("allowed(%q) = %v, want %v", tc.service, got, tc.want)
+		}
+	}
+}
+
+func TestWithTicket(t *testing.T) {
+	for _, tc := range []struct {
+		service, want string
+	}{
+		{"https://app.example/cas/", "https://app.example/cas/?ticket=ST-1"},
+		{"https://app.example/cas/?x=1", "https://app.example/cas/?x=1&ticket=ST-1"},
+		{"https://app.example/cas/#top", "https://app.example/cas/?ticket=ST-1#top"},
+	} {
+		if got := withTicket(tc.service, "ST-1"); got != tc.want {
+			t.Errorf("withTicket(%q) = %q, want %q", tc.service, got, tc.want)
+		}
+	}
+}
+
+// casLogin requests a login for the service, with the extra query
+// parameters, and returns the response.
+func casLogin(c *casServer, service, extra string, cookie *http.Cookie) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("GET", "/cas/login?service="+url.QueryEscape(service)+extra, nil)
+	if cookie != nil {
+		r.AddCookie(cookie)
+	}
+	w := httptest.NewRecorder()
+	c.login(w, r)
+	return w
+}
+
+// casTicketOf returns the ticket the login redirected back to the
+// service with, if any.
+func casTicketOf(t *testing.T, w *httptest.ResponseRecorder, service string) string {
+	t.Helper()
+	location := w.Header().Get("Location")
+	if w.Code != http.StatusSeeOther || !strings.HasPrefix(location, service+"?ticket=") {
+		t.Fatalf("got %d to %q, want a redirect to %s with a ticket", w.Code, location, service)
+	}
+	u, _ := url.Parse(location)
+	return u.Query().Get("ticket")
+}
+
+// casValidate validates the ticket at the endpoint, and returns the
+// response body.
+func casValidate(c *casServer, validate func(http.ResponseWriter, *http.Request), service, ticket, extra string) string {
+	r := httptest.NewRequest("GET", "/cas/serviceValidate?service="+url.QueryEscape(service)+"&ticket="+url.QueryEscape(ticket)+extra, nil)
+	w := httptest.NewRecorder()
+	validate(w, r)
+	return w.Body.String()
+}
+
+func TestCasLogin(t *testing.T) {
+	s, c := newTestCasServer(t)
+	service := "https://app.example/cas/login"
+
+	if w := casLogin(c, "https://other.example/", "", nil); w.Code != http.StatusBadRequest {
+		t.Errorf("got %d for an unknown service, want 400", w.Code)
+	}
+	w := casLogin(c, service, "", nil)
+	if location := w.Header().Get("Location"); w.Code != http.StatusSeeOther || !strings.HasPrefix(location, "/sso/login?next=") {
+		t.Errorf("got %d to %q, want a redirect to sign in", w.Code, location)
+	}
+	w = casLogin(c, service, "&gateway=true", nil)
+	if location := w.Header().Get("Location"); w.Code != http.StatusSeeOther || location != service {
+		t.Errorf("got %d to %q with gateway, want a redirect back without a ticket", w.Code, location)
+	}
+
+	ts, cookie := signIn(t, s, testIdpService)
+	ticket := casTicketOf(t, casLogin(c, service, "", cookie), service)
+	if !strings.HasPrefix(ticket, "ST-") {
+		t.Errorf("got ticket %q, want a service ticket", ticket)
+	}
+
+	// With renew, only a session that just started will do.
+	ts.Created = time.Now().Add(-2 * casRenewWindow)
+	if err := s.registry.put(ts); err != nil {
+		t.Fatal(err)
+	}
+	casTicketOf(t, casLogin(c, service, "", cookie), service)
+	for _, extra := range []string{"&renew=true", "&renew=true&gateway=true"} {
+		w = casLogin(c, service, extra, cookie)
+		if location := w.Header().Get("Location"); w.Code != http.StatusSeeOther || !strings.HasPrefix(location, "/sso/login?next=") || !strings.HasSuffix(location, "&renew=1") {
+			t.Errorf("got %d to %q with %s, want a redirect to sign in again", w.Code, location, extra)
+		}
+	}
+	_, fresh := signIn(t, s, testIdpService)
+	casTicketOf(t, casLogin(c, service, "&renew=true", fresh), service)
+}
+
+func TestCasValidate(t *testing.T) {
+	s, c := newTestCasServer(t)
+	service := "https://app.example/cas/login"
+	_, cookie := signIn(t, s, testIdpService)
+	account := currentAccount(t)
+	user := "<cas:user>" + account.Username + "</cas:user>"
+
+	ticket := casTicketOf(t, casLogin(c, service, "", cookie), service)
+	body := casValidate(c, c.serviceValidate, service, ticket, "")
+	if !strings.Contains(body, user) || strings.Contains(body, "cas:attributes") {
+		t.Errorf("serviceValidate returned %s, want the user without attributes", body)
+	}
+	// Tickets are single use.
+	if body := casValidate(c, c.serviceValidate, service, ticket, ""); !strings.Contains(body, `code="INVALID_TICKET"`) {
+		t.Errorf("Validating again returned %s, want INVALID_TICKET", body)
+	}
+
+	ticket = casTicketOf(t, casLogin(c, service, "", cookie), service)
+	body = casValidate(c, c.p3ServiceValidate, service, ticket, "")
+	if !strings.Contains(body, user) || !strings.Contains(body, "<cas:isFromNewLogin>false</cas:isFromNewLogin>") {
+		t.Errorf("p3/serviceValidate returned %s, want the user with attributes", body)
+	}
+
+	// A ticket for another service is used up all the same.
+	ticket = casTicketOf(t, casLogin(c, service, "", cookie), service)
+	if body := casValidate(c, c.serviceValidate, "https://app.example/cas/other", ticket, ""); !strings.Contains(body, `code="INVALID_SERVICE"`) {
+		t.Errorf("Validating for another service returned %s, want INVALID_SERVICE", body)
+	}
+	if body := casValidate(c, c.serviceValidate, service, ticket, ""); !strings.Contains(body, `code="INVALID_TICKET"`) {
+		t.Errorf("Validating after a mismatch returned %s, want INVALID_TICKET", body)
+	}
+
+	// With renew, the ticket must come from a new login.
+	ticket = casTicketOf(t, casLogin(c, service, "", cookie), service)
+	if body := casValidate(c, c.serviceValidate, service, ticket, "&renew=true"); !strings.Contains(body, `code="INVALID_TICKET_SPEC"`) {
+		t.Errorf("Validating with renew returned %s, want INVALID_TICKET_SPEC", body)
+	}
+	ticket = casTicketOf(t, casLogin(c, service, "&renew=true", cookie), service)
+	body = casValidate(c, c.p3ServiceValidate, service, ticket, "&renew=true")
+	if !strings.Contains(body, user) || !strings.Contains(body, "<cas:isFromNewLogin>true</cas:isFromNewLogin>") {
+		t.Errorf("Validating a renewed ticket returned %s, want a new login", body)
+	}
+
+	if body := casValidate(c, c.serviceValidate, service, "", ""); !strings.Contains(body, `code="INVALID_REQUEST"`) {
+		t.Errorf("Validating without a ticket returned %s, want INVALID_REQUEST", body)
+	}
+}
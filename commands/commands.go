@@ -2,51 +2,388 @@ package commands
 
 import (
 	"fmt"
+	"time"
 
+	"github.com/achernya/nonstick/pamsocket"
 	"github.com/urfave/cli/v2"
 )
 
+// serveFlags are the flags of serve, which may also be set in the
+// configuration file (see configKeys).
+var serveFlags = []cli.Flag{
+	&cli.StringFlag{
+		Name:    "config",
+		Value:   "",
+		EnvVars: []string{"NONSTICK_CONFIG"},
+		Usage:   "YAML configuration file; flags and environment variables take precedence over it. It is reloaded on SIGHUP, or when it changes",
+	},
+	&cli.IntFlag{
+		Name:  "port",
+		Usage: "Port to serve on; required",
+	},
+	&cli.StringFlag{
+		Name:  "tls_cert",
+		Value: "",
+		Usage: "PEM file with the certificate to serve HTTPS with; HTTP is served if empty",
+	},
+	&cli.StringFlag{
+		Name:  "tls_key",
+		Value: "",
+		Usage: "PEM file with the key for --tls_cert",
+	},
+	&cli.StringFlag{
+		Name:  "public_url",
+		Value: "",
+		Usage: "URL users reach nonstick at (e.g., https://idp.example.com), used to build absolute URLs such as callbacks; if empty, an address of a local interface and --port are used",
+	},
+	&cli.StringFlag{
+		Name:  "env",
+		Value: "dev",
+		Usage: "Environment to run, either 'dev', or 'prod'",
+	},
+	&cli.StringFlag{
+		Name:  "templates_dir",
+		Value: "",
+		Usage: "Directory with pages/ and includes/ to load the page templates from, instead of the built-in ones",
+	},
+	&cli.StringFlag{
+		Name:    "session_secret",
+		Value:   "",
+		EnvVars: []string{"SESSION_SECRET"},
+		Usage:   "Secret authenticating session cookies (required)",
+	},
+	&cli.StringFlag{
+		Name:    "csrf_secret",
+		Value:   "",
+		EnvVars: []string{"NONSTICK_CSRF_SECRET"},
+		Usage:   "32-byte secret string for CSRF protection; required",
+	},
+	&cli.StringFlag{
+		Name:  "login_flow",
+		Value: "hydra",
+		Usage: "Which login flow is in use [valid values: hydra, noop]",
+		Action: func(ctx *cli.Context, v string) error {
+			switch v {
+			case "hydra":
+				return nil
+			case "noop":
+				return nil
+			default:
+				return fmt.Errorf("flow %v not known", v)
+			}
+		},
+	},
+	&cli.StringFlag{
+		Name:  "hydra_admin_url",
+		Value: "http://localhost:4445",
+		Usage: "URL of the Ory Hydra admin API, for the hydra login flow",
+	},
+	&cli.StringSliceFlag{
+		Name:  "scope",
+		Usage: "Description of an OAuth2 scope on the consent page, as scope=description; may be repeated",
+		Action: func(ctx *cli.Context, v []string) error {
+			_, err := parseScopes(v)
+			return err
+		},
+	},
+	&cli.StringFlag{
+		Name:    "oidc_client_id",
+		Value:   "",
+		EnvVars: []string{"OPENID_CONNECT_KEY"},
+		Usage:   "OAuth2 client ID of the built-in OpenID Connect test app",
+	},
+	&cli.StringFlag{
+		Name:    "oidc_client_secret",
+		Value:   "",
+		EnvVars: []string{"OPENID_CONNECT_SECRET"},
+		Usage:   "OAuth2 client secret of the built-in OpenID Connect test app",
+	},
+	&cli.StringFlag{
+		Name:    "oidc_discovery_url",
+		Value:   "",
+		EnvVars: []string{"OPENID_CONNECT_DISCOVERY_URL"},
+		Usage:   "OpenID Connect discovery URL the built-in test app signs in with",
+	},
+	&cli.StringFlag{
+		Name:  "webauthn",
+		Value: "off",
+		Usage: "Whether a WebAuthn credential is needed after PAM [valid values: off, optional, required]",
+		Action: func(ctx *cli.Context, v string) error {
+			_, err := pamsocket.ParseWebAuthnPolicy(v)
+			return err
+		},
+	},
+	&cli.BoolFlag{
+		Name:  "webauthn_enroll",
+		Value: false,
+		Usage: "if true, users without a WebAuthn credential are asked to register one after PAM",
+	},
+	&cli.StringFlag{
+		Name:  "webauthn_rpid",
+		Value: "",
+		Usage: "WebAuthn relying party ID, typically the domain nonstick is served from",
+	},
+	&cli.StringSliceFlag{
+		Name:  "webauthn_origin",
+		Usage: "Origin (e.g., https://idp.example.com) permitted to use WebAuthn; may be repeated",
+	},
+	&cli.StringFlag{
+		Name:  "webauthn_dir",
+		Value: "webauthn/",
+		Usage: "Directory in which per-user WebAuthn credentials are stored",
+	},
+	&cli.StringSliceFlag{
+		Name:  "pam_claim",
+		Usage: "Expose a PAM environment variable or item as an ID token claim, as claim=env:NAME or claim=item:PAM_RHOST, released with the scope of the same name or the one given by an @scope suffix; may be repeated",
+		Action: func(ctx *cli.Context, v []string) error {
+			_, err := pamsocket.ParseClaims(v)
+			return err
+		},
+	},
+	&cli.StringSliceFlag{
+		Name:  "trusted_proxy",
+		Usage: "IP address or CIDR range of a reverse proxy whose Forwarded and X-Forwarded-* headers are trusted, to learn the client's address, scheme and host; may be repeated",
+		Action: func(ctx *cli.Context, v []string) error {
+			_, err := pamsocket.ParseTrustedProxies(v)
+			return err
+		},
+	},
+	&cli.StringFlag{
+		Name:  "pam_tty",
+		Value: "nonstick",
+		Usage: "Value of PAM_TTY for web logins, e.g. for matching in pam_access",
+	},
+	&cli.StringFlag{
+		Name:  "pam_xdisplay",
+		Value: "",
+		Usage: "Value of PAM_XDISPLAY for web logins, if any",
+	},
+	&cli.StringFlag{
+		Name:  "pam_helper",
+		Value: "",
+		Usage: "UNIX socket of a privileged nonstick pam-helper; if unset, PAM runs in this process",
+	},
+	&cli.IntFlag{
+		Name:  "pam_workers",
+		Value: 0,
+		Usage: "if positive, run each PAM transaction in an isolated subprocess, keeping this many ready; ignored with --pam_helper",
+	},
+	&cli.StringFlag{
+		Name:  "idp_service",
+		Value: "google-authenticator",
+		Usage: "PAM service users authenticate with to sign in to relying parties, over OIDC, SAML, CAS or forward auth",
+	},
+	&cli.StringFlag{
+		Name:  "enroll_service",
+		Value: "password",
+		Usage: "PAM service used to sign in to nonstick's own pages, such as one-time code enrollment",
+	},
+	&cli.StringFlag{
+		Name:  "saml_key",
+		Value: "",
+		Usage: "PEM file with the key signing SAML assertions; the SAML identity provider is disabled if empty",
+	},
+	&cli.StringFlag{
+		Name:  "saml_cert",
+		Value: "",
+		Usage: "PEM file with the certificate for --saml_key, published in the SAML metadata",
+	},
+	&cli.StringFlag{
+		Name:  "saml_base_url",
+		Value: "",
+		Usage: "Public URL (e.g., https://idp.example.com) the SAML endpoints are served under; defaults to --public_url",
+	},
+	&cli.StringSliceFlag{
+		Name:  "saml_sp",
+		Usage: "SAML service provider metadata file; may be repeated",
+	},
+	&cli.StringSliceFlag{
+		Name:  "cas_service",
+		Usage: "URL prefix (e.g., https://app.example.com/) of a CAS service allowed to sign in with nonstick; may be repeated. The CAS server is disabled if none are given",
+	},
+	&cli.StringSliceFlag{
+		Name:  "forward_auth_host",
+		Usage: "Host (e.g., app.example.com, or *.example.com) whose apps reverse proxies listed in --trusted_proxy may put behind /auth/verify, optionally followed by =<group> to require membership of that group (or any of the groups, if repeated); may be repeated",
+	},
+	&cli.StringFlag{
+		Name:  "forward_auth_signin",
+		Value: "",
+		Usage: "Absolute URL of /auth/signin as users reach it (e.g., https://idp.example.com/auth/signin), to redirect unauthenticated users to; defaults to /auth/signin under --public_url, if that is set. Otherwise, /auth/verify only answers 401",
+	},
+	&cli.StringFlag{
+		Name:  "cookie_domain",
+		Value: "",
+		Usage: "Domain (e.g., example.com) of the forward auth cookie, so it is sent along with requests to the apps' hosts; by default, it is only sent to nonstick. nonstick's own session cookie is never shared",
+	},
+	&cli.StringFlag{
+		Name:  "ldap_addr",
+		Value: "",
+		Usage: "Address (e.g., :636) to serve LDAP simple binds and user/group searches on; disabled if empty",
+	},
+	&cli.StringFlag{
+		Name:  "ldap_base_dn",
+		Value: "dc=nonstick",
+		Usage: "Base DN of the LDAP directory; users are uid=<user>,ou=people,<base> and groups cn=<group>,ou=groups,<base>",
+	},
+	&cli.StringFlag{
+		Name:  "ldap_service",
+		Value: "password",
+		Usage: "PAM service LDAP binds authenticate with; it may only prompt for a password",
+	},
+	&cli.StringFlag{
+		Name:  "ldap_cert",
+		Value: "",
+		Usage: "PEM file with the LDAP server's certificate, to serve LDAP with TLS; required unless --ldap_insecure",
+	},
+	&cli.StringFlag{
+		Name:  "ldap_key",
+		Value: "",
+		Usage: "PEM file with the key for --ldap_cert",
+	},
+	&cli.BoolFlag{
+		Name:  "ldap_insecure",
+		Value: false,
+		Usage: "Serve LDAP without TLS, sending passwords in the clear; only for testing",
+	},
+	&cli.StringFlag{
+		Name:  "radius_addr",
+		Value: "",
+		Usage: "Address (e.g., :1812) to serve RADIUS Access-Requests on; disabled if empty",
+	},
+	&cli.StringFlag{
+		Name:  "radius_service",
+		Value: "google-authenticator",
+		Usage: "PAM service RADIUS Access-Requests authenticate with; its first hidden prompt is answered with the password",
+	},
+	&cli.StringFlag{
+		Name:    "radius_secret",
+		Value:   "",
+		EnvVars: []string{"NONSTICK_RADIUS_SECRET"},
+		Usage:   "RADIUS shared secret; required with --radius_addr",
+	},
+	&cli.StringFlag{
+		Name:  "session_store",
+		Value: "cookie",
+		Usage: "Where sessions and other state are kept [valid values: cookie, which keeps sessions in cookies and the rest in memory; file; bolt; redis]",
+		Action: func(ctx *cli.Context, v string) error {
+			switch v {
+			case "cookie", "file", "bolt", "redis":
+				return nil
+			default:
+				return fmt.Errorf("session store %v not known", v)
+			}
+		},
+	},
+	&cli.StringFlag{
+		Name:  "session_path",
+		Value: "",
+		Usage: "Directory of the file session store, or database file of the bolt session store",
+	},
+	&cli.StringFlag{
+		Name:    "redis_url",
+		Value:   "",
+		EnvVars: []string{"NONSTICK_REDIS_URL"},
+		Usage:   "URL (e.g., redis://localhost:6379/0) of the Redis server for the redis session store",
+	},
+	&cli.StringFlag{
+		Name:  "replica_url",
+		Value: "",
+		Usage: "URL (e.g., http://10.0.0.5:8080) other replicas reach this one at; if set, sign-ins in progress are recorded in the session store, and requests for them reaching another replica are passed on to this one, which trusts the replicas sharing its session secret as proxies",
+	},
+	&cli.DurationFlag{
+		Name:  "session_idle_timeout",
+		Value: 2 * time.Hour,
+		Usage: "How long a nonstick session may go unused before the user must sign in again",
+	},
+	&cli.DurationFlag{
+		Name:  "session_lifetime",
+		Value: 24 * time.Hour,
+		Usage: "How long after signing in a nonstick session ends, however much it is used",
+	},
+	&cli.StringFlag{
+		Name:  "admin_addr",
+		Value: "",
+		Usage: "Address (e.g., localhost:9100) for operational endpoints such as /debug/vars and /sessions; disabled if empty. Without --admin_token, it must be a loopback address",
+	},
+	&cli.StringFlag{
+		Name:    "admin_token",
+		Value:   "",
+		EnvVars: []string{"NONSTICK_ADMIN_TOKEN"},
+		Usage:   "Bearer token required by the operational endpoints of --admin_addr",
+	},
+	&cli.BoolFlag{
+		Name:  "use_dotenv",
+		Value: false,
+		Usage: "if true, read .env files",
+	},
+}
+
 var Commands = []*cli.Command{
 	{
 		Name:   "serve",
 		Usage:  "Start web server",
 		Action: serve,
+		Flags:  serveFlags,
+	},
+	{
+		Name:  "config",
+		Usage: "Work with configuration files",
+		Subcommands: []*cli.Command{
+			{
+				Name:      "validate",
+				Usage:     "Check a configuration file for serve, and report any problems with their line numbers",
+				ArgsUsage: "FILE",
+				Action:    validateConfig,
+			},
+		},
+	},
+	{
+		Name:   "pam-helper",
+		Usage:  "Run PAM transactions on behalf of an unprivileged serve",
+		Action: pamHelper,
 		Flags: []cli.Flag{
-			&cli.IntFlag{
-				Name:     "port",
+			&cli.StringFlag{
+				Name:     "socket",
 				Required: true,
+				Usage:    "Path of the UNIX socket to listen on",
 			},
 			&cli.StringFlag{
-				Name:  "env",
-				Value: "dev",
-				Usage: "Environment to run, either 'dev', or 'prod'",
+				Name:  "socket_group",
+				Value: "",
+				Usage: "Group permitted to connect to the socket, typically the one serve runs as",
 			},
 			&cli.StringFlag{
-				Name:     "csrf_secret",
-				Value:    "",
+				Name:  "pam_confdir",
+				Value: "pam.d/",
+				Usage: "Directory where the PAM service configurations live",
+			},
+			&cli.StringSliceFlag{
+				Name:     "service",
 				Required: true,
-				EnvVars:  []string{"NONSTICK_CSRF_SECRET"},
-				Usage:    "32-byte secret string for CSRF protection",
+				Usage:    "PAM service clients may use; may be repeated. No others may be used",
 			},
-			&cli.StringFlag{
-				Name:  "login_flow",
-				Value: "hydra",
-				Usage: "Which login flow is in use [valid values: hydra, noop]",
-				Action: func(ctx *cli.Context, v string) error {
-					switch v {
-					case "hydra":
-						return nil
-					case "noop":
-						return nil
-					default:
-						return fmt.Errorf("flow %v not known", v)
-					}
-				},
+			&cli.IntFlag{
+				Name:  "workers",
+				Value: 0,
+				Usage: "if positive, run each PAM transaction in an isolated subprocess, keeping this many ready",
 			},
 			&cli.BoolFlag{
-				Name:  "use_dotenv",
+				Name:  "enroll",
 				Value: false,
-				Usage: "if true, read .env files",
+				Usage: "Write one-time code enrollments into users' home directories on behalf of serve",
+			},
+		},
+	},
+	{
+		Name:   "pam-worker",
+		Usage:  "Run a single PAM transaction over stdin and stdout",
+		Hidden: true,
+		Action: pamWorker,
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:  "pam_confdir",
+				Value: "pam.d/",
+				Usage: "Directory where the PAM service configurations live",
 			},
 		},
 	},
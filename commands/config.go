@@ -0,0 +1,361 @@
+package commands
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/urfave/cli/v2"
+	"gopkg.in/yaml.v3"
+)
+
+// configKeys maps the settings of the configuration file to the
+// flags of serve they stand for. Flags given on the command line, or
+// through the environment, take precedence over the file.
+var configKeys = map[string]string{
+	"listen.port":            "port",
+	"listen.tls.cert":        "tls_cert",
+	"listen.tls.key":         "tls_key",
+	"listen.public_url":      "public_url",
+	"listen.admin_addr":      "admin_addr",
+	"listen.trusted_proxies": "trusted_proxy",
+	"listen.replica_url":     "replica_url",
+
+	"secrets.session": "session_secret",
+	"secrets.csrf":    "csrf_secret",
+	"secrets.admin":   "admin_token",
+
+	"ui.env":           "env",
+	"ui.templates_dir": "templates_dir",
+
+	"flow.login":      "login_flow",
+	"hydra.admin_url": "hydra_admin_url",
+	"scopes":          "scope",
+
+	"test_app.client_id":     "oidc_client_id",
+	"test_app.client_secret": "oidc_client_secret",
+	"test_app.discovery_url": "oidc_discovery_url",
+
+	"pam.services.idp":    "idp_service",
+	"pam.services.enroll": "enroll_service",
+	"pam.services.ldap":   "ldap_service",
+	"pam.services.radius": "radius_service",
+	"pam.claims":          "pam_claim",
+	"pam.tty":             "pam_tty",
+	"pam.xdisplay":        "pam_xdisplay",
+	"pam.helper":          "pam_helper",
+	"pam.workers":         "pam_workers",
+
+	"webauthn.policy":  "webauthn",
+	"webauthn.enroll":  "webauthn_enroll",
+	"webauthn.rpid":    "webauthn_rpid",
+	"webauthn.origins": "webauthn_origin",
+	"webauthn.dir":     "webauthn_dir",
+
+	"sessions.store":        "session_store",
+	"sessions.path":         "session_path",
+	"sessions.redis_url":    "redis_url",
+	"sessions.idle_timeout": "session_idle_timeout",
+	"sessions.lifetime":     "session_lifetime",
+
+	"saml.key":               "saml_key",
+	"saml.cert":              "saml_cert",
+	"saml.base_url":          "saml_base_url",
+	"saml.service_providers": "saml_sp",
+
+	"cas.services": "cas_service",
+
+	"forward_auth.hosts":         "forward_auth_host",
+	"forward_auth.signin":        "forward_auth_signin",
+	"forward_auth.cookie_domain": "cookie_domain",
+
+	"ldap.addr":     "ldap_addr",
+	"ldap.base_dn":  "ldap_base_dn",
+	"ldap.cert":     "ldap_cert",
+	"ldap.key":      "ldap_key",
+	"ldap.insecure": "ldap_insecure",
+
+	"radius.addr":   "radius_addr",
+	"radius.secret": "radius_secret",
+}
+
+// configMaps are the list settings that may also be written as a
+// mapping, each entry of which becomes `key=value`.
+var configMaps = []string{"scopes", "pam.claims"}
+
+// configSetting is a setting from the configuration file.
+type configSetting struct {
+	key    string
+	values []string
+	line   int
+}
+
+// configParser validates a configuration file against the flags of
+// serve.
+type configParser struct {
+	filename string
+	flags    map[string]cli.Flag
+	settings map[string]*configSetting
+	errs     []error
+}
+
+func (p *configParser) errorf(node *yaml.Node, format string, args ...interface{}) {
+	p.errs = append(p.errs, fmt.Errorf("%s:%d: %s", p.filename, node.Line, fmt.Sprintf(format, args...)))
+}
+
+// section reports whether key has settings below it.
+func section(key string) bool {
+	for setting := range configKeys {
+		if strings.HasPrefix(setting, key+".") {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *configParser) walk(node *yaml.Node, prefix string) {
+	if node.Kind != yaml.MappingNode {
+		p.errorf(node, "%s must be a mapping", strings.TrimSuffix(prefix, "."))
+		return
+	}
+	seen := make(map[string]bool)
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		keyNode, value := node.Content[i], node.Content[i+1]
+		key := prefix + keyNode.Value
+		if seen[key] {
+			p.errorf(keyNode, "%s is set more than once", key)
+			continue
+		}
+		seen[key] = true
+		if name, ok := configKeys[key]; ok {
+			p.setting(key, p.flags[name], value)
+		} else if section(key) {
+			p.walk(value, key+".")
+		} else {
+			p.errorf(keyNode, "unknown setting %s", key)
+		}
+	}
+}
+
+// setting checks the value has the type of the flag, and records it.
+func (p *configParser) setting(key string, flag cli.Flag, node *yaml.Node) {
+	s := &configSetting{key: key, line: node.Line}
+	scalar := func(tag, kind string) bool {
+		if node.Kind != yaml.ScalarNode || (tag != "" && node.Tag != tag) {
+			p.errorf(node, "%s must be %s", key, kind)
+			return false
+		}
+		s.values = []string{node.Value}
+		return true
+	}
+	switch flag.(type) {
+	case *cli.IntFlag:
+		if !scalar("!!int", "an integer") {
+			return
+		}
+	case *cli.BoolFlag:
+		if !scalar("!!bool", "true or false") {
+			return
+		}
+	case *cli.DurationFlag:
+		if !scalar("!!str", "a duration (e.g., 2h)") {
+			return
+		}
+		if _, err := time.ParseDuration(node.Value); err != nil {
+			p.errorf(node, "%s must be a duration (e.g., 2h)", key)
+			return
+		}
+	case *cli.StringFlag:
+		if node.Tag == "!!null" {
+			p.errorf(node, "%s must be a string", key)
+			return
+		}
+		if !scalar("", "a string") {
+			return
+		}
+	case *cli.StringSliceFlag:
+		switch {
+		case node.Kind == yaml.MappingNode && slices.Contains(configMaps, key):
+			for i := 0; i+1 < len(node.Content); i += 2 {
+				k, v := node.Content[i], node.Content[i+1]
+				if v.Kind != yaml.ScalarNode {
+					p.errorf(v, "%s.%s must be a string", key, k.Value)
+					return
+				}
+				s.values = append(s.values, k.Value+"="+v.Value)
+			}
+		case node.Kind == yaml.SequenceNode:
+			for _, item := range node.Content {
+				if item.Kind != yaml.ScalarNode {
+					p.errorf(item, "the entries of %s must be strings", key)
+					return
+				}
+				s.values = append(s.values, item.Value)
+			}
+		default:
+			p.errorf(node, "%s must be a list", key)
+			return
+		}
+	}
+	if err := runFlagAction(flag, s.values); err != nil {
+		p.errorf(node, "%s: %v", key, err)
+		return
+	}
+	p.settings[flag.Names()[0]] = s
+}
+
+// runFlagAction runs the checks of the flag on values it would be
+// set to.
+func runFlagAction(flag cli.Flag, values []string) error {
+	switch f := flag.(type) {
+	case *cli.StringFlag:
+		if f.Action != nil && len(values) == 1 {
+			return f.Action(nil, values[0])
+		}
+	case *cli.StringSliceFlag:
+		if f.Action != nil {
+			return f.Action(nil, values)
+		}
+	}
+	return nil
+}
+
+// parseConfig parses a configuration file, and checks every setting
+// is known, and valid for its flag. All problems found are returned,
+// each with the line it is on.
+func parseConfig(filename string, data []byte, flags []cli.Flag) (map[string]*configSetting, error) {
+	p := &configParser{
+		filename: filename,
+		flags:    make(map[string]cli.Flag),
+		settings: make(map[string]*configSetting),
+	}
+	for _, flag := range flags {
+		p.flags[flag.Names()[0]] = flag
+	}
+	for key, name := range configKeys {
+		if p.flags[name] == nil {
+			return nil, fmt.Errorf("setting %s is for unknown flag --%s", key, name)
+		}
+	}
+
+	doc := &yaml.Node{}
+	if err := yaml.Unmarshal(data, doc); err != nil {
+		return nil, fmt.Errorf("%s: %w", filename, err)
+	}
+	if len(doc.Content) == 0 {
+		// An empty file sets nothing.
+		return p.settings, nil
+	}
+	p.walk(doc.Content[0], "")
+	return p.settings, errors.Join(p.errs...)
+}
+
+// readConfig reads and parses the configuration file.
+func readConfig(filename string, flags []cli.Flag) (map[string]*configSetting, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	return parseConfig(filename, data, flags)
+}
+
+// envVars returns the environment variables that may set the flag:
+// those it declares, and NONSTICK_ followed by its name in upper
+// case.
+func envVars(flag cli.Flag) []string {
+	var result []string
+	if f, ok := flag.(cli.DocGenerationFlag); ok {
+		result = append(result, f.GetEnvVars()...)
+	}
+	return append(result, "NONSTICK_"+strings.ToUpper(flag.Names()[0]))
+}
+
+// splitEnvList splits a list from the environment at commas. A comma
+// or backslash within a value (e.g., a scope description) is escaped
+// with a backslash.
+func splitEnvList(value string) []string {
+	var result []string
+	var current strings.Builder
+	escaped := false
+	for _, r := range value {
+		switch {
+		case escaped:
+			current.WriteRune(r)
+			escaped = false
+		case r == '\\':
+			escaped = true
+		case r == ',':
+			result = append(result, current.String())
+			current.Reset()
+		default:
+			current.WriteRune(r)
+		}
+	}
+	if escaped {
+		current.WriteRune('\\')
+	}
+	return append(result, current.String())
+}
+
+// loadConfig sets the flags of serve not given on the command line
+// from the environment, or else the configuration file, if any. Lists
+// in the environment are separated by commas (see splitEnvList). The
+// settings taken from the file are returned, by flag name.
+func loadConfig(c *cli.Context) (map[string]*configSetting, error) {
+	var settings map[string]*configSetting
+	if filename := c.String("config"); filename != "" {
+		var err error
+		settings, err = readConfig(filename, c.Command.Flags)
+		if err != nil {
+			return nil, err
+		}
+		log.Info().Msgf("Loaded configuration from %s", filename)
+	}
+	applied := make(map[string]*configSetting)
+	for _, flag := range c.Command.Flags {
+		name := flag.Names()[0]
+		if name == "config" || c.IsSet(name) {
+			continue
+		}
+		var values []string
+		for _, env := range envVars(flag) {
+			if value, ok := os.LookupEnv(env); ok {
+				values = []string{value}
+				if _, ok := flag.(*cli.StringSliceFlag); ok {
+					values = splitEnvList(value)
+				}
+				if err := runFlagAction(flag, values); err != nil {
+					return nil, fmt.Errorf("%s: %w", env, err)
+				}
+				break
+			}
+		}
+		if values == nil && settings[name] != nil {
+			values = settings[name].values
+			applied[name] = settings[name]
+		}
+		for _, value := range values {
+			if err := c.Set(name, value); err != nil {
+				return nil, fmt.Errorf("could not set --%s: %w", name, err)
+			}
+		}
+	}
+	return applied, nil
+}
+
+// validateConfig checks a configuration file, for `nonstick config
+// validate`.
+func validateConfig(c *cli.Context) error {
+	if c.NArg() != 1 {
+		return errors.New("usage: nonstick config validate FILE")
+	}
+	if _, err := readConfig(c.Args().First(), serveFlags); err != nil {
+		return err
+	}
+	fmt.Fprintf(c.App.Writer, "%s is valid\n", c.Args().First())
+	return nil
+}
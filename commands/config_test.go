@@ -0,0 +1,181 @@
+package commands
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/urfave/cli/v2"
+)
+
+func TestParseConfig(t *testing.T) {
+	for _, tc := range []struct {
+		name, config string
+		// want maps flags to the values they are set to.
+		want map[string][]string
+	}{
+		{"empty", "", map[string][]string{}},
+		{"scalars", `
+listen:
+  port: 8080
+  public_url: https://idp.example
+ldap:
+  insecure: true
+sessions:
+  lifetime: 12h
+`, map[string][]string{
+			"port":             {"8080"},
+			"public_url":       {"https://idp.example"},
+			"ldap_insecure":    {"true"},
+			"session_lifetime": {"12h"},
+		}},
+		{"lists", `
+listen:
+  trusted_proxies: [10.0.0.0/8, 192.0.2.1]
+scopes:
+  email: Your email address
+pam:
+  services:
+    idp: totp
+  claims:
+    - email=env:EMAIL
+`, map[string][]string{
+			"trusted_proxy": {"10.0.0.0/8", "192.0.2.1"},
+			"scope":         {"email=Your email address"},
+			"idp_service":   {"totp"},
+			"pam_claim":     {"email=env:EMAIL"},
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			settings, err := parseConfig("nonstick.yaml", []byte(tc.config), serveFlags)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := make(map[string][]string)
+			for name, s := range settings {
+				got[name] = s.values
+			}
+			if len(got) != len(tc.want) {
+				t.Errorf("parseConfig() = %v, want %v", got, tc.want)
+			}
+			for name, values := range tc.want {
+				if !slices.Equal(got[name], values) {
+					t.Errorf("--%s = %q, want %q", name, got[name], values)
+				}
+			}
+		})
+	}
+}
+
+func TestParseConfigInvalid(t *testing.T) {
+	for _, tc := range []struct {
+		name, config, want string
+	}{
+		{"unknown key", "listen:\n  prot: 8080\n", "nonstick.yaml:2: unknown setting listen.prot"},
+		{"unknown section", "lisen:\n  port: 8080\n", "unknown setting lisen"},
+		{"section as a value", "listen: 8080\n", "listen must be a mapping"},
+		{"not a mapping", "- port\n", "must be a mapping"},
+		{"duplicate key", "listen:\n  port: 8080\n  port: 8081\n", "listen.port is set more than once"},
+		{"duplicate section", "listen:\n  port: 8080\nlisten:\n  admin_addr: :8081\n", "listen is set more than once"},
+		{"string for an integer", "listen:\n  port: http\n", "listen.port must be an integer"},
+		{"quoted integer", "listen:\n  port: \"8080\"\n", "listen.port must be an integer"},
+		{"string for a bool", "ldap:\n  insecure: sometimes\n", "ldap.insecure must be true or false"},
+		{"invalid duration", "sessions:\n  lifetime: forever\n", "sessions.lifetime must be a duration"},
+		{"integer for a duration", "sessions:\n  lifetime: 3600\n", "sessions.lifetime must be a duration"},
+		{"null string", "secrets:\n  session:\n", "secrets.session must be a string"},
+		{"list for a string", "secrets:\n  session: [a, b]\n", "secrets.session must be a string"},
+		{"string for a list", "listen:\n  trusted_proxies: 10.0.0.0/8\n", "listen.trusted_proxies must be a list"},
+		{"nested list", "listen:\n  trusted_proxies: [[10.0.0.0/8]]\n", "the entries of listen.trusted_proxies must be strings"},
+		{"mapping for a list", "cas:\n  services:\n    a: b\n", "cas.services must be a list"},
+		{"invalid value", "pam:\n  claims: [email=email]\n", "pam.claims: claim mapping"},
+		{"syntax error", "listen: [\n", "nonstick.yaml"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := parseConfig("nonstick.yaml", []byte(tc.config), serveFlags)
+			if err == nil || !strings.Contains(err.Error(), tc.want) {
+				t.Errorf("parseConfig() returned %v, want %q", err, tc.want)
+			}
+		})
+	}
+
+	// Every problem is reported at once.
+	_, err := parseConfig("nonstick.yaml", []byte("listen:\n  prot: 1\n  port: x\n"), serveFlags)
+	if err == nil || !strings.Contains(err.Error(), ":2: unknown setting") || !strings.Contains(err.Error(), ":3: listen.port") {
+		t.Errorf("parseConfig() returned %v, want both problems", err)
+	}
+}
+
+// runServeFlags runs a command with the flags of serve, and the
+// arguments, returning the values of the flags after loading the
+// configuration.
+func runServeFlags(t *testing.T, args ...string) map[string]string {
+	t.Helper()
+	got := make(map[string]string)
+	app := &cli.App{
+		// As in main.
+		DisableSliceFlagSeparator: true,
+		Commands: []*cli.Command{{
+			Name:  "serve",
+			Flags: serveFlags,
+			Action: func(c *cli.Context) error {
+				if _, err := loadConfig(c); err != nil {
+					return err
+				}
+				for _, name := range []string{"port", "session_secret", "idp_service", "ldap_service", "session_lifetime"} {
+					got[name] = fmt.Sprint(c.Value(name))
+				}
+				got["trusted_proxy"] = strings.Join(c.StringSlice("trusted_proxy"), " ")
+				got["scope"] = strings.Join(c.StringSlice("scope"), "|")
+				return nil
+			},
+		}},
+	}
+	if err := app.Run(append([]string{"nonstick", "serve"}, args...)); err != nil {
+		t.Fatal(err)
+	}
+	return got
+}
+
+func TestLoadConfigPrecedence(t *testing.T) {
+	config := filepath.Join(t.TempDir(), "nonstick.yaml")
+	if err := os.WriteFile(config, []byte(`
+listen:
+  port: 8080
+  trusted_proxies: [10.0.0.0/8]
+secrets:
+  session: from-file
+pam:
+  services:
+    idp: file-idp
+    ldap: file-ldap
+`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("SESSION_SECRET", "from-env")
+	t.Setenv("NONSTICK_IDP_SERVICE", "env-idp")
+	t.Setenv("NONSTICK_TRUSTED_PROXY", "192.0.2.1,192.0.2.2")
+	t.Setenv("NONSTICK_SCOPE", `groups=Read your groups\, and roles,drive=Read C:\\files`)
+	t.Setenv("NONSTICK_SESSION_LIFETIME", "2h")
+
+	got := runServeFlags(t, "--config", config, "--idp_service", "flag-idp")
+	for name, want := range map[string]string{
+		// The command line comes first,
+		"idp_service": "flag-idp",
+		// then the environment, by the flag's own variables
+		// or NONSTICK_ ones,
+		"session_secret":   "from-env",
+		"trusted_proxy":    "192.0.2.1 192.0.2.2",
+		"scope":            `groups=Read your groups, and roles|drive=Read C:\files`,
+		"session_lifetime": "2h0m0s",
+		// then the file.
+		"port":         "8080",
+		"ldap_service": "file-ldap",
+	} {
+		if got[name] != want {
+			t.Errorf("--%s = %q, want %q", name, got[name], want)
+		}
+	}
+}
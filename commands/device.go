@@ -0,0 +1,118 @@
+package commands
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/gorilla/csrf"
+	"github.com/rs/zerolog/log"
+)
+
+// errInvalidUserCode is returned by deviceFlow.AcceptUserCode if the
+// user code is wrong, or has expired.
+var errInvalidUserCode = errors.New("invalid user code")
+
+// deviceFlow is implemented by login flows that support the OAuth2
+// device authorization grant, where the user signs in on a different
+// device than the one being authorized.
+type deviceFlow interface {
+	// AcceptUserCode checks the user code the user entered for
+	// the device challenge, and returns the URL to redirect to,
+	// which continues with the usual login and consent.
+	AcceptUserCode(ctx context.Context, deviceChallenge, userCode string) (string, error)
+}
+
+// AcceptUserCode accepts a device user code. hydra-client-go does
+// not cover the device flow yet, so this calls the admin API
+// directly.
+func (o *OryHydraFlow) AcceptUserCode(ctx context.Context, deviceChallenge, userCode string) (string, error) {
+	config := o.client.GetConfig()
+	endpoint := config.Servers[0].URL + "/admin/oauth2/auth/requests/device/accept?device_challenge=" + url.QueryEscape(deviceChallenge)
+	body, err := json.Marshal(map[string]string{"user_code": userCode})
+	if err != nil {
+		return "", err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for header, value := range config.DefaultHeader {
+		req.Header.Set(header, value)
+	}
+	client := config.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusOK:
+		result := struct {
+			RedirectTo string `json:"redirect_to"`
+		}{}
+		if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+			return "", fmt.Errorf("could not decode device accept response: %w", err)
+		}
+		return result.RedirectTo, nil
+	case resp.StatusCode >= 400 && resp.StatusCode < 500:
+		hydraErr := struct {
+			Error       string `json:"error"`
+			Description string `json:"error_description"`
+		}{}
+		json.NewDecoder(resp.Body).Decode(&hydraErr)
+		return "", fmt.Errorf("%w: %s: %s", errInvalidUserCode, hydraErr.Error, hydraErr.Description)
+	default:
+		return "", fmt.Errorf("device accept failed with status %d", resp.StatusCode)
+	}
+}
+
+// getDevice shows the form to enter the user code shown on the
+// device. Hydra sends the user here with a `device_challenge`, and,
+// if they followed the complete verification URI, the `user_code`.
+func (s *server) getDevice(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Query().Get("device_challenge") == "" {
+		s.respondWithError(w, r, "Please start from the link or code shown on your device.")
+		return
+	}
+	s.renderTemplate("device", map[string]interface{}{
+		"CsrfField": csrf.TemplateField(r),
+		"UserCode":  r.URL.Query().Get("user_code"),
+	}, w)
+}
+
+func (s *server) postDevice(w http.ResponseWriter, r *http.Request) {
+	flow := s.flow.(deviceFlow)
+	redirect, err := flow.AcceptUserCode(r.Context(), r.URL.Query().Get("device_challenge"), r.PostFormValue("user_code"))
+	if errors.Is(err, errInvalidUserCode) {
+		log.Info().Err(err).Msg("Rejected device user code")
+		s.renderStatus(http.StatusBadRequest, "device", map[string]interface{}{
+			"CsrfField": csrf.TemplateField(r),
+			"UserCode":  r.PostFormValue("user_code"),
+			"Error":     "That code is not valid, or has expired.",
+		}, w)
+		return
+	}
+	if err != nil {
+		s.internalError(w, r, err)
+		return
+	}
+	http.Redirect(w, r, redirect, http.StatusSeeOther)
+}
+
+// deviceDone is where Hydra sends the user once the device is
+// authorized.
+func (s *server) deviceDone(w http.ResponseWriter, r *http.Request) {
+	s.renderTemplate("device", map[string]interface{}{
+		"Done": true,
+	}, w)
+}
@@ -0,0 +1,89 @@
+package commands
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestAcceptUserCode(t *testing.T) {
+	fake := &fakeHydra{userCode: "ABCD-EFGH"}
+	ts := httptest.NewServer(fake)
+	defer ts.Close()
+	flow := NewOryHydraFlow(ts.URL, defaultScopes)
+
+	redirect, err := flow.AcceptUserCode(context.Background(), "device", "ABCD-EFGH")
+	if err != nil || redirect != "https://hydra.example/device/next" {
+		t.Errorf("AcceptUserCode() = %q, %v", redirect, err)
+	}
+	if _, err := flow.AcceptUserCode(context.Background(), "device", "WXYZ-WXYZ"); !errors.Is(err, errInvalidUserCode) {
+		t.Errorf("got %v for a wrong code, want errInvalidUserCode", err)
+	}
+	if _, err := flow.AcceptUserCode(context.Background(), "other", "ABCD-EFGH"); !errors.Is(err, errInvalidUserCode) {
+		t.Errorf("got %v for another challenge, want errInvalidUserCode", err)
+	}
+	fake.userCode = ""
+	if _, err := flow.AcceptUserCode(context.Background(), "device", "ABCD-EFGH"); err == nil || errors.Is(err, errInvalidUserCode) {
+		t.Errorf("got %v when Hydra fails, want an internal error", err)
+	}
+}
+
+func TestGetDevice(t *testing.T) {
+	s := newTestServer(t)
+	for _, tc := range []struct {
+		name   string
+		query  string
+		status int
+		want   string
+	}{
+		{"no challenge", "", http.StatusBadRequest, "start from the link or code"},
+		{"challenge", "?device_challenge=device", http.StatusOK, `value=""`},
+		{"complete URI", "?device_challenge=device&user_code=ABCD-EFGH", http.StatusOK, `value="ABCD-EFGH"`},
+		{"escaped", "?device_challenge=device&user_code=%22%3E", http.StatusOK, `value="&#34;&gt;"`},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			s.getDevice(w, httptest.NewRequest("GET", "/device"+tc.query, nil))
+			if w.Code != tc.status || !strings.Contains(w.Body.String(), tc.want) {
+				t.Errorf("got %d with body %s, want %d containing %q", w.Code, w.Body, tc.status, tc.want)
+			}
+		})
+	}
+}
+
+func TestPostDevice(t *testing.T) {
+	fake := &fakeHydra{userCode: "ABCD-EFGH"}
+	ts := httptest.NewServer(fake)
+	defer ts.Close()
+	s := newTestServer(t)
+	s.flow = NewOryHydraFlow(ts.URL, defaultScopes)
+
+	post := func(userCode string) *httptest.ResponseRecorder {
+		form := url.Values{"user_code": {userCode}}
+		r := httptest.NewRequest("POST", "/device?device_challenge=device", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		s.postDevice(w, r)
+		return w
+	}
+
+	w := post("ABCD-EFGH")
+	if w.Code != http.StatusSeeOther || w.Header().Get("Location") != "https://hydra.example/device/next" {
+		t.Errorf("got %d to %q, want a redirect on to Hydra", w.Code, w.Header().Get("Location"))
+	}
+
+	// A wrong code shows the form again, keeping the code.
+	w = post("WXYZ-WXYZ")
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), `value="WXYZ-WXYZ"`) || !strings.Contains(w.Body.String(), "not valid") {
+		t.Errorf("got %d with body %s, want the form again", w.Code, w.Body)
+	}
+
+	fake.userCode = ""
+	if w = post("ABCD-EFGH"); w.Code != http.StatusInternalServerError {
+		t.Errorf("got %d when Hydra fails, want 500", w.Code)
+	}
+}
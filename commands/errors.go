@@ -0,0 +1,80 @@
+package commands
+
+import (
+	"bytes"
+	"expvar"
+	"fmt"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/rs/zerolog/log"
+)
+
+// errorCount counts requests that failed with an internal error,
+// keyed by route, and is published via expvar.
+var errorCount = expvar.NewMap("nonstick_errors")
+
+// routeName returns a low-cardinality name for the route r was
+// matched to, for use in metrics.
+func routeName(r *http.Request) string {
+	if route := mux.CurrentRoute(r); route != nil {
+		if tmpl, err := route.GetPathTemplate(); err == nil {
+			return tmpl
+		}
+	}
+	return "unknown"
+}
+
+// renderStatus renders a page with the given status code. The page is
+// rendered in full before anything is written, so a failure results
+// in a plain 500 response rather than a partial page.
+func (s *server) renderStatus(status int, page string, tmplArgs map[string]interface{}, w http.ResponseWriter) {
+	t, ok := s.live.Load().templates[page]
+	if !ok {
+		errorCount.Add("template", 1)
+		log.Error().Msgf("Could not find page %q", page)
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
+	if tmplArgs == nil {
+		tmplArgs = make(map[string]interface{})
+	}
+	tmplArgs["vue"] = s.glue
+	var b bytes.Buffer
+	if err := t.ExecuteTemplate(&b, "page", tmplArgs); err != nil {
+		errorCount.Add("template", 1)
+		log.Error().Err(err).Msgf("Could not execute template %q", page)
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	b.WriteTo(w)
+}
+
+// internalError logs err, and responds with a generic 500 page, so
+// that no internal details are exposed.
+func (s *server) internalError(w http.ResponseWriter, r *http.Request, err error) {
+	errorCount.Add(routeName(r), 1)
+	log.Error().Err(err).Msgf("Internal error serving %q", r.URL.Path)
+	s.renderStatus(http.StatusInternalServerError, "error", map[string]interface{}{
+		"Message": "Something went wrong on our end. Please try again later.",
+	}, w)
+}
+
+// recoverPanics turns a panic in a handler into a 500 response,
+// rather than letting it take down the connection without an answer.
+func (s *server) recoverPanics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			if v := recover(); v != nil {
+				if v == http.ErrAbortHandler {
+					panic(v)
+				}
+				errorCount.Add("panic", 1)
+				s.internalError(w, r, fmt.Errorf("panic: %v", v))
+			}
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,163 @@
+package commands
+
+import (
+	"encoding/base64"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/securecookie"
+)
+
+// fileStore is a kvStore keeping each value in a file in dir, named
+// after its key. It may be shared by nonstick processes on the same
+// machine.
+type fileStore struct {
+	dir string
+
+	mu        sync.Mutex
+	lastSweep time.Time
+}
+
+func newFileStore(dir string) (*fileStore, error) {
+	if dir == "" {
+		return nil, errors.New("the file session store needs a directory")
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	return &fileStore{dir: dir}, nil
+}
+
+// path returns the file of the key. Keys are encoded, so they cannot
+// escape dir.
+func (f *fileStore) path(key string) string {
+	return filepath.Join(f.dir, base64.RawURLEncoding.EncodeToString([]byte(key)))
+}
+
+func (f *fileStore) Get(key string) ([]byte, error) {
+	data, err := os.ReadFile(f.path(key))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, errNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	value, ok := unexpired(data, time.Now())
+	if !ok {
+		return nil, errNotFound
+	}
+	return value, nil
+}
+
+func (f *fileStore) Put(key string, value []byte, ttl time.Duration) error {
+	f.sweep()
+	// Write to a temporary file first, so readers never see a
+	// partial value.
+	tmp, err := os.CreateTemp(f.dir, ".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(withExpiry(value, ttl)); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), f.path(key))
+}
+
+func (f *fileStore) Delete(key string) error {
+	err := os.Remove(f.path(key))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+func (f *fileStore) Take(key string) ([]byte, error) {
+	// Only one process can move the file away.
+	taken := filepath.Join(f.dir, ".taken-"+base64.RawURLEncoding.EncodeToString(securecookie.GenerateRandomKey(16)))
+	err := os.Rename(f.path(key), taken)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, errNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(taken)
+	data, err := os.ReadFile(taken)
+	if err != nil {
+		return nil, err
+	}
+	value, ok := unexpired(data, time.Now())
+	if !ok {
+		return nil, errNotFound
+	}
+	return value, nil
+}
+
+// each calls fn with the key and file of every value.
+func (f *fileStore) each(fn func(key, path string)) error {
+	entries, err := os.ReadDir(f.dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		key, err := base64.RawURLEncoding.DecodeString(entry.Name())
+		if err != nil {
+			continue
+		}
+		fn(string(key), filepath.Join(f.dir, entry.Name()))
+	}
+	return nil
+}
+
+func (f *fileStore) Scan(prefix string) (map[string][]byte, error) {
+	now := time.Now()
+	result := make(map[string][]byte)
+	err := f.each(func(key, path string) {
+		if !strings.HasPrefix(key, prefix) {
+			return
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return
+		}
+		if value, ok := unexpired(data, now); ok {
+			result[key] = value
+		}
+	})
+	return result, err
+}
+
+// sweep removes expired values, at most once every sweepInterval.
+func (f *fileStore) sweep() {
+	now := time.Now()
+	f.mu.Lock()
+	if now.Sub(f.lastSweep) < sweepInterval {
+		f.mu.Unlock()
+		return
+	}
+	f.lastSweep = now
+	f.mu.Unlock()
+	f.each(func(_, path string) {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return
+		}
+		if _, ok := unexpired(data, now); !ok {
+			os.Remove(path)
+		}
+	})
+}
+
+func (f *fileStore) Close() error { return nil }
@@ -0,0 +1,182 @@
+package commands
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/achernya/nonstick/pamsocket"
+	"github.com/gorilla/csrf"
+	"github.com/gorilla/sessions"
+	"github.com/rs/zerolog/log"
+)
+
+// formWait bounds how long a page waits for PAM to prompt, before
+// letting the user check back.
+const formWait = 30 * time.Second
+
+// formLogin signs users in with plain HTML forms, for browsers
+// without JavaScript. It drives the same conversations as the
+// websocket, one prompt per page, answering each with a POST. The
+// conversation ID is held in the session, and never appears in the
+// page.
+type formLogin struct {
+	s      *server
+	socket *pamsocket.PamSocket
+	// key is the session value holding the conversation ID.
+	key string
+}
+
+// formPath returns the path of the form-based sign-in for the
+// current request, keeping its query parameters (e.g.,
+// `login_challenge` or `next`).
+func formPath(path string, r *http.Request) string {
+	if r.URL.RawQuery == "" {
+		return path
+	}
+	return path + "?" + r.URL.RawQuery
+}
+
+// restartPath returns the current page, asking to start the
+// conversation over.
+func restartPath(r *http.Request, ignoreHint bool) string {
+	q := r.URL.Query()
+	q.Set("restart", "1")
+	q.Del("ignore_hint")
+	if ignoreHint {
+		q.Set("ignore_hint", "1")
+	}
+	return r.URL.Path + "?" + q.Encode()
+}
+
+func (f *formLogin) get(w http.ResponseWriter, r *http.Request) {
+	f.s.bindBrowser(w, r)
+	session, err := f.s.sessions.Get(r, sessionName)
+	if err != nil {
+		log.Info().Err(err).Msg("Discarding invalid session")
+	}
+	if r.URL.Query().Get("restart") == "1" {
+		// Forget the old conversation, and drop the parameter,
+		// so answering a prompt does not start over again.
+		delete(session.Values, f.key)
+		if err := session.Save(r, w); err != nil {
+			f.s.internalError(w, r, fmt.Errorf("could not save session: %w", err))
+			return
+		}
+		q := r.URL.Query()
+		q.Del("restart")
+		r.URL.RawQuery = q.Encode()
+		http.Redirect(w, r, r.URL.RequestURI(), http.StatusSeeOther)
+		return
+	}
+
+	var c *pamsocket.Conversation
+	if id, ok := session.Values[f.key].(string); ok {
+		if f.socket.Forward(w, r, id) {
+			return
+		}
+		c = f.socket.Resume(id)
+	}
+	if c == nil {
+		var redirect string
+		c, redirect, err = f.socket.Start(r)
+		if err != nil {
+			f.s.internalError(w, r, err)
+			return
+		}
+		if redirect != "" {
+			http.Redirect(w, r, redirect, http.StatusSeeOther)
+			return
+		}
+		session.Values[f.key] = c.ID
+		if err := session.Save(r, w); err != nil {
+			f.s.internalError(w, r, fmt.Errorf("could not save session: %w", err))
+			return
+		}
+	}
+
+	args := map[string]interface{}{
+		"CsrfField":  csrf.TemplateField(r),
+		"SwitchUser": restartPath(r, true),
+	}
+	var messages []pamsocket.Message
+	a := c.Attach()
+	defer a.Detach()
+	ctx, cancel := context.WithTimeout(r.Context(), formWait)
+	defer cancel()
+	for args["Prompt"] == nil {
+		msg, err := a.Next(ctx)
+		if errors.Is(err, pamsocket.ErrConversationOver) {
+			f.finish(w, r, session, c)
+			return
+		}
+		if err != nil {
+			// PAM is taking its time; the page lets the
+			// user check back.
+			break
+		}
+		switch msg.Type {
+		case "Username", "UsernameFixed":
+			args["Username"] = msg.Message
+			args["UsernameFixed"] = msg.Type == "UsernameFixed"
+		case "PromptEchoOff", "PromptEchoOn":
+			args["Prompt"] = msg
+		case "WebAuthnRegister", "WebAuthnAssert":
+			// WebAuthn needs JavaScript, so fail the step.
+			messages = append(messages, pamsocket.Message{
+				Type:    "Error",
+				Message: "This sign-in requires a security key, which needs JavaScript.",
+			})
+			a.Answer("")
+		default:
+			messages = append(messages, msg)
+		}
+	}
+	args["Messages"] = messages
+	f.s.renderTemplate("login_form", args, w)
+}
+
+// finish completes the conversation, and sends the user on.
+func (f *formLogin) finish(w http.ResponseWriter, r *http.Request, session *sessions.Session, c *pamsocket.Conversation) {
+	delete(session.Values, f.key)
+	if err := session.Save(r, w); err != nil {
+		log.Error().Err(err).Msg("Could not save session")
+	}
+	redirect, err := f.socket.Finish(r, c)
+	if err != nil {
+		log.Info().Err(err).Msg("Could not authenticate user")
+		f.s.renderStatus(http.StatusUnauthorized, "login_form", map[string]interface{}{
+			"Error":   pamsocket.UserMessage(err),
+			"Restart": restartPath(r, false),
+		}, w)
+		return
+	}
+	http.Redirect(w, r, redirect, http.StatusSeeOther)
+}
+
+func (f *formLogin) post(w http.ResponseWriter, r *http.Request) {
+	session, err := f.s.sessions.Get(r, sessionName)
+	if err != nil {
+		log.Info().Err(err).Msg("Discarding invalid session")
+	}
+	id, _ := session.Values[f.key].(string)
+	if f.socket.Forward(w, r, id) {
+		return
+	}
+	c := f.socket.Resume(id)
+	if c == nil {
+		f.s.renderStatus(http.StatusNotFound, "login_form", map[string]interface{}{
+			"Error":   "Your sign-in has expired, please try again.",
+			"Restart": restartPath(r, false),
+		}, w)
+		return
+	}
+	if err := c.Answer(r.PostFormValue("input")); err != nil {
+		// Most likely a stale page; the current prompt is
+		// shown again.
+		log.Info().Err(err).Msg("Ignoring input from form")
+	}
+	http.Redirect(w, r, r.URL.RequestURI(), http.StatusSeeOther)
+}
@@ -0,0 +1,215 @@
+package commands
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os/user"
+	"slices"
+	"strings"
+
+	"github.com/achernya/nonstick/pamsocket"
+	"github.com/gorilla/securecookie"
+	"github.com/rs/zerolog/log"
+)
+
+// forwardAuthCookie is the name of the cookie forward auth
+// recognizes users by.
+const forwardAuthCookie = "nonstick-forward-auth"
+
+// forwardAuthRule lets users into the apps on a host.
+type forwardAuthRule struct {
+	// host is the host name, or `*.` followed by a domain for
+	// every host below it.
+	host string
+	// groups are the groups users must be in one of, or empty to
+	// let in every user.
+	groups []string
+}
+
+// forwardAuth lets reverse proxies (e.g., nginx auth_request, Traefik
+// or Caddy forward_auth) put apps behind nonstick, by asking whether
+// each request comes from a user signed in to the IdP. Rather than
+// nonstick's own session cookie, which must not be sent to the apps,
+// users are recognized by a separate cookie, issued by /auth/signin
+// and scoped to a domain covering the apps (see --cookie_domain). It
+// only refers to the nonstick session, so ends along with it.
+type forwardAuth struct {
+	s     *server
+	rules []*forwardAuthRule
+	// signin is the absolute URL of /auth/signin, as users reach
+	// it. If empty, unauthenticated requests are only refused.
+	signin string
+	// cookies authenticates forward auth cookies, which are
+	// scoped to domain, or only sent to nonstick if empty.
+	cookies *securecookie.SecureCookie
+	domain  string
+}
+
+// parseForwardAuthHosts parses `host` and `host=group` rules. Users
+// may use a host if they are in any of the groups given for it.
+func parseForwardAuthHosts(specs []string) ([]*forwardAuthRule, error) {
+	var rules []*forwardAuthRule
+	byHost := make(map[string]*forwardAuthRule)
+	for _, spec := range specs {
+		host, group, _ := strings.Cut(spec, "=")
+		host = strings.ToLower(strings.TrimSpace(host))
+		// Wildcards only cover the hosts below a domain, so `*`
+		// must start a `*.` prefix, followed by the domain.
+		domain, wildcard := strings.CutPrefix(host, "*.")
+		if domain == "" || strings.ContainsAny(domain, "/:*") || strings.HasPrefix(domain, ".") {
+			return nil, fmt.Errorf("invalid forward auth host %q", spec)
+		}
+		if wildcard && !strings.Contains(domain, ".") {
+			return nil, fmt.Errorf("forward auth host %q covers a top-level domain", spec)
+		}
+		rule, ok := byHost[host]
+		if !ok {
+			rule = &forwardAuthRule{host: host}
+			byHost[host] = rule
+			rules = append(rules, rule)
+		}
+		if group != "" {
+			rule.groups = append(rule.groups, group)
+		}
+	}
+	return rules, nil
+}
+
+// rule returns the rule for the host, if any. Exact matches take
+// precedence over wildcards.
+func (f *forwardAuth) rule(host string) *forwardAuthRule {
+	host = strings.ToLower(host)
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	var wildcard *forwardAuthRule
+	for _, rule := range f.rules {
+		if rule.host == host {
+			return rule
+		}
+		if domain, ok := strings.CutPrefix(rule.host, "*."); ok && strings.HasSuffix(host, "."+domain) && wildcard == nil {
+			wildcard = rule
+		}
+	}
+	return wildcard
+}
+
+// original returns the URL of the request the proxy is asking about,
+// or nil if the request did not come from a proxy listed in
+// --trusted_proxy, as only such a proxy's description of it can be
+// believed. Its scheme and host are those the forwarding headers give
+// (see pamsocket.ParseClient), and its path and query those of
+// `X-Forwarded-Uri`.
+func original(r *http.Request) *url.URL {
+	client := pamsocket.ClientOf(r)
+	if !client.Proxied {
+		return nil
+	}
+	u := &url.URL{Scheme: client.Proto, Host: client.Host}
+	if uri, err := url.ParseRequestURI(r.Header.Get("X-Forwarded-Uri")); err == nil {
+		u.Path, u.RawQuery = uri.Path, uri.RawQuery
+	}
+	return u
+}
+
+// verify answers the proxy: 200 with the user's name and groups in
+// X-Remote-User and X-Remote-Groups if they may use the app, 403 if
+// they may not, and 401 if they must sign in first. Proxies that pass
+// responses on to users are instead sent a redirect to sign in, if
+// they say where the user was going.
+func (f *forwardAuth) verify(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+	target := original(r)
+	if target == nil {
+		log.Info().Msgf("Refused forward auth for %s, which is not a trusted proxy", pamsocket.ClientOf(r).Addr)
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	rule := f.rule(target.Host)
+	if rule == nil {
+		log.Info().Msgf("Refused forward auth for unknown host %q", target.Host)
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	userinfo := f.user(r)
+	if userinfo == nil {
+		if f.signin != "" && r.Header.Get("X-Forwarded-Uri") != "" {
+			http.Redirect(w, r, f.signin+"?rd="+url.QueryEscape(target.String()), http.StatusFound)
+			return
+		}
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	profile, err := lookupProfile(userinfo.Uid)
+	if err != nil {
+		f.s.internalError(w, r, err)
+		return
+	}
+	if len(rule.groups) > 0 && !slices.ContainsFunc(profile.Groups, func(g string) bool { return slices.Contains(rule.groups, g) }) {
+		log.Info().Msgf("Refused forward auth for %q to %q", profile.Username, target.Host)
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	w.Header().Set("X-Remote-User", profile.Username)
+	w.Header().Set("X-Remote-Groups", strings.Join(profile.Groups, ","))
+	w.WriteHeader(http.StatusOK)
+}
+
+// user returns the UNIX account the forward auth cookie refers to, if
+// its session was signed in with the IdP's PAM service. Otherwise,
+// nil is returned.
+func (f *forwardAuth) user(r *http.Request) *user.User {
+	cookie, err := r.Cookie(forwardAuthCookie)
+	if err != nil {
+		return nil
+	}
+	var id string
+	if err := f.cookies.Decode(forwardAuthCookie, cookie.Value, &id); err != nil {
+		log.Info().Err(err).Msg("Ignoring invalid forward auth cookie")
+		return nil
+	}
+	ts, err := f.s.registry.Touch(id)
+	if err != nil {
+		log.Error().Err(err).Msg("Could not look up session")
+		return nil
+	}
+	if ts == nil || ts.Service != f.s.idpService() {
+		return nil
+	}
+	return sessionUser(ts)
+}
+
+// signIn signs the user in, issues the forward auth cookie, and sends
+// them back to the app at `rd`, which must be on one of the hosts
+// behind nonstick.
+func (f *forwardAuth) signIn(w http.ResponseWriter, r *http.Request) {
+	rd, err := url.Parse(r.URL.Query().Get("rd"))
+	if err != nil || (rd.Scheme != "https" && rd.Scheme != "http") || f.rule(rd.Host) == nil {
+		f.s.respondWithError(w, r, "This application may not sign in with nonstick.")
+		return
+	}
+	ts := f.s.idpSession(r)
+	if ts == nil {
+		http.Redirect(w, r, "/sso/login?next="+url.QueryEscape(r.URL.RequestURI()), http.StatusSeeOther)
+		return
+	}
+	value, err := f.cookies.Encode(forwardAuthCookie, ts.ID)
+	if err != nil {
+		f.s.internalError(w, r, err)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     forwardAuthCookie,
+		Value:    value,
+		Path:     "/",
+		Domain:   f.domain,
+		MaxAge:   int(f.s.registry.lifetime.Seconds()),
+		Secure:   f.s.glue.Environment != "development" || pamsocket.ClientOf(r).Proto == "https",
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.Redirect(w, r, rd.String(), http.StatusSeeOther)
+}
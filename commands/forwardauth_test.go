@@ -0,0 +1,231 @@
+package commands
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"slices"
+	"testing"
+
+	"github.com/achernya/nonstick/pamsocket"
+	"github.com/gorilla/securecookie"
+)
+
+func newTestForwardAuth(t *testing.T) (*server, *forwardAuth) {
+	t.Helper()
+	s := newTestServer(t)
+	rules, err := parseForwardAuthHosts([]string{"app.example", "*.apps.example", "admin.apps.example=nonstick-nobody"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.forwardAuth = &forwardAuth{
+		s:       s,
+		rules:   rules,
+		signin:  "https://idp.example/auth/signin",
+		cookies: securecookie.New(securecookie.GenerateRandomKey(32), nil),
+		domain:  "apps.example",
+	}
+	return s, s.forwardAuth
+}
+
+func TestParseForwardAuthHosts(t *testing.T) {
+	rules, err := parseForwardAuthHosts([]string{"App.example=admins", "*.apps.example", "app.example=wheel", "other.example"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rules) != 3 {
+		t.Fatalf("got %d rules, want 3", len(rules))
+	}
+	if rules[0].host != "app.example" || !slices.Equal(rules[0].groups, []string{"admins", "wheel"}) {
+		t.Errorf("got rule %+v, want app.example for admins and wheel", rules[0])
+	}
+	if rules[1].host != "*.apps.example" || len(rules[1].groups) != 0 {
+		t.Errorf("got rule %+v, want *.apps.example for everyone", rules[1])
+	}
+
+	for _, spec := range []string{"", "=admins", "*", "*.", "*example.com", "a*.example.com", "*.*.example.com", "*.com", "*..example.com", "app.example/path", "app.example:443", "https://app.example"} {
+		if _, err := parseForwardAuthHosts([]string{spec}); err == nil {
+			t.Errorf("Expected host %q to be rejected", spec)
+		}
+	}
+}
+
+func TestForwardAuthRule(t *testing.T) {
+	_, f := newTestForwardAuth(t)
+	for _, tc := range []struct {
+		host, want string
+	}{
+		{"app.example", "app.example"},
+		{"APP.example:8443", "app.example"},
+		{"wiki.apps.example", "*.apps.example"},
+		{"a.b.apps.example", "*.apps.example"},
+		{"admin.apps.example", "admin.apps.example"},
+		{"apps.example", ""},
+		{"evilapps.example", ""},
+		{"app.example.evil", ""},
+		{"other.example", ""},
+		{"", ""},
+	} {
+		got := ""
+		if rule := f.rule(tc.host); rule != nil {
+			got = rule.host
+		}
+		if got != tc.want {
+			t.Errorf("rule(%q) = %q, want %q", tc.host, got, tc.want)
+		}
+	}
+}
+
+// testProxies are the trusted proxies of forward auth tests, which
+// include the address httptest requests come from.
+var testProxies = []netip.Prefix{netip.MustParsePrefix("192.0.2.0/24")}
+
+// fromProxy returns the request as identifyClient passes it on, with
+// its peer a trusted proxy if trusted is set.
+func fromProxy(r *http.Request, trusted bool) *http.Request {
+	var proxies []netip.Prefix
+	if trusted {
+		proxies = testProxies
+	}
+	return r.WithContext(pamsocket.WithClient(r.Context(), pamsocket.ParseClient(r, proxies)))
+}
+
+func TestOriginal(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		headers map[string]string
+		want    string
+	}{
+		{"forwarded", map[string]string{"X-Forwarded-Proto": "http", "X-Forwarded-Host": "app.example", "X-Forwarded-Uri": "/a?b=1"}, "http://app.example/a?b=1"},
+		{"Forwarded", map[string]string{"Forwarded": "proto=https;host=app.example", "X-Forwarded-Uri": "/a"}, "https://app.example/a"},
+		{"invalid URI", map[string]string{"X-Forwarded-Host": "app.example", "X-Forwarded-Uri": "a"}, "http://app.example"},
+		// X-Original-URL is not believed, even from a trusted
+		// proxy, as some pass it on from clients.
+		{"original URL", map[string]string{"X-Original-URL": "https://admin.example/a", "X-Forwarded-Proto": "https", "X-Forwarded-Host": "app.example"}, "https://app.example"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/auth/verify", nil)
+			for name, value := range tc.headers {
+				r.Header.Set(name, value)
+			}
+			if got := original(fromProxy(r, true)).String(); got != tc.want {
+				t.Errorf("original() = %q, want %q", got, tc.want)
+			}
+			if got := original(fromProxy(r, false)); got != nil {
+				t.Errorf("original() = %q from an untrusted peer, want nil", got)
+			}
+		})
+	}
+}
+
+// forwardAuthRequest asks the forward auth endpoint about the URL,
+// through a trusted proxy, with the cookie, and returns the response.
+func forwardAuthRequest(f *forwardAuth, target string, cookie *http.Cookie) *httptest.ResponseRecorder {
+	u, _ := url.Parse(target)
+	r := httptest.NewRequest("GET", "/auth/verify", nil)
+	r.Header.Set("X-Forwarded-Proto", u.Scheme)
+	r.Header.Set("X-Forwarded-Host", u.Host)
+	r.Header.Set("X-Forwarded-Uri", u.RequestURI())
+	if cookie != nil {
+		r.AddCookie(cookie)
+	}
+	w := httptest.NewRecorder()
+	f.verify(w, fromProxy(r, true))
+	return w
+}
+
+func TestForwardAuth(t *testing.T) {
+	s, f := newTestForwardAuth(t)
+	account := currentAccount(t)
+	target := "https://wiki.apps.example/page?x=1"
+
+	w := forwardAuthRequest(f, target, nil)
+	if location := w.Header().Get("Location"); w.Code != http.StatusFound || location != f.signin+"?rd="+url.QueryEscape(target) {
+		t.Errorf("got %d to %q when signed out, want a redirect to sign in", w.Code, location)
+	}
+
+	// The nonstick session cookie is not enough by itself, as it
+	// is never sent to the apps.
+	ts, session := signIn(t, s, testIdpService)
+	if w := forwardAuthRequest(f, target, session); w.Code != http.StatusFound {
+		t.Errorf("got %d with the session cookie, want a redirect to sign in", w.Code)
+	}
+	if w := forwardAuthRequest(f, target, &http.Cookie{Name: forwardAuthCookie, Value: session.Value}); w.Code != http.StatusFound {
+		t.Errorf("got %d with the session cookie renamed, want a redirect to sign in", w.Code)
+	}
+
+	r := httptest.NewRequest("GET", "/auth/signin?rd="+url.QueryEscape(target), nil)
+	r.AddCookie(session)
+	w = httptest.NewRecorder()
+	f.signIn(w, r)
+	if location := w.Header().Get("Location"); w.Code != http.StatusSeeOther || location != target {
+		t.Fatalf("got %d to %q from signing in, want a redirect back", w.Code, location)
+	}
+	var cookie *http.Cookie
+	for _, c := range w.Result().Cookies() {
+		if c.Name == forwardAuthCookie {
+			cookie = c
+		}
+	}
+	if cookie == nil || cookie.Domain != "apps.example" || !cookie.Secure || !cookie.HttpOnly {
+		t.Fatalf("got cookie %v, want a secure forward auth cookie for apps.example", cookie)
+	}
+
+	w = forwardAuthRequest(f, target, cookie)
+	if w.Code != http.StatusOK || w.Header().Get("X-Remote-User") != account.Username {
+		t.Errorf("got %d for %q, want %s let in", w.Code, w.Header().Get("X-Remote-User"), account.Username)
+	}
+	if w := forwardAuthRequest(f, "https://admin.apps.example/", cookie); w.Code != http.StatusForbidden {
+		t.Errorf("got %d outside the host's groups, want 403", w.Code)
+	}
+	if w := forwardAuthRequest(f, "https://other.example/", cookie); w.Code != http.StatusForbidden {
+		t.Errorf("got %d for an unknown host, want 403", w.Code)
+	}
+
+	// A client reaching nonstick directly cannot claim to be going
+	// to a host it may use, rather than one it may not.
+	r = httptest.NewRequest("GET", "/auth/verify", nil)
+	r.Header.Set("X-Forwarded-Proto", "https")
+	r.Header.Set("X-Forwarded-Host", "wiki.apps.example")
+	r.Header.Set("X-Original-URL", "https://wiki.apps.example/")
+	r.AddCookie(cookie)
+	w = httptest.NewRecorder()
+	f.verify(w, fromProxy(r, false))
+	if w.Code != http.StatusForbidden || w.Header().Get("X-Remote-User") != "" {
+		t.Errorf("got %d for a host claimed by an untrusted client, want 403", w.Code)
+	}
+
+	// The cookie ends with the session.
+	if _, err := s.registry.Revoke(ts.ID); err != nil {
+		t.Fatal(err)
+	}
+	if w := forwardAuthRequest(f, target, cookie); w.Code != http.StatusFound {
+		t.Errorf("got %d once signed out, want a redirect to sign in", w.Code)
+	}
+}
+
+func TestForwardAuthSignIn(t *testing.T) {
+	s, f := newTestForwardAuth(t)
+	for _, rd := range []string{"", "https://other.example/", "javascript:alert(1)", "//wiki.apps.example/"} {
+		r := httptest.NewRequest("GET", "/auth/signin?rd="+url.QueryEscape(rd), nil)
+		w := httptest.NewRecorder()
+		f.signIn(w, r)
+		if w.Code == http.StatusSeeOther {
+			t.Errorf("Signing in redirected to %q for rd %q", w.Header().Get("Location"), rd)
+		}
+	}
+
+	// Sessions of other PAM services do not sign in to the apps.
+	_, other := signIn(t, s, "other")
+	r := httptest.NewRequest("GET", "/auth/signin?rd="+url.QueryEscape("https://app.example/"), nil)
+	r.AddCookie(other)
+	w := httptest.NewRecorder()
+	f.signIn(w, r)
+	if location := w.Header().Get("Location"); w.Code != http.StatusSeeOther || location != "/sso/login?next="+url.QueryEscape(r.URL.RequestURI()) {
+		t.Errorf("got %d to %q with another service's session, want a redirect to sign in", w.Code, location)
+	}
+	if len(w.Result().Cookies()) != 0 {
+		t.Error("Signing in with another service's session issued a cookie")
+	}
+}
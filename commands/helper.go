@@ -0,0 +1,101 @@
+package commands
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"os/user"
+	"strconv"
+	"syscall"
+
+	"github.com/achernya/nonstick/pamsocket"
+	"github.com/rs/zerolog/log"
+	"github.com/urfave/cli/v2"
+)
+
+func pamHelper(c *cli.Context) error {
+	path := c.String("socket")
+	// Remove a stale socket left behind by a previous run.
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	// Create the socket without any permissions for others, so
+	// there is no window in which anyone could connect.
+	oldMask := syscall.Umask(0117)
+	l, err := net.Listen("unix", path)
+	syscall.Umask(oldMask)
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+	if group := c.String("socket_group"); group != "" {
+		g, err := user.LookupGroup(group)
+		if err != nil {
+			return err
+		}
+		gid, err := strconv.Atoi(g.Gid)
+		if err != nil {
+			return err
+		}
+		if err := os.Chown(path, -1, gid); err != nil {
+			return err
+		}
+	}
+
+	var authenticator pamsocket.Authenticator = &pamsocket.LocalAuthenticator{
+		ConfDir: c.String("pam_confdir"),
+	}
+	if workers := c.Int("workers"); workers > 0 {
+		authenticator, err = workerPool(workers, c.String("pam_confdir"))
+		if err != nil {
+			return err
+		}
+	}
+	helper := &pamsocket.Helper{
+		Authenticator: authenticator,
+		Services:      c.StringSlice("service"),
+	}
+	if c.Bool("enroll") {
+		helper.Enroller = pamsocket.LocalEnroller{}
+	}
+	log.Info().Msgf("PAM helper listening on %q", path)
+	return helper.Serve(l)
+}
+
+// workerPool returns an Authenticator that runs each PAM transaction
+// in its own `nonstick pam-worker` subprocess, keeping size of them
+// ready.
+func workerPool(size int, confDir string) (*pamsocket.PoolAuthenticator, error) {
+	self, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+	return &pamsocket.PoolAuthenticator{
+		Command: func() *exec.Cmd {
+			cmd := exec.Command(self, "pam-worker", "--pam_confdir", confDir)
+			cmd.Stderr = os.Stderr
+			return cmd
+		},
+		Size: size,
+	}, nil
+}
+
+// pamWorker runs a single PAM transaction for the PoolAuthenticator
+// that started it, over stdin and stdout.
+func pamWorker(c *cli.Context) error {
+	// The worker only serves the process that started it, which
+	// already checked the service.
+	helper := &pamsocket.Helper{
+		Authenticator: &pamsocket.LocalAuthenticator{
+			ConfDir: c.String("pam_confdir"),
+		},
+		AnyService: true,
+	}
+	helper.ServeConn(struct {
+		io.Reader
+		io.WriteCloser
+	}{os.Stdin, os.Stdout})
+	return nil
+}
@@ -0,0 +1,645 @@
+package commands
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os/user"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/achernya/nonstick/pamsocket"
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/go-ldap/ldap/v3"
+	"github.com/gorilla/securecookie"
+	"github.com/hashicorp/go-hclog"
+	"github.com/jimlambrt/gldap"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// ldapUserFailures and ldapHostFailures are how many binds may
+	// fail for a user, or from a client address, within
+	// ldapFailureWindow, before further binds are refused.
+	ldapUserFailures  = 5
+	ldapHostFailures  = 20
+	ldapFailureWindow = 15 * time.Minute
+)
+
+// ldapServer is a minimal LDAPv3 server, for appliances that can only
+// authenticate users with an LDAP bind. Simple binds are checked
+// with PAM, answering its password prompt without a user, so the PAM
+// service must not ask for anything else. Bound clients may search
+// for the users and groups known to NSS, below:
+//
+//	uid=<user>,ou=people,<base>
+//	cn=<group>,ou=groups,<base>
+//
+// NSS cannot be enumerated, so searches only find entries their filter
+// names, by uid, cn, uidNumber, gidNumber, memberUid or member. For the
+// same reason, groups only list the members named by the filter.
+type ldapServer struct {
+	socket *pamsocket.PamSocket
+	base   *ldap.DN
+	people *ldap.DN
+	groups *ldap.DN
+	// users and hosts throttle failed binds by username, and by
+	// client address.
+	users *failureThrottle
+	hosts *failureThrottle
+
+	// relaySecret authenticates the relay to gldap, when it
+	// announces the address of a client.
+	relaySecret string
+
+	mu sync.Mutex
+	// bound holds the user bound on each connection.
+	bound map[int]string
+	// peers holds the address of the client of each connection,
+	// as announced by the relay.
+	peers map[int]string
+}
+
+// newLdapServer returns an LDAP server authenticating users with the
+// socket's PAM service, with entries below the base DN, counting
+// failed binds in kv.
+func newLdapServer(socket *pamsocket.PamSocket, baseDN string, kv kvStore) (*ldapServer, error) {
+	base, err := ldap.ParseDN(baseDN)
+	if err != nil || len(base.RDNs) == 0 {
+		return nil, fmt.Errorf("invalid LDAP base DN %q: %w", baseDN, err)
+	}
+	people, _ := ldap.ParseDN("ou=people," + base.String())
+	groups, _ := ldap.ParseDN("ou=groups," + base.String())
+	return &ldapServer{
+		socket:      socket,
+		base:        base,
+		people:      people,
+		groups:      groups,
+		users:       newFailureThrottle(kv, "ldap-user", ldapUserFailures, ldapFailureWindow),
+		hosts:       newFailureThrottle(kv, "ldap-host", ldapHostFailures, ldapFailureWindow),
+		bound:       make(map[int]string),
+		peers:       make(map[int]string),
+		relaySecret: base64.RawURLEncoding.EncodeToString(securecookie.GenerateRandomKey(32)),
+	}, nil
+}
+
+// ldapRelayDN is the DN the relay binds as, first thing on each
+// connection to gldap, with the relay secret and the address of the
+// client as the password.
+const ldapRelayDN = "cn=nonstick-relay"
+
+// Run serves LDAP on addr, with TLS if tlsConfig is set. gldap
+// listens for itself, and does not tell handlers where requests come
+// from, so it listens on a loopback address, and clients are relayed
+// to it, after announcing their address.
+func (l *ldapServer) Run(addr string, tlsConfig *tls.Config) error {
+	logger := hclog.New(&hclog.LoggerOptions{
+		Name:   "ldap",
+		Output: log.Logger,
+		Level:  hclog.Error,
+	})
+	s, err := gldap.NewServer(gldap.WithLogger(logger), gldap.WithOnClose(l.closed))
+	if err != nil {
+		return err
+	}
+	mux, err := gldap.NewMux()
+	if err != nil {
+		return err
+	}
+	mux.Bind(l.bind)
+	mux.Search(l.search)
+	mux.Unbind(func(_ *gldap.ResponseWriter, r *gldap.Request) {
+		l.unbind(r.ConnectionID())
+	})
+	mux.DefaultRoute(func(w *gldap.ResponseWriter, r *gldap.Request) {
+		w.Write(r.NewResponse(gldap.WithResponseCode(gldap.ResultUnwillingToPerform)))
+	})
+	if err := s.Router(mux); err != nil {
+		return err
+	}
+	internal, err := loopbackAddr()
+	if err != nil {
+		return err
+	}
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer listener.Close()
+	if tlsConfig != nil {
+		listener = tls.NewListener(listener, tlsConfig)
+	}
+	errs := make(chan error, 2)
+	go func() { errs <- s.Run(internal) }()
+	defer s.Stop()
+	for !s.Ready() {
+		time.Sleep(10 * time.Millisecond)
+	}
+	log.Info().Msgf("Serving LDAP on %s", addr)
+	go func() {
+		for {
+			client, err := listener.Accept()
+			if err != nil {
+				errs <- err
+				return
+			}
+			go l.relay(client, internal)
+		}
+	}()
+	return <-errs
+}
+
+// loopbackAddr returns a loopback address nothing listens on.
+func loopbackAddr() (string, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", err
+	}
+	defer l.Close()
+	return l.Addr().String(), nil
+}
+
+// relay passes the client's connection on to gldap, at internal,
+// once it announced the client's address.
+func (l *ldapServer) relay(client net.Conn, internal string) {
+	defer client.Close()
+	conn, err := net.Dial("tcp", internal)
+	if err != nil {
+		log.Error().Err(err).Msg("Could not relay LDAP connection")
+		return
+	}
+	defer conn.Close()
+	host, _, err := net.SplitHostPort(client.RemoteAddr().String())
+	if err != nil {
+		log.Error().Err(err).Msg("Could not relay LDAP connection")
+		return
+	}
+	if err := l.announce(conn, host); err != nil {
+		log.Error().Err(err).Msgf("Could not relay LDAP connection from %s", host)
+		return
+	}
+	go func() {
+		io.Copy(conn, client)
+		conn.(*net.TCPConn).CloseWrite()
+	}()
+	io.Copy(client, conn)
+}
+
+// announce binds as ldapRelayDN on the connection to gldap, to tell
+// it the address of the client.
+func (l *ldapServer) announce(conn net.Conn, host string) error {
+	packet := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "LDAP Request")
+	packet.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, 1, "MessageID"))
+	bind := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldap.ApplicationBindRequest, nil, "Bind Request")
+	bind.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, 3, "Version"))
+	bind.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, ldapRelayDN, "User Name"))
+	bind.AppendChild(ber.NewString(ber.ClassContext, ber.TypePrimitive, 0, l.relaySecret+" "+host, "Password"))
+	packet.AppendChild(bind)
+	if _, err := conn.Write(packet.Bytes()); err != nil {
+		return err
+	}
+	resp, err := ber.ReadPacket(conn)
+	if err != nil {
+		return err
+	}
+	if len(resp.Children) < 2 || len(resp.Children[1].Children) < 1 {
+		return errors.New("invalid bind response")
+	}
+	if code, _ := resp.Children[1].Children[0].Value.(int64); code != gldap.ResultSuccess {
+		return fmt.Errorf("announcement refused with result %d", code)
+	}
+	return nil
+}
+
+// peer returns the address of the client of the connection, or ""
+// if the relay did not announce it.
+func (l *ldapServer) peer(conn int) string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.peers[conn]
+}
+
+// closed forgets the connection.
+func (l *ldapServer) closed(conn int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.bound, conn)
+	delete(l.peers, conn)
+}
+
+func (l *ldapServer) unbind(conn int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.bound, conn)
+}
+
+// username returns the user a bind DN names, which may also be a
+// bare username.
+func (l *ldapServer) username(name string) (string, bool) {
+	if name != "" && !strings.ContainsAny(name, "=,") {
+		return name, true
+	}
+	dn, err := ldap.ParseDN(name)
+	if err != nil || len(dn.RDNs) == 0 || len(dn.RDNs[0].Attributes) != 1 {
+		return "", false
+	}
+	rdn := dn.RDNs[0].Attributes[0]
+	parent := &ldap.DN{RDNs: dn.RDNs[1:]}
+	if !strings.EqualFold(rdn.Type, "uid") || !parent.EqualFold(l.people) {
+		return "", false
+	}
+	return rdn.Value, true
+}
+
+func (l *ldapServer) bind(w *gldap.ResponseWriter, r *gldap.Request) {
+	resp := r.NewBindResponse(gldap.WithResponseCode(gldap.ResultInvalidCredentials))
+	defer w.Write(resp)
+	// Whatever happens, the connection is no longer bound as
+	// before.
+	l.unbind(r.ConnectionID())
+	m, err := r.GetSimpleBindMessage()
+	if err != nil {
+		log.Info().Err(err).Msg("Rejected LDAP bind")
+		resp.SetResultCode(gldap.ResultAuthMethodNotSupported)
+		return
+	}
+	rhost := l.peer(r.ConnectionID())
+	if rhost == "" {
+		// Only the relay may announce the client, once, before
+		// anything else.
+		secret, host, _ := strings.Cut(string(m.Password), " ")
+		if m.UserName != ldapRelayDN || subtle.ConstantTimeCompare([]byte(secret), []byte(l.relaySecret)) != 1 || host == "" {
+			log.Error().Msg("Rejected LDAP bind from a client the relay did not announce")
+			resp.SetResultCode(gldap.ResultUnwillingToPerform)
+			return
+		}
+		l.mu.Lock()
+		l.peers[r.ConnectionID()] = host
+		l.mu.Unlock()
+		resp.SetResultCode(gldap.ResultSuccess)
+		return
+	}
+	if m.UserName == "" && m.Password == "" {
+		// Anonymous binds succeed, but may not search.
+		resp.SetResultCode(gldap.ResultSuccess)
+		return
+	}
+	username, ok := l.username(m.UserName)
+	if !ok || m.Password == "" {
+		log.Info().Msgf("Rejected LDAP bind as %q from %s", m.UserName, rhost)
+		return
+	}
+	if !l.users.Allowed(username) || !l.hosts.Allowed(rhost) {
+		log.Info().Msgf("Refused LDAP bind as %q from %s after too many failures", username, rhost)
+		return
+	}
+	userinfo, err := l.socket.CheckPassword(username, string(m.Password), rhost)
+	if errors.Is(err, pamsocket.ErrAuthenticationFailed) {
+		log.Info().Err(err).Msgf("LDAP bind as %q from %s failed", username, rhost)
+		l.users.Failed(username)
+		l.hosts.Failed(rhost)
+		return
+	}
+	if err != nil {
+		resp.SetResultCode(gldap.ResultOther)
+		return
+	}
+	l.mu.Lock()
+	l.bound[r.ConnectionID()] = userinfo.Username
+	l.mu.Unlock()
+	resp.SetResultCode(gldap.ResultSuccess)
+}
+
+// ldapEntry is a directory entry.
+type ldapEntry struct {
+	dn    *ldap.DN
+	attrs map[string][]string
+}
+
+func (l *ldapServer) userDN(name string) *ldap.DN {
+	return &ldap.DN{RDNs: append([]*ldap.RelativeDN{{
+		Attributes: []*ldap.AttributeTypeAndValue{{Type: "uid", Value: name}},
+	}}, l.people.RDNs...)}
+}
+
+func (l *ldapServer) groupDN(name string) *ldap.DN {
+	return &ldap.DN{RDNs: append([]*ldap.RelativeDN{{
+		Attributes: []*ldap.AttributeTypeAndValue{{Type: "cn", Value: name}},
+	}}, l.groups.RDNs...)}
+}
+
+func (l *ldapServer) userEntry(userinfo *user.User) (*ldapEntry, error) {
+	profile, err := lookupProfile(userinfo.Uid)
+	if err != nil {
+		return nil, err
+	}
+	attrs := map[string][]string{
+		"objectClass":   {"top", "person", "organizationalPerson", "inetOrgPerson", "posixAccount"},
+		"uid":           {profile.Username},
+		"cn":            {profile.Username},
+		"sn":            {profile.Username},
+		"uidNumber":     {userinfo.Uid},
+		"gidNumber":     {userinfo.Gid},
+		"homeDirectory": {userinfo.HomeDir},
+	}
+	if profile.Name != "" {
+		attrs["cn"] = []string{profile.Name}
+		attrs["displayName"] = []string{profile.Name}
+	}
+	if profile.GivenName != "" {
+		attrs["givenName"] = []string{profile.GivenName}
+		attrs["sn"] = []string{profile.FamilyName}
+	}
+	for _, group := range profile.Groups {
+		attrs["memberOf"] = append(attrs["memberOf"], l.groupDN(group).String())
+	}
+	return &ldapEntry{dn: l.userDN(profile.Username), attrs: attrs}, nil
+}
+
+func (l *ldapServer) groupEntry(group *user.Group, members []string) *ldapEntry {
+	attrs := map[string][]string{
+		"objectClass": {"top", "posixGroup", "groupOfNames"},
+		"cn":          {group.Name},
+		"gidNumber":   {group.Gid},
+	}
+	for _, member := range members {
+		attrs["memberUid"] = append(attrs["memberUid"], member)
+		attrs["member"] = append(attrs["member"], l.userDN(member).String())
+	}
+	return &ldapEntry{dn: l.groupDN(group.Name), attrs: attrs}
+}
+
+// containers returns the entries for the base DN, and the people and
+// groups organizational units.
+func (l *ldapServer) containers() []*ldapEntry {
+	base := l.base.RDNs[0].Attributes[0]
+	return []*ldapEntry{
+		{dn: l.base, attrs: map[string][]string{
+			"objectClass": {"top", "extensibleObject"},
+			base.Type:     {base.Value},
+		}},
+		{dn: l.people, attrs: map[string][]string{
+			"objectClass": {"top", "organizationalUnit"},
+			"ou":          {"people"},
+		}},
+		{dn: l.groups, attrs: map[string][]string{
+			"objectClass": {"top", "organizationalUnit"},
+			"ou":          {"groups"},
+		}},
+	}
+}
+
+// equalities returns the attribute values a filter asks for
+// equality with, keyed by lowercase attribute name.
+func equalities(filter *ber.Packet, result map[string][]string) {
+	switch filter.Tag {
+	case ldap.FilterAnd, ldap.FilterOr, ldap.FilterNot:
+		for _, child := range filter.Children {
+			equalities(child, result)
+		}
+	case ldap.FilterEqualityMatch, ldap.FilterApproxMatch:
+		if len(filter.Children) == 2 {
+			attr := strings.ToLower(filter.Children[0].Data.String())
+			result[attr] = append(result[attr], filter.Children[1].Data.String())
+		}
+	}
+}
+
+// candidates returns the entries a search may return: the base DN,
+// if it names an entry, and the users and groups its filter names.
+func (l *ldapServer) candidates(base *ldap.DN, filter *ber.Packet) []*ldapEntry {
+	var result []*ldapEntry
+	byDN := make(map[string]*ldapEntry)
+	add := func(entry *ldapEntry) {
+		key := strings.ToLower(entry.dn.String())
+		existing, ok := byDN[key]
+		if !ok {
+			byDN[key] = entry
+			result = append(result, entry)
+			return
+		}
+		// The same group may be found with different members.
+		for name, values := range entry.attrs {
+			for _, v := range values {
+				if !slices.Contains(existing.attrs[name], v) {
+					existing.attrs[name] = append(existing.attrs[name], v)
+				}
+			}
+		}
+	}
+	addUser := func(userinfo *user.User, err error) {
+		if err != nil {
+			return
+		}
+		if entry, err := l.userEntry(userinfo); err == nil {
+			add(entry)
+		}
+	}
+	addGroup := func(group *user.Group, err error, members ...string) {
+		if err == nil {
+			add(l.groupEntry(group, members))
+		}
+	}
+	addMemberships := func(username string) {
+		userinfo, err := user.Lookup(username)
+		if err != nil {
+			return
+		}
+		for _, name := range userGroups(userinfo) {
+			group, err := user.LookupGroup(name)
+			addGroup(group, err, username)
+		}
+	}
+
+	for _, entry := range l.containers() {
+		add(entry)
+	}
+	if name, ok := l.username(base.String()); ok {
+		addUser(user.Lookup(name))
+	}
+	if len(base.RDNs) > 0 && len(base.RDNs[0].Attributes) == 1 && (&ldap.DN{RDNs: base.RDNs[1:]}).EqualFold(l.groups) {
+		addGroup(user.LookupGroup(base.RDNs[0].Attributes[0].Value))
+	}
+
+	values := make(map[string][]string)
+	equalities(filter, values)
+	for attr, vs := range values {
+		for _, v := range vs {
+			switch attr {
+			case "uid":
+				addUser(user.Lookup(v))
+			case "cn":
+				addUser(user.Lookup(v))
+				addGroup(user.LookupGroup(v))
+			case "uidnumber":
+				addUser(user.LookupId(v))
+			case "gidnumber":
+				addGroup(user.LookupGroupId(v))
+			case "memberuid":
+				addMemberships(v)
+			case "member", "uniquemember":
+				if name, ok := l.username(v); ok {
+					addMemberships(name)
+				}
+			}
+		}
+	}
+	return result
+}
+
+// inScope reports whether dn is within the search's scope.
+func inScope(base, dn *ldap.DN, scope gldap.Scope) bool {
+	switch scope {
+	case gldap.BaseObject:
+		return base.EqualFold(dn)
+	case gldap.SingleLevel:
+		return len(dn.RDNs) == len(base.RDNs)+1 && base.AncestorOfFold(dn)
+	default:
+		return base.EqualFold(dn) || base.AncestorOfFold(dn)
+	}
+}
+
+// values returns the entry's values of the attribute, regardless of
+// case.
+func (e *ldapEntry) values(attr string) []string {
+	for name, vs := range e.attrs {
+		if strings.EqualFold(name, attr) {
+			return vs
+		}
+	}
+	return nil
+}
+
+// matches reports whether the entry matches the filter. Values are
+// compared regardless of case; ordering matches are not supported.
+func (e *ldapEntry) matches(filter *ber.Packet) bool {
+	switch filter.Tag {
+	case ldap.FilterAnd:
+		for _, child := range filter.Children {
+			if !e.matches(child) {
+				return false
+			}
+		}
+		return true
+	case ldap.FilterOr:
+		for _, child := range filter.Children {
+			if e.matches(child) {
+				return true
+			}
+		}
+		return false
+	case ldap.FilterNot:
+		return len(filter.Children) == 1 && !e.matches(filter.Children[0])
+	case ldap.FilterPresent:
+		return len(e.values(filter.Data.String())) > 0
+	case ldap.FilterEqualityMatch, ldap.FilterApproxMatch:
+		if len(filter.Children) != 2 {
+			return false
+		}
+		want := filter.Children[1].Data.String()
+		return slices.ContainsFunc(e.values(filter.Children[0].Data.String()), func(v string) bool {
+			return strings.EqualFold(v, want)
+		})
+	case ldap.FilterSubstrings:
+		if len(filter.Children) != 2 {
+			return false
+		}
+		return slices.ContainsFunc(e.values(filter.Children[0].Data.String()), func(v string) bool {
+			return matchSubstrings(strings.ToLower(v), filter.Children[1].Children)
+		})
+	}
+	return false
+}
+
+// matchSubstrings reports whether v matches the initial, any and
+// final parts of a substrings filter, which must be lowercase.
+func matchSubstrings(v string, parts []*ber.Packet) bool {
+	for _, part := range parts {
+		s := strings.ToLower(part.Data.String())
+		switch part.Tag {
+		case ldap.FilterSubstringsInitial:
+			if !strings.HasPrefix(v, s) {
+				return false
+			}
+			v = v[len(s):]
+		case ldap.FilterSubstringsAny:
+			i := strings.Index(v, s)
+			if i < 0 {
+				return false
+			}
+			v = v[i+len(s):]
+		case ldap.FilterSubstringsFinal:
+			if !strings.HasSuffix(v, s) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// selectAttributes returns the attributes a search asked for.
+func selectAttributes(attrs map[string][]string, requested []string) map[string][]string {
+	if len(requested) == 0 || slices.Contains(requested, "*") {
+		return attrs
+	}
+	result := make(map[string][]string)
+	for name, values := range attrs {
+		if slices.ContainsFunc(requested, func(r string) bool { return strings.EqualFold(r, name) }) {
+			result[name] = values
+		}
+	}
+	return result
+}
+
+func (l *ldapServer) search(w *gldap.ResponseWriter, r *gldap.Request) {
+	resp := r.NewSearchDoneResponse(gldap.WithResponseCode(gldap.ResultOperationsError))
+	defer w.Write(resp)
+	l.mu.Lock()
+	bound := l.bound[r.ConnectionID()]
+	l.mu.Unlock()
+	if bound == "" {
+		resp.SetResultCode(gldap.ResultInsufficientAccessRights)
+		return
+	}
+	m, err := r.GetSearchMessage()
+	if err != nil {
+		log.Info().Err(err).Msg("Rejected LDAP search")
+		return
+	}
+	base, err := ldap.ParseDN(m.BaseDN)
+	if err != nil {
+		resp.SetResultCode(gldap.ResultInvalidDNSyntax)
+		return
+	}
+	filter, err := ldap.CompileFilter(m.Filter)
+	if err != nil {
+		log.Info().Err(err).Msgf("Rejected LDAP filter %q", m.Filter)
+		resp.SetResultCode(gldap.ResultProtocolError)
+		return
+	}
+	if !base.EqualFold(l.base) && !l.base.AncestorOfFold(base) {
+		resp.SetResultCode(gldap.ResultNoSuchObject)
+		return
+	}
+
+	var count int64
+	for _, entry := range l.candidates(base, filter) {
+		if !inScope(base, entry.dn, m.Scope) || !entry.matches(filter) {
+			continue
+		}
+		if m.SizeLimit > 0 && count == m.SizeLimit {
+			resp.SetResultCode(gldap.ResultSizeLimitExceeded)
+			return
+		}
+		count++
+		w.Write(r.NewSearchResponseEntry(entry.dn.String(), gldap.WithAttributes(selectAttributes(entry.attrs, m.Attributes))))
+	}
+	log.Info().Msgf("LDAP search by %q for %q returned %d entries", bound, m.Filter, count)
+	resp.SetResultCode(gldap.ResultSuccess)
+}
@@ -0,0 +1,220 @@
+package commands
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/achernya/nonstick/pamsocket"
+	"github.com/go-ldap/ldap/v3"
+	"github.com/jimlambrt/gldap"
+	"github.com/msteinert/pam/v2"
+)
+
+func newTestLdapServer(t *testing.T, socket *pamsocket.PamSocket) *ldapServer {
+	t.Helper()
+	l, err := newLdapServer(socket, "dc=nonstick,dc=example", newMemStore())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return l
+}
+
+func mustParseDN(t *testing.T, dn string) *ldap.DN {
+	t.Helper()
+	result, err := ldap.ParseDN(dn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return result
+}
+
+func TestLdapUsername(t *testing.T) {
+	l := newTestLdapServer(t, nil)
+	for _, tc := range []struct {
+		name, want string
+		ok         bool
+	}{
+		{"alice", "alice", true},
+		{"uid=alice,ou=people,dc=nonstick,dc=example", "alice", true},
+		{"UID=alice,OU=People,DC=nonstick,DC=example", "alice", true},
+		{"", "", false},
+		{"cn=alice,ou=people,dc=nonstick,dc=example", "", false},
+		{"uid=alice,ou=groups,dc=nonstick,dc=example", "", false},
+		{"uid=alice,ou=people,dc=other,dc=example", "", false},
+		{"uid=alice+cn=bob,ou=people,dc=nonstick,dc=example", "", false},
+		{"uid=alice,ou=people", "", false},
+		{"uid=alice,", "", false},
+	} {
+		got, ok := l.username(tc.name)
+		if got != tc.want || ok != tc.ok {
+			t.Errorf("username(%q) = %q, %v, want %q, %v", tc.name, got, ok, tc.want, tc.ok)
+		}
+	}
+}
+
+func TestLdapMatches(t *testing.T) {
+	entry := &ldapEntry{attrs: map[string][]string{
+		"objectClass": {"top", "posixAccount"},
+		"uid":         {"alice"},
+		"cn":          {"Alice Liddell"},
+		"uidNumber":   {"1000"},
+	}}
+	for _, tc := range []struct {
+		filter string
+		want   bool
+	}{
+		{"(uid=alice)", true},
+		{"(UID=ALICE)", true},
+		{"(uid=bob)", false},
+		{"(uid~=alice)", true},
+		{"(objectClass=posixAccount)", true},
+		{"(&(objectClass=posixAccount)(uid=alice))", true},
+		{"(&(objectClass=posixAccount)(uid=bob))", false},
+		{"(|(uid=bob)(cn=alice liddell))", true},
+		{"(|(uid=bob)(cn=bob))", false},
+		{"(!(uid=bob))", true},
+		{"(!(uid=alice))", false},
+		{"(uid=*)", true},
+		{"(mail=*)", false},
+		{"(cn=alice*)", true},
+		{"(cn=*liddell)", true},
+		{"(cn=*ce li*)", true},
+		{"(cn=a*l*l)", true},
+		{"(cn=bob*)", false},
+		{"(mail=a*)", false},
+		{"(uidNumber>=999)", false},
+	} {
+		filter, err := ldap.CompileFilter(tc.filter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := entry.matches(filter); got != tc.want {
+			t.Errorf("matches(%s) = %v, want %v", tc.filter, got, tc.want)
+		}
+	}
+}
+
+func TestMatchSubstrings(t *testing.T) {
+	for _, tc := range []struct {
+		value, filter string
+		want          bool
+	}{
+		{"abcdef", "(x=abc*)", true},
+		{"abcdef", "(x=*def)", true},
+		{"abcdef", "(x=*cd*)", true},
+		{"abcdef", "(x=a*c*e*)", true},
+		{"abcdef", "(x=ab*ef)", true},
+		{"abcdef", "(x=ABC*)", true},
+		{"abcdef", "(x=b*)", false},
+		{"abcdef", "(x=*e*c*)", false},
+		// The initial and final parts may not overlap.
+		{"aba", "(x=ab*ba)", false},
+		{"a", "(x=a*a)", false},
+		{"aa", "(x=a*a)", true},
+	} {
+		filter, err := ldap.CompileFilter(tc.filter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := matchSubstrings(tc.value, filter.Children[1].Children); got != tc.want {
+			t.Errorf("matchSubstrings(%q, %s) = %v, want %v", tc.value, tc.filter, got, tc.want)
+		}
+	}
+}
+
+func TestInScope(t *testing.T) {
+	base := "ou=people,dc=nonstick,dc=example"
+	for _, tc := range []struct {
+		dn    string
+		scope gldap.Scope
+		want  bool
+	}{
+		{base, gldap.BaseObject, true},
+		{"OU=People,DC=Nonstick,DC=Example", gldap.BaseObject, true},
+		{"uid=alice," + base, gldap.BaseObject, false},
+		{base, gldap.SingleLevel, false},
+		{"uid=alice," + base, gldap.SingleLevel, true},
+		{"cn=x,uid=alice," + base, gldap.SingleLevel, false},
+		{"dc=nonstick,dc=example", gldap.SingleLevel, false},
+		{base, gldap.WholeSubtree, true},
+		{"uid=alice," + base, gldap.WholeSubtree, true},
+		{"cn=x,uid=alice," + base, gldap.WholeSubtree, true},
+		{"uid=alice,ou=groups,dc=nonstick,dc=example", gldap.WholeSubtree, false},
+	} {
+		if got := inScope(mustParseDN(t, base), mustParseDN(t, tc.dn), tc.scope); got != tc.want {
+			t.Errorf("inScope(%q, %d) = %v, want %v", tc.dn, tc.scope, got, tc.want)
+		}
+	}
+}
+
+// passwordAuthenticator accepts the password "secret", recording the
+// PAM_RHOST of each transaction.
+type passwordAuthenticator chan string
+
+func (a passwordAuthenticator) Authenticate(req *pamsocket.AuthRequest, conv pam.ConversationHandler) (*pamsocket.AuthResult, error) {
+	a <- req.Items[pam.Rhost]
+	password, err := conv.RespondPAM(pam.PromptEchoOff, "Password: ")
+	if err != nil || password != "secret" {
+		return nil, errors.Join(pamsocket.ErrAuthenticationFailed, err)
+	}
+	return &pamsocket.AuthResult{Username: req.User}, nil
+}
+
+// freeAddr returns a local address nothing listens on.
+func freeAddr(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
+
+func TestLdapBind(t *testing.T) {
+	account := currentAccount(t)
+	rhosts := make(passwordAuthenticator, 100)
+	l := newTestLdapServer(t, &pamsocket.PamSocket{Authenticator: rhosts})
+	addr := freeAddr(t)
+	go l.Run(addr, nil)
+	var conn *ldap.Conn
+	var err error
+	for i := 0; i < 50; i++ {
+		if conn, err = ldap.DialURL("ldap://" + addr); err == nil {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	dn := l.userDN(account.Username).String()
+
+	if err := conn.Bind(dn, "secret"); err != nil {
+		t.Fatal(err)
+	}
+	if rhost := <-rhosts; rhost != "127.0.0.1" {
+		t.Errorf("got PAM_RHOST %q, want 127.0.0.1", rhost)
+	}
+	// Clients cannot announce another address for themselves.
+	if err := conn.Bind(ldapRelayDN, "guess 192.0.2.1"); !ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+		t.Errorf("got %v binding as the relay, want invalid credentials", err)
+	}
+
+	for i := 0; i < ldapUserFailures; i++ {
+		if err := conn.Bind(dn, "guess"); !ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+			t.Fatalf("got %v for a wrong password, want invalid credentials", err)
+		}
+		<-rhosts
+	}
+	// Even the right password is refused now, without asking PAM.
+	if err := conn.Bind(dn, "secret"); !ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+		t.Errorf("got %v once throttled, want invalid credentials", err)
+	}
+	if len(rhosts) != 0 {
+		t.Error("PAM was asked once throttled")
+	}
+}
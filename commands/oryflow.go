@@ -1,36 +1,139 @@
 package commands
 
 import (
+	"encoding/json"
 	"errors"
+	"fmt"
+	"maps"
 	"net/http"
+	"net/url"
 	"os/user"
 	"slices"
+	"strconv"
 	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/achernya/nonstick/pamsocket"
 
 	hydra "github.com/ory/hydra-client-go/v2"
 )
 
+// defaultScopes are the descriptions of common scopes on the consent
+// page.
+var defaultScopes = map[string]string{
+	"profile": "Access your first and last name",
+	"email":   "Access your email address",
+}
+
+// parseScopes parses `scope=description` descriptions of scopes,
+// on top of defaultScopes.
+func parseScopes(specs []string) (map[string]string, error) {
+	scopes := maps.Clone(defaultScopes)
+	for _, spec := range specs {
+		scope, description, ok := strings.Cut(spec, "=")
+		if !ok || scope == "" || scope == "openid" {
+			return nil, fmt.Errorf("invalid scope description %q", spec)
+		}
+		scopes[scope] = description
+	}
+	return scopes, nil
+}
+
+const (
+	// hydraRememberFor is how long Hydra remembers a sign-in,
+	// skipping the next ones of the same browser.
+	hydraRememberFor = 30 * time.Second
+	// hydraClaimsPrefix prefixes the keys of remembered claims in
+	// the kvStore.
+	hydraClaimsPrefix = "hydra-claims:"
+)
+
 type OryHydraFlow struct {
 	client *hydra.APIClient
+	// scopes are the descriptions of scopes on the consent page.
+	scopes atomic.Pointer[map[string]string]
+	// claimScopes are the scopes with which each claim collected
+	// from PAM is released.
+	claimScopes atomic.Pointer[map[string]string]
+	// remembered holds the claims of each of Hydra's login
+	// sessions for as long as Hydra remembers the sign-in, as
+	// Hydra does not hand them back when it skips a sign-in. If
+	// nil, skipped sign-ins carry no claims.
+	remembered kvStore
 }
 
-func NewOryHydraFlow() *OryHydraFlow {
+func NewOryHydraFlow(adminURL string, scopes map[string]string) *OryHydraFlow {
 	config := hydra.NewConfiguration()
-	config.Servers[0].URL = "http://localhost:4445"
-	return &OryHydraFlow{
-		client: hydra.NewAPIClient(config),
+	config.Servers[0].URL = adminURL
+	result := &OryHydraFlow{client: hydra.NewAPIClient(config)}
+	result.SetScopes(scopes)
+	return result
+}
+
+// SetScopes replaces the descriptions of scopes on the consent page.
+// It may be called while serving.
+func (o *OryHydraFlow) SetScopes(scopes map[string]string) {
+	o.scopes.Store(&scopes)
+}
+
+// SetClaims replaces the scopes with which the claims collected from
+// PAM are released. It may be called while serving.
+func (o *OryHydraFlow) SetClaims(claims map[string]pamsocket.ClaimSource) {
+	scopes := make(map[string]string)
+	for claim, source := range claims {
+		scopes[claim] = source.Scope
 	}
+	o.claimScopes.Store(&scopes)
 }
 
-func (o *OryHydraFlow) loginReq(username string) *hydra.AcceptOAuth2LoginRequest {
+func (o *OryHydraFlow) loginReq(username string, claims map[string]string) *hydra.AcceptOAuth2LoginRequest {
 	req := hydra.NewAcceptOAuth2LoginRequest(username)
 	req.SetRemember(true)
-	req.SetRememberFor(30)
+	req.SetRememberFor(int64(hydraRememberFor / time.Second))
+	if len(claims) > 0 {
+		// Hydra hands the login context back with the consent
+		// request, which is where the ID token is populated.
+		req.SetContext(map[string]interface{}{
+			"claims": claims,
+		})
+	}
 	return req
 }
 
+// rememberClaims records the claims of a sign-in to Hydra's login
+// session, for sign-ins Hydra skips while it remembers this one.
+func (o *OryHydraFlow) rememberClaims(sessionID string, claims map[string]string) error {
+	if o.remembered == nil || sessionID == "" {
+		return nil
+	}
+	data, err := json.Marshal(claims)
+	if err != nil {
+		return err
+	}
+	return o.remembered.Put(hydraClaimsPrefix+sessionID, data, hydraRememberFor)
+}
+
+// rememberedClaims returns the claims of the sign-in to Hydra's login
+// session, or nil if they are no longer remembered.
+func (o *OryHydraFlow) rememberedClaims(sessionID string) (map[string]string, error) {
+	if o.remembered == nil || sessionID == "" {
+		return nil, nil
+	}
+	data, err := o.remembered.Get(hydraClaimsPrefix + sessionID)
+	if errors.Is(err, errNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var claims map[string]string
+	if err := json.Unmarshal(data, &claims); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
 func (o *OryHydraFlow) consentReq(consentResp *hydra.OAuth2ConsentRequest, scopes []string) *hydra.AcceptOAuth2ConsentRequest {
 	req := hydra.NewAcceptOAuth2ConsentRequest()
 	if scopes != nil {
@@ -44,20 +147,45 @@ func (o *OryHydraFlow) consentReq(consentResp *hydra.OAuth2ConsentRequest, scope
 	return req
 }
 
-func (o *OryHydraFlow) fillProfile(uid string) (*hydra.AcceptOAuth2ConsentRequestSession, error) {
-	userinfo, err := user.LookupId(uid)
+func (o *OryHydraFlow) fillProfile(uid string, fields map[string]interface{}) error {
+	profile, err := lookupProfile(uid)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	fields := map[string]string{
-		"name":               userinfo.Name,
-		"preferred_username": userinfo.Username,
+	fields["name"] = profile.Name
+	fields["preferred_username"] = profile.Username
+	if profile.GivenName != "" {
+		fields["given_name"] = profile.GivenName
+		fields["family_name"] = profile.FamilyName
+	}
+	return nil
+}
+
+// fillSession builds the ID token session for an accepted consent:
+// the claims collected from PAM at login whose scope was granted,
+// plus the profile if the `profile` scope was granted.
+func (o *OryHydraFlow) fillSession(consentResp *hydra.OAuth2ConsentRequest, scopes []string) (*hydra.AcceptOAuth2ConsentRequestSession, error) {
+	fields := make(map[string]interface{})
+	var claimScopes map[string]string
+	if p := o.claimScopes.Load(); p != nil {
+		claimScopes = *p
 	}
-	name := strings.Split(userinfo.Name, " ")
-	if len(name) == 2 {
-		fields["given_name"] = name[0]
-		fields["family_name"] = name[1]
+	if loginContext, ok := consentResp.Context.(map[string]interface{}); ok {
+		if claims, ok := loginContext["claims"].(map[string]interface{}); ok {
+			for claim, value := range claims {
+				// Claims no longer configured have no
+				// scope, and are not released.
+				if scope, ok := claimScopes[claim]; ok && slices.Contains(scopes, scope) {
+					fields[claim] = value
+				}
+			}
+		}
+	}
+	if slices.Contains(scopes, "profile") {
+		if err := o.fillProfile(consentResp.GetSubject(), fields); err != nil {
+			return nil, err
+		}
 	}
 
 	session := hydra.NewAcceptOAuth2ConsentRequestSession()
@@ -65,7 +193,27 @@ func (o *OryHydraFlow) fillProfile(uid string) (*hydra.AcceptOAuth2ConsentReques
 	return session, nil
 }
 
-func (o *OryHydraFlow) PreLogin(r *http.Request) (string, error) {
+// resolveLoginHint maps an OpenID Connect `login_hint` to a UNIX
+// username. The hint may be a bare username, or an email-like
+// `user@domain`, in which case only the local part is
+// considered. An empty string is returned if no such user exists.
+func resolveLoginHint(hint string) string {
+	candidates := []string{hint}
+	if local, _, found := strings.Cut(hint, "@"); found {
+		candidates = append(candidates, local)
+	}
+	for _, candidate := range candidates {
+		if candidate == "" {
+			continue
+		}
+		if userinfo, err := user.Lookup(candidate); err == nil {
+			return userinfo.Username
+		}
+	}
+	return ""
+}
+
+func (o *OryHydraFlow) PreLogin(r *http.Request) (*pamsocket.LoginInfo, error) {
 	ctx := r.Context()
 
 	// Ory Hydra should have included a `login_challenge` query
@@ -73,35 +221,80 @@ func (o *OryHydraFlow) PreLogin(r *http.Request) (string, error) {
 	loginChallenge := r.URL.Query().Get("login_challenge")
 	loginResp, _, err := o.client.OAuth2API.GetOAuth2LoginRequest(ctx).LoginChallenge(loginChallenge).Execute()
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
 	// We attemtped to get a new login request, but Hydra believes it's already authenticated.
 	if loginResp.Skip {
+		claims, err := o.rememberedClaims(loginResp.GetSessionId())
+		if err != nil {
+			return nil, err
+		}
 		acceptResp, _, err := o.client.OAuth2API.AcceptOAuth2LoginRequest(ctx).
 			LoginChallenge(loginChallenge).
-			AcceptOAuth2LoginRequest(*o.loginReq(loginResp.Subject)).
+			AcceptOAuth2LoginRequest(*o.loginReq(loginResp.Subject, claims)).
 			Execute()
 		if err != nil {
-			return "", err
+			return nil, err
 		}
-		return acceptResp.RedirectTo, nil
+		return &pamsocket.LoginInfo{
+			Redirect: acceptResp.RedirectTo,
+		}, nil
 	}
 
-	// If we get here, authentication is required
-	return "", nil
+	// If we get here, authentication is required. If Hydra
+	// already knows the subject (e.g., because of `prompt=login`
+	// or `max_age`), this is a re-authentication, and the user
+	// must not be permitted to switch accounts.
+	if loginResp.Subject != "" {
+		userinfo, err := user.LookupId(loginResp.Subject)
+		if err != nil {
+			return nil, err
+		}
+		return &pamsocket.LoginInfo{
+			Username:       userinfo.Username,
+			UsernameFixed:  true,
+			Reauthenticate: true,
+		}, nil
+	}
+	result := &pamsocket.LoginInfo{}
+	// Hydra only applies `prompt` and `max_age` to its own
+	// session, so pass them on in case another session would
+	// stand in for the sign-in.
+	if requestURL, err := url.Parse(loginResp.RequestUrl); err == nil {
+		query := requestURL.Query()
+		result.Reauthenticate = slices.Contains(strings.Fields(query.Get("prompt")), "login")
+		if maxAge, err := strconv.Atoi(query.Get("max_age")); err == nil && maxAge >= 0 {
+			result.MaxAge = time.Duration(maxAge) * time.Second
+			result.Reauthenticate = result.Reauthenticate || maxAge == 0
+		}
+	}
+	if oidc, ok := loginResp.GetOidcContextOk(); ok {
+		result.Username = resolveLoginHint(oidc.GetLoginHint())
+	}
+	return result, nil
 }
 
-func (o *OryHydraFlow) Authenticated(r *http.Request, subject string) (string, error) {
+func (o *OryHydraFlow) Authenticated(r *http.Request, subject string, claims map[string]string) (string, error) {
 	ctx := r.Context()
 	loginChallenge := r.URL.Query().Get("login_challenge")
+	// The claims are remembered for the login session the sign-in
+	// is to, so that another session of the subject (e.g., in
+	// another browser) does not receive them.
+	loginResp, _, err := o.client.OAuth2API.GetOAuth2LoginRequest(ctx).LoginChallenge(loginChallenge).Execute()
+	if err != nil {
+		return "", err
+	}
 	acceptResp, _, err := o.client.OAuth2API.AcceptOAuth2LoginRequest(ctx).
 		LoginChallenge(loginChallenge).
-		AcceptOAuth2LoginRequest(*o.loginReq(subject)).
+		AcceptOAuth2LoginRequest(*o.loginReq(subject, claims)).
 		Execute()
 	if err != nil {
 		return "", err
 	}
+	if err := o.rememberClaims(loginResp.GetSessionId(), claims); err != nil {
+		return "", err
+	}
 	return acceptResp.RedirectTo, nil
 }
 
@@ -119,13 +312,11 @@ func (o *OryHydraFlow) RequestConsent(r *http.Request) (*pamsocket.ConsentInfo,
 		// -- no need to show the consent screen to the user
 		// again.
 		consentReq := o.consentReq(consentResp, nil)
-		if slices.Contains(consentResp.RequestedScope, "profile") {
-			session, err := o.fillProfile(consentResp.GetSubject())
-			if err != nil {
-				return nil, err
-			}
-			consentReq.SetSession(*session)
+		session, err := o.fillSession(consentResp, consentResp.RequestedScope)
+		if err != nil {
+			return nil, err
 		}
+		consentReq.SetSession(*session)
 
 		acceptResp, _, err := o.client.OAuth2API.AcceptOAuth2ConsentRequest(ctx).
 			ConsentChallenge(consentChallenge).
@@ -149,29 +340,23 @@ func (o *OryHydraFlow) RequestConsent(r *http.Request) (*pamsocket.ConsentInfo,
 	if result.Target == "" {
 		result.Target = client.GetClientId()
 	}
+	scopes := *o.scopes.Load()
 	for _, element := range consentResp.GetRequestedScope() {
-		switch element {
-		case "openid":
+		if element == "openid" {
 			result.Scopes = append(result.Scopes, &pamsocket.Scope{
 				Name:   "scope." + element,
 				Hidden: true,
 			})
-		case "profile":
-			result.Scopes = append(result.Scopes, &pamsocket.Scope{
-				Name:        "scope." + element,
-				Description: "Access your first and last name",
-			})
-		case "email":
-			result.Scopes = append(result.Scopes, &pamsocket.Scope{
-				Name:        "scope." + element,
-				Description: "Access your email address",
-			})
-		default:
-			result.Scopes = append(result.Scopes, &pamsocket.Scope{
-				Name:        "scope." + element,
-				Description: "(no detailed description) access to '" + element + "'",
-			})
+			continue
+		}
+		description, ok := scopes[element]
+		if !ok {
+			description = "(no detailed description) access to '" + element + "'"
 		}
+		result.Scopes = append(result.Scopes, &pamsocket.Scope{
+			Name:        "scope." + element,
+			Description: description,
+		})
 	}
 	return result, nil
 }
@@ -213,13 +398,11 @@ func (o *OryHydraFlow) AcceptConsent(r *http.Request) (string, error) {
 		return rejectResp.RedirectTo, nil
 	case "Accept":
 		consentReq := o.consentReq(consentResp, scopes)
-		if slices.Contains(scopes, "profile") {
-			session, err := o.fillProfile(consentResp.GetSubject())
-			if err != nil {
-				return "", err
-			}
-			consentReq.SetSession(*session)
+		session, err := o.fillSession(consentResp, scopes)
+		if err != nil {
+			return "", err
 		}
+		consentReq.SetSession(*session)
 		acceptResp, _, err := o.client.OAuth2API.AcceptOAuth2ConsentRequest(ctx).
 			ConsentChallenge(consentChallenge).
 			AcceptOAuth2ConsentRequest(*consentReq).
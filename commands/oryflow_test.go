@@ -0,0 +1,181 @@
+package commands
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/user"
+	"reflect"
+	"strconv"
+	"testing"
+
+	"github.com/achernya/nonstick/pamsocket"
+
+	hydra "github.com/ory/hydra-client-go/v2"
+)
+
+// fakeHydra answers login requests like Hydra's admin API, skipping
+// the sign-in if skip is set, and records what logins were accepted
+// with.
+type fakeHydra struct {
+	skip    bool
+	subject string
+	// sessionID is the login session the requests are in.
+	sessionID string
+	accepted  []hydra.AcceptOAuth2LoginRequest
+	// userCode is the device user code accepted for the device
+	// challenge "device". If empty, Hydra fails.
+	userCode string
+	// requestURL is the authorization request being signed in
+	// to, if not a plain one.
+	requestURL string
+}
+
+func (f *fakeHydra) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	switch r.URL.Path {
+	case "/admin/oauth2/auth/requests/login":
+		requestURL := f.requestURL
+		if requestURL == "" {
+			requestURL = "https://hydra.example/oauth2/auth"
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"challenge":   r.URL.Query().Get("login_challenge"),
+			"client":      map[string]interface{}{"client_id": "app"},
+			"request_url": requestURL,
+			"skip":        f.skip,
+			"subject":     f.subject,
+			"session_id":  f.sessionID,
+		})
+	case "/admin/oauth2/auth/requests/login/accept":
+		var req hydra.AcceptOAuth2LoginRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		f.accepted = append(f.accepted, req)
+		json.NewEncoder(w).Encode(map[string]interface{}{"redirect_to": "https://hydra.example/next"})
+	case "/admin/oauth2/auth/requests/device/accept":
+		var req struct {
+			UserCode string `json:"user_code"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		switch {
+		case f.userCode == "":
+			http.Error(w, "{}", http.StatusInternalServerError)
+		case r.Method != http.MethodPut || r.URL.Query().Get("device_challenge") != "device" || req.UserCode != f.userCode:
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_request", "error_description": "wrong user code"})
+		default:
+			json.NewEncoder(w).Encode(map[string]interface{}{"redirect_to": "https://hydra.example/device/next"})
+		}
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// acceptedClaims returns the claims the last login was accepted with.
+func (f *fakeHydra) acceptedClaims(t *testing.T) interface{} {
+	t.Helper()
+	if len(f.accepted) == 0 {
+		t.Fatal("No login was accepted")
+	}
+	context, _ := f.accepted[len(f.accepted)-1].Context.(map[string]interface{})
+	return context["claims"]
+}
+
+func TestSkippedLoginKeepsClaims(t *testing.T) {
+	fake := &fakeHydra{subject: "1000", sessionID: "browser"}
+	ts := httptest.NewServer(fake)
+	defer ts.Close()
+	flow := NewOryHydraFlow(ts.URL, defaultScopes)
+	flow.remembered = newMemStore()
+
+	r := httptest.NewRequest("GET", "/login?login_challenge=first", nil)
+	if _, err := flow.Authenticated(r, "1000", map[string]string{"email": "alice@example.com"}); err != nil {
+		t.Fatal(err)
+	}
+
+	fake.skip = true
+	r = httptest.NewRequest("GET", "/login?login_challenge=second", nil)
+	info, err := flow.PreLogin(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Redirect != "https://hydra.example/next" {
+		t.Errorf("Skipped sign-in redirected to %q", info.Redirect)
+	}
+	want := map[string]interface{}{"email": "alice@example.com"}
+	if got := fake.acceptedClaims(t); !reflect.DeepEqual(got, want) {
+		t.Errorf("Skipped sign-in was accepted with claims %v, want %v", got, want)
+	}
+
+	// The subject's sign-in in another login session (e.g.,
+	// another browser) has nothing remembered.
+	fake.sessionID = "other"
+	if _, err := flow.PreLogin(r); err != nil {
+		t.Fatal(err)
+	}
+	if got := fake.acceptedClaims(t); got != nil {
+		t.Errorf("Skipped sign-in in another session was accepted with claims %v", got)
+	}
+}
+
+func TestFillSession(t *testing.T) {
+	self, err := user.LookupId(strconv.Itoa(os.Getuid()))
+	if err != nil {
+		t.Skipf("Cannot look up the current user: %v", err)
+	}
+	loginContext := map[string]interface{}{
+		"claims": map[string]interface{}{
+			"email":          "alice@example.com",
+			"krb5_principal": "alice@EXAMPLE.COM",
+			// Configured no longer.
+			"remote_host": "192.0.2.1",
+		},
+	}
+	claims, err := pamsocket.ParseClaims([]string{"email=env:EMAIL", "krb5_principal=env:KRB5_PRINCIPAL@kerberos"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	flow := &OryHydraFlow{}
+	flow.SetClaims(claims)
+	for _, tc := range []struct {
+		name    string
+		context interface{}
+		scopes  []string
+		want    map[string]interface{}
+	}{
+		{"no claims", nil, []string{"openid"}, map[string]interface{}{}},
+		{"claims without scopes", loginContext, []string{"openid"}, map[string]interface{}{}},
+		{"claims", loginContext, []string{"openid", "email", "kerberos"}, map[string]interface{}{
+			"email":          "alice@example.com",
+			"krb5_principal": "alice@EXAMPLE.COM",
+		}},
+		{"unexpected context", map[string]interface{}{"claims": "email"}, []string{"openid", "email"}, map[string]interface{}{}},
+		{"profile", loginContext, []string{"openid", "profile", "email"}, map[string]interface{}{
+			"email":              "alice@example.com",
+			"name":               self.Name,
+			"preferred_username": self.Username,
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			consent := hydra.NewOAuth2ConsentRequest("challenge")
+			consent.SetSubject(self.Uid)
+			consent.Context = tc.context
+			session, err := flow.fillSession(consent, tc.scopes)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := session.IdToken.(map[string]interface{})
+			// The name may or may not split into given and
+			// family names.
+			delete(got, "given_name")
+			delete(got, "family_name")
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("fillSession() = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,60 @@
+package commands
+
+import (
+	"os/user"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+)
+
+// unixProfile describes a UNIX account, as exposed to relying
+// parties.
+type unixProfile struct {
+	Username   string
+	Name       string
+	GivenName  string
+	FamilyName string
+	// Groups are the names of the groups the user is a member
+	// of.
+	Groups []string
+}
+
+// lookupProfile returns the profile of the UNIX account with the
+// given UID.
+func lookupProfile(uid string) (*unixProfile, error) {
+	userinfo, err := user.LookupId(uid)
+	if err != nil {
+		return nil, err
+	}
+	profile := &unixProfile{
+		Username: userinfo.Username,
+		Name:     userinfo.Name,
+		Groups:   userGroups(userinfo),
+	}
+	name := strings.Split(userinfo.Name, " ")
+	if len(name) == 2 {
+		profile.GivenName = name[0]
+		profile.FamilyName = name[1]
+	}
+	return profile, nil
+}
+
+// userGroups returns the names of the groups the user is a member
+// of. Groups that cannot be resolved are skipped.
+func userGroups(userinfo *user.User) []string {
+	gids, err := userinfo.GroupIds()
+	if err != nil {
+		log.Error().Err(err).Msgf("Could not list groups of %q", userinfo.Username)
+		return nil
+	}
+	var groups []string
+	for _, gid := range gids {
+		group, err := user.LookupGroupId(gid)
+		if err != nil {
+			log.Warn().Err(err).Msgf("Could not look up group %s", gid)
+			continue
+		}
+		groups = append(groups, group.Name)
+	}
+	return groups
+}
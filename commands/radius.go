@@ -0,0 +1,389 @@
+package commands
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/md5"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/achernya/nonstick/pamsocket"
+	"github.com/gorilla/securecookie"
+	"github.com/rs/zerolog/log"
+	"layeh.com/radius"
+	"layeh.com/radius/rfc2865"
+	"layeh.com/radius/rfc2869"
+)
+
+const (
+	// radiusWait bounds how long a RADIUS request waits for PAM.
+	// Past it, no reply is sent, and the client retransmits the
+	// request.
+	radiusWait = 5 * time.Second
+	// radiusChallengeAge is how long a challenge is remembered, as
+	// long as a conversation may last.
+	radiusChallengeAge = 15 * time.Minute
+	// radiusRequestAge is how long a request is remembered, for
+	// its retransmissions.
+	radiusRequestAge = time.Minute
+	// radiusUserFailures and radiusHostFailures are how many
+	// authentications may fail for a user, or from a client,
+	// within radiusFailureWindow, before further ones are refused.
+	radiusUserFailures  = 5
+	radiusHostFailures  = 20
+	radiusFailureWindow = 15 * time.Minute
+)
+
+// radiusRequest is an Access-Request being answered. Retransmissions
+// of it, which have the same source, Identifier and Authenticator,
+// continue its conversation, rather than start another, and get the
+// same reply.
+type radiusRequest struct {
+	conversation *pamsocket.Conversation
+	// password answers the next hidden prompt, until it is used.
+	password string
+	// busy is set while the request is being answered.
+	busy bool
+	// reply is the reply sent, once there is one.
+	reply   *radius.Packet
+	expires time.Time
+}
+
+// radiusChallenge is a conversation waiting for the client to answer
+// an Access-Challenge.
+type radiusChallenge struct {
+	conversation *pamsocket.Conversation
+	username     string
+	expires      time.Time
+}
+
+// radiusServer authenticates RADIUS Access-Requests with a PAM
+// conversation. Access-Requests must carry a Message-Authenticator,
+// and every reply does. The PAP password answers PAM's first hidden
+// prompt; any further prompt (e.g., for a one-time code) is sent as an
+// Access-Challenge, with a State of its own, and answered by the next
+// Access-Request, once. Prompts that need a browser, such as
+// WebAuthn, fail the authentication. Conversations cannot be passed
+// on to other replicas over RADIUS, so a load balancer in front of
+// several must send each client to the same one.
+type radiusServer struct {
+	socket *pamsocket.PamSocket
+	// users and hosts throttle failed authentications by
+	// username, and by client address.
+	users *failureThrottle
+	hosts *failureThrottle
+
+	mu sync.Mutex
+	// challenges holds the conversations waiting for an answer,
+	// by the State of their Access-Challenge.
+	challenges map[string]radiusChallenge
+	// requests holds the recent requests, by source, Identifier
+	// and Authenticator.
+	requests map[string]*radiusRequest
+}
+
+// newRadiusServer returns a RADIUS server authenticating users with
+// the socket's PAM service, counting failures in kv.
+func newRadiusServer(socket *pamsocket.PamSocket, kv kvStore) *radiusServer {
+	return &radiusServer{
+		socket:     socket,
+		users:      newFailureThrottle(kv, "radius-user", radiusUserFailures, radiusFailureWindow),
+		hosts:      newFailureThrottle(kv, "radius-host", radiusHostFailures, radiusFailureWindow),
+		challenges: make(map[string]radiusChallenge),
+		requests:   make(map[string]*radiusRequest),
+	}
+}
+
+// request returns the request r is, or retransmits, marked busy, or
+// the reply to send again, if it was answered. Both are nil if it is
+// still being answered, which sends the reply.
+func (rs *radiusServer) request(r *radius.Request) (*radiusRequest, *radius.Packet) {
+	key := fmt.Sprintf("%s/%d/%x", r.RemoteAddr, r.Identifier, r.Authenticator)
+	now := time.Now()
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	for key, req := range rs.requests {
+		if now.After(req.expires) {
+			delete(rs.requests, key)
+		}
+	}
+	req, ok := rs.requests[key]
+	switch {
+	case !ok:
+		req = &radiusRequest{expires: now.Add(radiusRequestAge)}
+		rs.requests[key] = req
+	case req.reply != nil:
+		return nil, req.reply
+	case req.busy:
+		return nil, nil
+	}
+	req.busy = true
+	return req, nil
+}
+
+// reply sends the reply to the request, with a Message-Authenticator,
+// and keeps it for retransmissions. If resp is nil, nothing is sent,
+// and a retransmission continues.
+func (rs *radiusServer) reply(w radius.ResponseWriter, req *radiusRequest, resp *radius.Packet) {
+	if resp != nil {
+		if err := addMessageAuthenticator(resp); err != nil {
+			log.Error().Err(err).Msg("Could not sign RADIUS reply")
+			resp = nil
+		}
+	}
+	rs.mu.Lock()
+	req.busy = false
+	req.reply = resp
+	rs.mu.Unlock()
+	if resp != nil {
+		w.Write(resp)
+	}
+}
+
+// challenged records that the conversation is waiting for the user
+// to answer an Access-Challenge, and returns the State to send with
+// it.
+func (rs *radiusServer) challenged(c *pamsocket.Conversation, username string) string {
+	state := string(securecookie.GenerateRandomKey(16))
+	now := time.Now()
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	for state, challenge := range rs.challenges {
+		if now.After(challenge.expires) {
+			delete(rs.challenges, state)
+		}
+	}
+	rs.challenges[state] = radiusChallenge{
+		conversation: c,
+		username:     username,
+		expires:      now.Add(radiusChallengeAge),
+	}
+	return state
+}
+
+// resume returns the conversation an Access-Request answers, if it
+// belongs to the user. Each State is only answered once.
+func (rs *radiusServer) resume(state, username string) *pamsocket.Conversation {
+	rs.mu.Lock()
+	challenge, ok := rs.challenges[state]
+	delete(rs.challenges, state)
+	rs.mu.Unlock()
+	if !ok || challenge.username != username || time.Now().After(challenge.expires) {
+		return nil
+	}
+	return rs.socket.Resume(challenge.conversation.ID)
+}
+
+func (rs *radiusServer) done(c *pamsocket.Conversation) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	for state, challenge := range rs.challenges {
+		if challenge.conversation == c {
+			delete(rs.challenges, state)
+		}
+	}
+}
+
+// addMessageAuthenticator adds a Message-Authenticator (RFC 3579,
+// section 3.2) to the packet, as its first attribute. For a reply,
+// the packet's Authenticator must still be that of the request.
+func addMessageAuthenticator(p *radius.Packet) error {
+	avp := &radius.AVP{Type: rfc2869.MessageAuthenticator_Type, Attribute: make(radius.Attribute, md5.Size)}
+	p.Attributes = append(radius.Attributes{avp}, p.Attributes...)
+	b, err := p.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	mac := hmac.New(md5.New, p.Secret)
+	mac.Write(b)
+	copy(avp.Attribute, mac.Sum(nil))
+	return nil
+}
+
+// validMessageAuthenticator reports whether the packet carries a
+// single Message-Authenticator, made with the shared secret.
+func validMessageAuthenticator(p *radius.Packet) bool {
+	var avp *radius.AVP
+	for _, a := range p.Attributes {
+		if a.Type != rfc2869.MessageAuthenticator_Type {
+			continue
+		}
+		if avp != nil {
+			return false
+		}
+		avp = a
+	}
+	if avp == nil || len(avp.Attribute) != md5.Size {
+		return false
+	}
+	received := avp.Attribute
+	avp.Attribute = make(radius.Attribute, md5.Size)
+	b, err := p.MarshalBinary()
+	avp.Attribute = received
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(md5.New, p.Secret)
+	mac.Write(b)
+	return hmac.Equal(mac.Sum(nil), received)
+}
+
+// reply sends the reply, with a Message-Authenticator.
+func reply(w radius.ResponseWriter, resp *radius.Packet) {
+	if err := addMessageAuthenticator(resp); err != nil {
+		log.Error().Err(err).Msg("Could not sign RADIUS reply")
+		return
+	}
+	w.Write(resp)
+}
+
+// radiusHost returns the address the request came from.
+func radiusHost(r *radius.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr.String())
+	if err != nil {
+		return ""
+	}
+	return host
+}
+
+func (rs *radiusServer) ServeRADIUS(w radius.ResponseWriter, r *radius.Request) {
+	if r.Code != radius.CodeAccessRequest {
+		return
+	}
+	// Nothing else authenticates an Access-Request, nor binds the
+	// reply to all of it, so forged replies could otherwise be
+	// made to fit (BlastRADIUS, CVE-2024-3596). Such requests are
+	// silently discarded.
+	if !validMessageAuthenticator(r.Packet) {
+		log.Info().Msgf("Discarded RADIUS request from %s without a valid Message-Authenticator", r.RemoteAddr)
+		return
+	}
+	username := rfc2865.UserName_GetString(r.Packet)
+	password, err := rfc2865.UserPassword_LookupString(r.Packet)
+	if username == "" || err != nil {
+		// Only PAP is supported, since PAM needs the password
+		// itself.
+		log.Info().Msgf("Rejected RADIUS request from %s without a username and password", r.RemoteAddr)
+		reply(w, r.Response(radius.CodeAccessReject))
+		return
+	}
+
+	req, resent := rs.request(r)
+	if resent != nil {
+		w.Write(resent)
+		return
+	}
+	if req == nil {
+		// The request is still being answered, so this
+		// retransmission is dropped.
+		return
+	}
+	if req.conversation == nil {
+		if state := rfc2865.State_Get(r.Packet); state != nil {
+			c := rs.resume(string(state), username)
+			if c == nil {
+				log.Info().Msgf("Rejected RADIUS request for %q with an unknown or already answered state", username)
+				rs.reply(w, req, r.Response(radius.CodeAccessReject))
+				return
+			}
+			if err := c.Answer(password); err != nil {
+				log.Info().Err(err).Msg("Could not answer RADIUS challenge")
+			}
+			req.conversation = c
+		} else {
+			// The client is the NAS, whose address is that of
+			// the packet. Calling-Station-Id is only what the NAS
+			// says about the user, so it is merely logged.
+			rhost := radiusHost(r)
+			if !rs.users.Allowed(username) || !rs.hosts.Allowed(rhost) {
+				log.Info().Msgf("Refused RADIUS request for %q from %s after too many failures", username, rhost)
+				rs.reply(w, req, r.Response(radius.CodeAccessReject))
+				return
+			}
+			log.Info().Msgf("RADIUS request for %q from %s, calling station %q", username, rhost, rfc2865.CallingStationID_GetString(r.Packet))
+			req.conversation = rs.socket.StartUser(username, rhost)
+			req.password = password
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), radiusWait)
+	defer cancel()
+	resp, err := rs.step(ctx, r, req, username)
+	if err != nil {
+		log.Info().Err(err).Msgf("No RADIUS reply for %q", username)
+	}
+	rs.reply(w, req, resp)
+}
+
+// step runs the request's conversation until it prompts, or is
+// over, and returns the reply for the client. The request's password,
+// if set, answers the first hidden prompt.
+func (rs *radiusServer) step(ctx context.Context, r *radius.Request, req *radiusRequest, username string) (*radius.Packet, error) {
+	c := req.conversation
+	a := c.Attach()
+	defer a.Detach()
+	var messages []string
+	for {
+		msg, err := a.Next(ctx)
+		if errors.Is(err, pamsocket.ErrConversationOver) {
+			rs.done(c)
+			return rs.result(r, c, username, messages), nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch msg.Type {
+		case "Info", "Error":
+			messages = append(messages, msg.Message)
+		case "PromptEchoOff", "PromptEchoOn":
+			if msg.Type == "PromptEchoOff" && req.password != "" {
+				a.Answer(req.password)
+				req.password = ""
+				continue
+			}
+			resp := r.Response(radius.CodeAccessChallenge)
+			rfc2865.State_SetString(resp, rs.challenged(c, username))
+			replyMessage(resp, append(messages, msg.Message))
+			return resp, nil
+		case "WebAuthnRegister", "WebAuthnAssert":
+			// WebAuthn needs a browser.
+			a.Answer("")
+		}
+	}
+}
+
+// result returns the reply for a finished conversation.
+func (rs *radiusServer) result(r *radius.Request, c *pamsocket.Conversation, username string, messages []string) *radius.Packet {
+	identity, err := c.Result()
+	if err != nil {
+		log.Info().Err(err).Msgf("RADIUS authentication of %q failed", username)
+		if errors.Is(err, pamsocket.ErrAuthenticationFailed) {
+			rs.users.Failed(username)
+			rs.hosts.Failed(radiusHost(r))
+		}
+		resp := r.Response(radius.CodeAccessReject)
+		replyMessage(resp, append(messages, pamsocket.UserMessage(err)))
+		return resp
+	}
+	log.Info().Msgf("RADIUS authenticated %q for %s", identity.User.Username, r.RemoteAddr)
+	resp := r.Response(radius.CodeAccessAccept)
+	replyMessage(resp, messages)
+	return resp
+}
+
+// replyMessage adds the messages to the packet as a Reply-Message,
+// truncated to fit a single attribute.
+func replyMessage(p *radius.Packet, messages []string) {
+	if len(messages) == 0 {
+		return
+	}
+	text := strings.Join(messages, "\n")
+	if len(text) > 253 {
+		text = text[:253]
+	}
+	rfc2865.ReplyMessage_SetString(p, text)
+}
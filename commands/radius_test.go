@@ -0,0 +1,283 @@
+package commands
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/achernya/nonstick/pamsocket"
+	"github.com/msteinert/pam/v2"
+	"layeh.com/radius"
+	"layeh.com/radius/rfc2865"
+)
+
+var testRadiusSecret = []byte("radius secret")
+
+// newTestRadiusServer serves RADIUS on a local port, authenticating
+// with the authenticator, and returns its address.
+func newTestRadiusServer(t *testing.T, authenticator pamsocket.Authenticator) string {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &radius.PacketServer{
+		Handler:      newRadiusServer(&pamsocket.PamSocket{Authenticator: authenticator}, newMemStore()),
+		SecretSource: radius.StaticSecretSource(testRadiusSecret),
+	}
+	go server.Serve(conn)
+	t.Cleanup(func() { server.Shutdown(context.Background()) })
+	return conn.LocalAddr().String()
+}
+
+// accessRequest returns an Access-Request for the username and
+// password, with a Message-Authenticator if signed.
+func accessRequest(t *testing.T, username, password string, signed bool) *radius.Packet {
+	t.Helper()
+	p := radius.New(radius.CodeAccessRequest, testRadiusSecret)
+	rfc2865.UserName_SetString(p, username)
+	rfc2865.UserPassword_SetString(p, password)
+	if signed {
+		if err := addMessageAuthenticator(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return p
+}
+
+// radiusExchange sends the request, and checks the reply carries a valid
+// Message-Authenticator.
+func radiusExchange(t *testing.T, addr string, req *radius.Packet) *radius.Packet {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	resp, err := radius.Exchange(ctx, req, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The reply's Message-Authenticator is made with the request's
+	// authenticator in place of its own.
+	resp.Authenticator = req.Authenticator
+	if !validMessageAuthenticator(resp) {
+		t.Errorf("%v reply has no valid Message-Authenticator", resp.Code)
+	}
+	return resp
+}
+
+func TestMessageAuthenticator(t *testing.T) {
+	p := accessRequest(t, "alice", "secret", true)
+	if !validMessageAuthenticator(p) {
+		t.Error("Signed request was not valid")
+	}
+	rfc2865.UserName_SetString(p, "bob")
+	if validMessageAuthenticator(p) {
+		t.Error("Altered request was valid")
+	}
+
+	p = accessRequest(t, "alice", "secret", true)
+	p.Secret = []byte("other secret")
+	if validMessageAuthenticator(p) {
+		t.Error("Request signed with another secret was valid")
+	}
+
+	p = accessRequest(t, "alice", "secret", true)
+	if err := addMessageAuthenticator(p); err != nil {
+		t.Fatal(err)
+	}
+	if validMessageAuthenticator(p) {
+		t.Error("Request with two Message-Authenticators was valid")
+	}
+	if validMessageAuthenticator(accessRequest(t, "alice", "secret", false)) {
+		t.Error("Request without a Message-Authenticator was valid")
+	}
+}
+
+func TestRadiusAccessRequest(t *testing.T) {
+	account := currentAccount(t)
+	rhosts := make(passwordAuthenticator, 100)
+	addr := newTestRadiusServer(t, rhosts)
+
+	// Requests without a Message-Authenticator are dropped.
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	if resp, err := radius.Exchange(ctx, accessRequest(t, account.Username, "secret", false), addr); err == nil {
+		t.Errorf("got %v for a request without a Message-Authenticator, want no reply", resp.Code)
+	}
+	if len(rhosts) != 0 {
+		t.Error("PAM was asked for a request without a Message-Authenticator")
+	}
+
+	// PAM_RHOST is the address the request came from, whatever
+	// the NAS says about the user.
+	req := radius.New(radius.CodeAccessRequest, testRadiusSecret)
+	rfc2865.UserName_SetString(req, account.Username)
+	rfc2865.UserPassword_SetString(req, "secret")
+	rfc2865.CallingStationID_SetString(req, "192.0.2.1")
+	if err := addMessageAuthenticator(req); err != nil {
+		t.Fatal(err)
+	}
+	if resp := radiusExchange(t, addr, req); resp.Code != radius.CodeAccessAccept {
+		t.Errorf("got %v for the right password, want Access-Accept", resp.Code)
+	}
+	if rhost := <-rhosts; rhost != "127.0.0.1" {
+		t.Errorf("got PAM_RHOST %q, want 127.0.0.1", rhost)
+	}
+	if resp := radiusExchange(t, addr, accessRequest(t, account.Username, "guess", true)); resp.Code != radius.CodeAccessReject {
+		t.Errorf("got %v for a wrong password, want Access-Reject", resp.Code)
+	}
+	<-rhosts
+	if resp := radiusExchange(t, addr, accessRequest(t, "", "secret", true)); resp.Code != radius.CodeAccessReject {
+		t.Errorf("got %v without a username, want Access-Reject", resp.Code)
+	}
+
+	for i := 1; i < radiusUserFailures; i++ {
+		radiusExchange(t, addr, accessRequest(t, account.Username, "guess", true))
+		<-rhosts
+	}
+	// Even the right password is refused now, without asking PAM.
+	if resp := radiusExchange(t, addr, accessRequest(t, account.Username, "secret", true)); resp.Code != radius.CodeAccessReject {
+		t.Errorf("got %v once throttled, want Access-Reject", resp.Code)
+	}
+	if len(rhosts) != 0 {
+		t.Error("PAM was asked once throttled")
+	}
+}
+
+// codeAuthenticator asks for the password "secret", then for the
+// codes "1" and "2".
+type codeAuthenticator struct{}
+
+func (codeAuthenticator) Authenticate(req *pamsocket.AuthRequest, conv pam.ConversationHandler) (*pamsocket.AuthResult, error) {
+	for _, prompt := range []struct {
+		style  pam.Style
+		text   string
+		answer string
+	}{
+		{pam.PromptEchoOff, "Password: ", "secret"},
+		{pam.PromptEchoOn, "First code: ", "1"},
+		{pam.PromptEchoOn, "Second code: ", "2"},
+	} {
+		answer, err := conv.RespondPAM(prompt.style, prompt.text)
+		if err != nil || answer != prompt.answer {
+			return nil, errors.Join(pamsocket.ErrAuthenticationFailed, err)
+		}
+	}
+	return &pamsocket.AuthResult{Username: req.User}, nil
+}
+
+// answerChallenge returns an Access-Request answering the challenge.
+func answerChallenge(t *testing.T, username, answer string, challenge *radius.Packet) *radius.Packet {
+	t.Helper()
+	p := radius.New(radius.CodeAccessRequest, testRadiusSecret)
+	rfc2865.UserName_SetString(p, username)
+	rfc2865.UserPassword_SetString(p, answer)
+	rfc2865.State_Set(p, rfc2865.State_Get(challenge))
+	if err := addMessageAuthenticator(p); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestRadiusChallenge(t *testing.T) {
+	account := currentAccount(t)
+	addr := newTestRadiusServer(t, codeAuthenticator{})
+
+	first := radiusExchange(t, addr, accessRequest(t, account.Username, "secret", true))
+	if first.Code != radius.CodeAccessChallenge {
+		t.Fatalf("got %v for the password, want Access-Challenge", first.Code)
+	}
+	second := radiusExchange(t, addr, answerChallenge(t, account.Username, "1", first))
+	if second.Code != radius.CodeAccessChallenge {
+		t.Fatalf("got %v for the first code, want Access-Challenge", second.Code)
+	}
+	if string(rfc2865.State_Get(first)) == string(rfc2865.State_Get(second)) {
+		t.Error("Both challenges have the same State")
+	}
+
+	// Each State is answered once.
+	if resp := radiusExchange(t, addr, answerChallenge(t, account.Username, "2", first)); resp.Code != radius.CodeAccessReject {
+		t.Errorf("got %v answering the first challenge again, want Access-Reject", resp.Code)
+	}
+	if resp := radiusExchange(t, addr, answerChallenge(t, "other", "2", second)); resp.Code != radius.CodeAccessReject {
+		t.Errorf("got %v answering as another user, want Access-Reject", resp.Code)
+	}
+
+	// Answering each challenge in turn signs in.
+	resp := radiusExchange(t, addr, accessRequest(t, account.Username, "secret", true))
+	for _, code := range []string{"1", "2"} {
+		resp = radiusExchange(t, addr, answerChallenge(t, account.Username, code, resp))
+	}
+	if resp.Code != radius.CodeAccessAccept {
+		t.Errorf("got %v once every challenge was answered, want Access-Accept", resp.Code)
+	}
+}
+
+// slowAuthenticator is a passwordAuthenticator taking its time.
+type slowAuthenticator struct{ passwordAuthenticator }
+
+func (a slowAuthenticator) Authenticate(req *pamsocket.AuthRequest, conv pam.ConversationHandler) (*pamsocket.AuthResult, error) {
+	time.Sleep(300 * time.Millisecond)
+	return a.passwordAuthenticator.Authenticate(req, conv)
+}
+
+func TestRadiusRetransmission(t *testing.T) {
+	account := currentAccount(t)
+	rhosts := make(passwordAuthenticator, 100)
+	addr := newTestRadiusServer(t, slowAuthenticator{rhosts})
+
+	// The client retransmits while PAM is still busy, which must
+	// not start another transaction.
+	client := &radius.Client{Retry: 50 * time.Millisecond}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	req := accessRequest(t, account.Username, "guess", true)
+	resp, err := client.Exchange(ctx, req, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Code != radius.CodeAccessReject {
+		t.Errorf("got %v for a wrong password, want Access-Reject", resp.Code)
+	}
+
+	// Retransmissions after the reply, from the same source, get
+	// it again.
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	b, err := req.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var replies [][]byte
+	for i := 0; i < 2; i++ {
+		// Like a client, retransmit until there is a reply: the
+		// packet server drops a retransmission arriving before it
+		// is done with the request, even if it was answered.
+		buf := make([]byte, radius.MaxPacketLength)
+		var n int
+		for attempt := 0; ; attempt++ {
+			if _, err := conn.Write(b); err != nil {
+				t.Fatal(err)
+			}
+			conn.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+			if n, err = conn.Read(buf); err == nil {
+				break
+			}
+			if attempt == 10 {
+				t.Fatal(err)
+			}
+		}
+		replies = append(replies, buf[:n])
+	}
+	if string(replies[0]) != string(replies[1]) {
+		t.Error("A retransmission got another reply")
+	}
+	time.Sleep(100 * time.Millisecond)
+	if len(rhosts) != 2 {
+		t.Errorf("PAM was asked %d times, want once for each source", len(rhosts))
+	}
+}
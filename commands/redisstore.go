@@ -0,0 +1,90 @@
+package commands
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// redisPrefix namespaces nonstick's keys, so the Redis server may be
+// shared.
+const redisPrefix = "nonstick:"
+
+// redisStore is a kvStore on a Redis (or Redis protocol compatible)
+// server, which may be shared by many nonstick processes.
+type redisStore struct {
+	client *redis.Client
+}
+
+func newRedisStore(redisURL string) (*redisStore, error) {
+	if redisURL == "" {
+		return nil, errors.New("the redis session store needs --redis_url")
+	}
+	opts, err := redis.ParseURL(redisURL)
+	if err != nil {
+		return nil, err
+	}
+	return &redisStore{client: redis.NewClient(opts)}, nil
+}
+
+func (rs *redisStore) Get(key string) ([]byte, error) {
+	value, err := rs.client.Get(context.Background(), redisPrefix+key).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, errNotFound
+	}
+	return value, err
+}
+
+func (rs *redisStore) Put(key string, value []byte, ttl time.Duration) error {
+	return rs.client.Set(context.Background(), redisPrefix+key, value, ttl).Err()
+}
+
+func (rs *redisStore) Delete(key string) error {
+	return rs.client.Del(context.Background(), redisPrefix+key).Err()
+}
+
+func (rs *redisStore) Take(key string) ([]byte, error) {
+	value, err := rs.client.GetDel(context.Background(), redisPrefix+key).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, errNotFound
+	}
+	return value, err
+}
+
+func (rs *redisStore) Scan(prefix string) (map[string][]byte, error) {
+	ctx := context.Background()
+	result := make(map[string][]byte)
+	iter := rs.client.Scan(ctx, 0, redisPrefix+escapeGlob(prefix)+"*", 100).Iterator()
+	for iter.Next(ctx) {
+		value, err := rs.client.Get(ctx, iter.Val()).Bytes()
+		if errors.Is(err, redis.Nil) {
+			// Expired since it was listed.
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		result[strings.TrimPrefix(iter.Val(), redisPrefix)] = value
+	}
+	return result, iter.Err()
+}
+
+// escapeGlob escapes the characters Redis treats specially in a
+// MATCH pattern.
+func escapeGlob(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		if strings.ContainsRune(`*?[]\`, r) {
+			b.WriteRune('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+func (rs *redisStore) Close() error {
+	return rs.client.Close()
+}
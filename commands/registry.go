@@ -0,0 +1,225 @@
+package commands
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/gorilla/securecookie"
+	"github.com/rs/zerolog/log"
+)
+
+// trackedSession is a sign-in to nonstick. The session cookie only
+// refers to it by ID, so it can be listed and revoked, and expires
+// on the server whatever the browser does with the cookie.
+type trackedSession struct {
+	ID       string `json:"id"`
+	Subject  string `json:"subject"`
+	Username string `json:"username"`
+	// Service is the PAM service the subject authenticated with.
+	Service string `json:"service"`
+	// Claims are those collected from PAM at sign-in, for
+	// relying parties the session signs in to later.
+	Claims     map[string]string `json:"claims,omitempty"`
+	RemoteAddr string            `json:"remote_addr,omitempty"`
+	Created    time.Time         `json:"created"`
+	LastSeen   time.Time         `json:"last_seen"`
+}
+
+// registryPrefix prefixes the keys of sessions in the kvStore.
+const registryPrefix = "registry:"
+
+// sessionRegistry holds the sessions of users signed in to
+// nonstick. Sessions expire once unused for longer than the idle
+// timeout, or once older than the lifetime, whichever comes first.
+type sessionRegistry struct {
+	kv       kvStore
+	idle     time.Duration
+	lifetime time.Duration
+}
+
+func newSessionRegistry(kv kvStore, idle, lifetime time.Duration) *sessionRegistry {
+	return &sessionRegistry{
+		kv:       kv,
+		idle:     idle,
+		lifetime: lifetime,
+	}
+}
+
+// put stores the session until it would expire, if unused.
+func (sr *sessionRegistry) put(ts *trackedSession) error {
+	data, err := json.Marshal(ts)
+	if err != nil {
+		return err
+	}
+	ttl := min(sr.idle, time.Until(ts.Created.Add(sr.lifetime)))
+	if ttl <= 0 {
+		return sr.kv.Delete(registryPrefix + ts.ID)
+	}
+	return sr.kv.Put(registryPrefix+ts.ID, data, ttl)
+}
+
+// all returns the sessions that have not expired.
+func (sr *sessionRegistry) all() ([]*trackedSession, error) {
+	values, err := sr.kv.Scan(registryPrefix)
+	if err != nil {
+		return nil, err
+	}
+	var result []*trackedSession
+	for _, data := range values {
+		ts := &trackedSession{}
+		if err := json.Unmarshal(data, ts); err != nil {
+			return nil, err
+		}
+		result = append(result, ts)
+	}
+	return result, nil
+}
+
+// Create records a new session for the subject.
+func (sr *sessionRegistry) Create(subject, username, service string, claims map[string]string, remoteAddr string) (*trackedSession, error) {
+	id := securecookie.GenerateRandomKey(32)
+	if id == nil {
+		return nil, errors.New("could not generate a session ID")
+	}
+	now := time.Now()
+	ts := &trackedSession{
+		ID:         base64.RawURLEncoding.EncodeToString(id),
+		Subject:    subject,
+		Username:   username,
+		Service:    service,
+		Claims:     claims,
+		RemoteAddr: remoteAddr,
+		Created:    now,
+		LastSeen:   now,
+	}
+	if err := sr.put(ts); err != nil {
+		return nil, err
+	}
+	return ts, nil
+}
+
+// Touch returns the session with the ID, and marks it as used, or
+// returns nil if there is no such session, or it has expired.
+func (sr *sessionRegistry) Touch(id string) (*trackedSession, error) {
+	data, err := sr.kv.Get(registryPrefix + id)
+	if errors.Is(err, errNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	ts := &trackedSession{}
+	if err := json.Unmarshal(data, ts); err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	if now.Sub(ts.LastSeen) > sr.idle || now.Sub(ts.Created) > sr.lifetime {
+		return nil, nil
+	}
+	ts.LastSeen = now
+	if err := sr.put(ts); err != nil {
+		return nil, err
+	}
+	return ts, nil
+}
+
+// List returns the sessions that have not expired, oldest first. If
+// username is set, only that user's sessions are returned.
+func (sr *sessionRegistry) List(username string) ([]*trackedSession, error) {
+	all, err := sr.all()
+	if err != nil {
+		return nil, err
+	}
+	result := []*trackedSession{}
+	for _, ts := range all {
+		if username == "" || ts.Username == username {
+			result = append(result, ts)
+		}
+	}
+	slices.SortFunc(result, func(a, b *trackedSession) int {
+		return a.Created.Compare(b.Created)
+	})
+	return result, nil
+}
+
+// Revoke ends the session with the ID, and reports whether there was
+// one.
+func (sr *sessionRegistry) Revoke(id string) (bool, error) {
+	_, err := sr.kv.Take(registryPrefix + id)
+	if errors.Is(err, errNotFound) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// RevokeUser ends all of the user's sessions, and returns how many
+// there were.
+func (sr *sessionRegistry) RevokeUser(username string) (int, error) {
+	all, err := sr.all()
+	if err != nil {
+		return 0, err
+	}
+	revoked := 0
+	for _, ts := range all {
+		if ts.Username != username {
+			continue
+		}
+		if err := sr.kv.Delete(registryPrefix + ts.ID); err != nil {
+			return revoked, err
+		}
+		revoked++
+	}
+	return revoked, nil
+}
+
+// serveList lists the sessions, or only those of the user given by
+// the `user` query parameter, as JSON.
+func (sr *sessionRegistry) serveList(w http.ResponseWriter, r *http.Request) {
+	list, err := sr.List(r.URL.Query().Get("user"))
+	if err != nil {
+		log.Error().Err(err).Msg("Could not list sessions")
+		http.Error(w, "Could not list sessions", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(list)
+}
+
+// serveRevoke revokes the session with the ID in the path.
+func (sr *sessionRegistry) serveRevoke(w http.ResponseWriter, r *http.Request) {
+	ok, err := sr.Revoke(r.PathValue("id"))
+	if err != nil {
+		log.Error().Err(err).Msg("Could not revoke session")
+		http.Error(w, "Could not revoke session", http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		http.Error(w, "No such session", http.StatusNotFound)
+		return
+	}
+	log.Info().Msg("Revoked a session")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// serveRevokeUser revokes all sessions of the user given by the
+// `user` query parameter.
+func (sr *sessionRegistry) serveRevokeUser(w http.ResponseWriter, r *http.Request) {
+	username := r.URL.Query().Get("user")
+	if username == "" {
+		http.Error(w, "The user query parameter is required", http.StatusBadRequest)
+		return
+	}
+	revoked, err := sr.RevokeUser(username)
+	if err != nil {
+		log.Error().Err(err).Msgf("Could not revoke the sessions of %q", username)
+		http.Error(w, "Could not revoke sessions", http.StatusInternalServerError)
+		return
+	}
+	log.Info().Msgf("Revoked %d sessions of %q", revoked, username)
+	w.WriteHeader(http.StatusNoContent)
+}
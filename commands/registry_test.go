@@ -0,0 +1,146 @@
+package commands
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+)
+
+// storedExpiry returns when the value of the key in the memStore
+// expires.
+func storedExpiry(t *testing.T, m *memStore, key string) time.Time {
+	t.Helper()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	data, ok := m.values[key]
+	if !ok || len(data) < 8 {
+		t.Fatalf("No value stored for %q", key)
+	}
+	return time.Unix(0, int64(binary.BigEndian.Uint64(data)))
+}
+
+func TestRegistryTouch(t *testing.T) {
+	kv := newMemStore()
+	sr := newSessionRegistry(kv, time.Hour, 24*time.Hour)
+	ts, err := sr.Create("1000", "alice", testIdpService, map[string]string{"email": "alice@example.com"}, "192.0.2.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := sr.Touch(ts.ID)
+	if err != nil || got == nil {
+		t.Fatalf("Touch() = %v, %v, want the session", got, err)
+	}
+	if got.Username != "alice" || got.Claims["email"] != "alice@example.com" || got.LastSeen.Before(ts.LastSeen) {
+		t.Errorf("Touch() = %+v, want the session as created, seen again", got)
+	}
+	if got, err := sr.Touch("unknown"); got != nil || err != nil {
+		t.Errorf("Touch(unknown) = %v, %v, want nil", got, err)
+	}
+}
+
+func TestRegistryIdleTimeout(t *testing.T) {
+	kv := newMemStore()
+	sr := newSessionRegistry(kv, time.Hour, 24*time.Hour)
+	ts, err := sr.Create("1000", "alice", testIdpService, nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Using the session keeps it going past the idle timeout.
+	ts.LastSeen = time.Now().Add(-50 * time.Minute)
+	if err := sr.put(ts); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := sr.Touch(ts.ID); got == nil {
+		t.Fatal("Session used within the idle timeout expired")
+	}
+
+	ts.LastSeen = time.Now().Add(-2 * time.Hour)
+	if err := sr.put(ts); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := sr.Touch(ts.ID); got != nil || err != nil {
+		t.Errorf("Touch() = %v, %v once idle, want nil", got, err)
+	}
+}
+
+func TestRegistryLifetime(t *testing.T) {
+	kv := newMemStore()
+	sr := newSessionRegistry(kv, time.Hour, 24*time.Hour)
+	ts, err := sr.Create("1000", "alice", testIdpService, nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Near the end of its lifetime, a session is only kept until
+	// then, however recently it was used.
+	ts.Created = time.Now().Add(-24*time.Hour + time.Minute)
+	if err := sr.put(ts); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := sr.Touch(ts.ID); got == nil {
+		t.Fatal("Session expired before the end of its lifetime")
+	}
+	if expires := storedExpiry(t, kv, registryPrefix+ts.ID); expires.After(ts.Created.Add(24*time.Hour + time.Second)) {
+		t.Errorf("Session is stored until %v, after the end of its lifetime", expires)
+	}
+
+	// Past its lifetime, it is gone, even if stored for longer.
+	ts.Created = time.Now().Add(-25 * time.Hour)
+	if err := sr.put(ts); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := kv.Get(registryPrefix + ts.ID); !errors.Is(err, errNotFound) {
+		t.Errorf("Session past its lifetime is still stored: %v", err)
+	}
+	data, err := json.Marshal(ts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := kv.Put(registryPrefix+ts.ID, data, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := sr.Touch(ts.ID); got != nil || err != nil {
+		t.Errorf("Touch() = %v, %v past the lifetime, want nil", got, err)
+	}
+}
+
+func TestRegistryRevoke(t *testing.T) {
+	sr := newSessionRegistry(newMemStore(), time.Hour, 24*time.Hour)
+	var ids []string
+	for _, username := range []string{"alice", "bob", "alice"} {
+		ts, err := sr.Create("1000", username, testIdpService, nil, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, ts.ID)
+	}
+	if list, err := sr.List("alice"); err != nil || len(list) != 2 || list[0].ID != ids[0] {
+		t.Fatalf("List(alice) = %v, %v, want alice's sessions, oldest first", list, err)
+	}
+
+	if ok, err := sr.Revoke(ids[0]); !ok || err != nil {
+		t.Errorf("Revoke() = %v, %v, want true", ok, err)
+	}
+	if ok, err := sr.Revoke(ids[0]); ok || err != nil {
+		t.Errorf("Revoke() = %v, %v again, want false", ok, err)
+	}
+	if got, _ := sr.Touch(ids[0]); got != nil {
+		t.Error("Revoked session is still signed in")
+	}
+
+	if n, err := sr.RevokeUser("alice"); n != 1 || err != nil {
+		t.Errorf("RevokeUser(alice) = %d, %v, want 1", n, err)
+	}
+	if got, _ := sr.Touch(ids[2]); got != nil {
+		t.Error("Revoked user's session is still signed in")
+	}
+	if got, _ := sr.Touch(ids[1]); got == nil {
+		t.Error("Revoking another user's sessions revoked bob's")
+	}
+	if list, err := sr.List(""); err != nil || len(list) != 1 {
+		t.Errorf("List() = %v, %v, want bob's session", list, err)
+	}
+}
@@ -0,0 +1,272 @@
+package commands
+
+import (
+	"fmt"
+	"html/template"
+	"io/fs"
+	"net/netip"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"slices"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/achernya/nonstick/pamsocket"
+	"github.com/rs/zerolog/log"
+	"github.com/urfave/cli/v2"
+
+	tmpls "github.com/achernya/nonstick/template"
+)
+
+// configPollInterval is how often the configuration file and the
+// templates are checked for changes.
+const configPollInterval = 5 * time.Second
+
+// reloadFlags are the flags of serve that take effect on reload.
+// Changing any other requires a restart.
+var reloadFlags = []string{
+	"templates_dir",
+	"scope",
+	"idp_service",
+	"enroll_service",
+	"ldap_service",
+	"radius_service",
+	"pam_claim",
+	"trusted_proxy",
+	"pam_tty",
+	"pam_xdisplay",
+}
+
+// liveConfig holds the settings of serve that may be reloaded. It is
+// replaced as a whole, so requests see either the old settings or the
+// new ones, never a mix.
+type liveConfig struct {
+	// templatesDir is where the page templates are loaded from,
+	// or empty for the built-in ones.
+	templatesDir string
+	templates    map[string]*template.Template
+	// scopes are the descriptions of scopes on the consent page.
+	scopes map[string]string
+	// idpService is the PAM service users authenticate with to
+	// sign in to relying parties. enrollService, ldapService and
+	// radiusService are those of nonstick's own pages, LDAP binds
+	// and RADIUS Access-Requests.
+	idpService    string
+	enrollService string
+	ldapService   string
+	radiusService string
+	claims        map[string]pamsocket.ClaimSource
+	// trustedProxies, tty and xdisplay determine the PAM_RHOST,
+	// PAM_TTY and PAM_XDISPLAY items of every PAM transaction.
+	trustedProxies []netip.Prefix
+	tty            string
+	xdisplay       string
+}
+
+// flagValues looks up the values of flags, like cli.Context.
+type flagValues interface {
+	String(name string) string
+	StringSlice(name string) []string
+}
+
+// reloadedFlags are the values of flags on reload.
+type reloadedFlags map[string][]string
+
+func (f reloadedFlags) String(name string) string {
+	if values := f[name]; len(values) > 0 {
+		return values[len(values)-1]
+	}
+	return ""
+}
+
+func (f reloadedFlags) StringSlice(name string) []string {
+	return f[name]
+}
+
+// loadLiveConfig checks the reloadable settings, and loads the
+// templates.
+func loadLiveConfig(flags flagValues) (*liveConfig, error) {
+	live := &liveConfig{
+		templatesDir:  flags.String("templates_dir"),
+		idpService:    flags.String("idp_service"),
+		enrollService: flags.String("enroll_service"),
+		ldapService:   flags.String("ldap_service"),
+		radiusService: flags.String("radius_service"),
+		tty:           flags.String("pam_tty"),
+		xdisplay:      flags.String("pam_xdisplay"),
+	}
+	var templates fs.FS = tmpls.Fs
+	if live.templatesDir != "" {
+		templates = os.DirFS(live.templatesDir)
+	}
+	var err error
+	live.templates, err = parseTemplates(templates)
+	if err != nil {
+		return nil, err
+	}
+	live.scopes, err = parseScopes(flags.StringSlice("scope"))
+	if err != nil {
+		return nil, err
+	}
+	live.claims, err = pamsocket.ParseClaims(flags.StringSlice("pam_claim"))
+	if err != nil {
+		return nil, err
+	}
+	live.trustedProxies, err = pamsocket.ParseTrustedProxies(flags.StringSlice("trusted_proxy"))
+	if err != nil {
+		return nil, err
+	}
+	return live, nil
+}
+
+// apply switches the server to the live settings. Conversations
+// already running keep the settings they started with.
+func (s *server) apply(live *liveConfig) {
+	s.live.Store(live)
+	for _, configure := range s.sockets {
+		configure(live)
+	}
+	if flow, ok := s.flow.(*OryHydraFlow); ok {
+		flow.SetScopes(live.scopes)
+		flow.SetClaims(live.claims)
+	}
+}
+
+// reloader reloads the configuration on SIGHUP, or when the
+// configuration file or the templates change.
+type reloader struct {
+	c *cli.Context
+	s *server
+	// applied are the settings taken from the configuration file
+	// when last loaded, by flag name.
+	applied map[string]*configSetting
+}
+
+// flagDefault returns the default value of a string or string slice
+// flag, which all of reloadFlags are.
+func flagDefault(flag cli.Flag) []string {
+	switch f := flag.(type) {
+	case *cli.StringFlag:
+		return []string{f.Value}
+	case *cli.StringSliceFlag:
+		if f.Value != nil {
+			return f.Value.Value()
+		}
+	}
+	return nil
+}
+
+// reload reads the configuration file again, and applies the
+// reloadable settings. Settings given on the command line, or through
+// the environment, still take precedence. If the configuration is not
+// valid, the current one is kept.
+func (rl *reloader) reload() error {
+	var settings map[string]*configSetting
+	if filename := rl.c.String("config"); filename != "" {
+		var err error
+		settings, err = readConfig(filename, rl.c.Command.Flags)
+		if err != nil {
+			return err
+		}
+	}
+	applied := make(map[string]*configSetting)
+	values := make(reloadedFlags)
+	var restart []string
+	for _, flag := range rl.c.Command.Flags {
+		name := flag.Names()[0]
+		reloadable := slices.Contains(reloadFlags, name)
+		if name == "config" || (rl.c.IsSet(name) && rl.applied[name] == nil) {
+			// Given on the command line, or through the
+			// environment.
+			if _, ok := flag.(*cli.StringSliceFlag); ok && reloadable {
+				values[name] = rl.c.StringSlice(name)
+			} else if reloadable {
+				values[name] = []string{rl.c.String(name)}
+			}
+			continue
+		}
+		if settings[name] != nil {
+			applied[name] = settings[name]
+		}
+		switch {
+		case reloadable && settings[name] != nil:
+			values[name] = settings[name].values
+		case reloadable:
+			values[name] = flagDefault(flag)
+		case !slices.Equal(settingValues(rl.applied[name]), settingValues(settings[name])):
+			restart = append(restart, name)
+		}
+	}
+	live, err := loadLiveConfig(values)
+	if err != nil {
+		return err
+	}
+	for _, name := range restart {
+		log.Warn().Msgf("The setting for --%s changed, which only takes effect on restart", name)
+	}
+	rl.s.apply(live)
+	rl.applied = applied
+	log.Info().Msg("Reloaded configuration")
+	return nil
+}
+
+func settingValues(setting *configSetting) []string {
+	if setting == nil {
+		return nil
+	}
+	return setting.values
+}
+
+// fingerprint summarizes the size and modification time of the
+// configuration file and the templates, to notice changes.
+func (rl *reloader) fingerprint() string {
+	var b strings.Builder
+	add := func(path string, info fs.FileInfo) {
+		fmt.Fprintf(&b, "%s %d %d\n", path, info.Size(), info.ModTime().UnixNano())
+	}
+	if filename := rl.c.String("config"); filename != "" {
+		if info, err := os.Stat(filename); err == nil {
+			add(filename, info)
+		}
+	}
+	if dir := rl.s.live.Load().templatesDir; dir != "" {
+		filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return nil
+			}
+			if info, err := d.Info(); err == nil {
+				add(path, info)
+			}
+			return nil
+		})
+	}
+	return b.String()
+}
+
+// run reloads the configuration whenever needed, forever.
+func (rl *reloader) run() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	ticker := time.NewTicker(configPollInterval)
+	defer ticker.Stop()
+	last := rl.fingerprint()
+	for {
+		select {
+		case <-hup:
+			log.Info().Msg("Reloading configuration on SIGHUP")
+		case <-ticker.C:
+			if rl.fingerprint() == last {
+				continue
+			}
+			log.Info().Msg("Reloading configuration, as it changed")
+		}
+		// Taken first, so changes made while reloading are
+		// picked up by the next poll.
+		last = rl.fingerprint()
+		if err := rl.reload(); err != nil {
+			log.Error().Err(err).Msg("Could not reload configuration, keeping the current one")
+		}
+	}
+}
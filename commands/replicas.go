@@ -0,0 +1,56 @@
+package commands
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/url"
+	"time"
+)
+
+// conversationPrefix prefixes the keys of conversation owners in the
+// kvStore.
+const conversationPrefix = "conversation:"
+
+// replicaToken derives the token authenticating requests the replicas
+// pass on to each other from the session secret, which they share.
+func replicaToken(sessionSecret []byte) string {
+	mac := hmac.New(sha256.New, sessionSecret)
+	mac.Write([]byte("nonstick replica"))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// kvDirectory is a pamsocket.Directory in the kvStore shared by the
+// replicas, which records the URL of the replica running each
+// conversation.
+type kvDirectory struct {
+	kv   kvStore
+	self *url.URL
+}
+
+func (d *kvDirectory) Claim(id string, ttl time.Duration) error {
+	return d.kv.Put(conversationPrefix+id, []byte(d.self.String()), ttl)
+}
+
+func (d *kvDirectory) Owner(id string) (*url.URL, error) {
+	data, err := d.kv.Get(conversationPrefix + id)
+	if errors.Is(err, errNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	owner, err := url.Parse(string(data))
+	if err != nil {
+		return nil, err
+	}
+	if *owner == *d.self {
+		return nil, nil
+	}
+	return owner, nil
+}
+
+func (d *kvDirectory) Release(id string) error {
+	return d.kv.Delete(conversationPrefix + id)
+}
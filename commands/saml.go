@@ -0,0 +1,254 @@
+package commands
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	stdlog "log"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/crewjam/saml"
+	"github.com/gorilla/securecookie"
+	"github.com/rs/zerolog/log"
+	dsig "github.com/russellhaering/goxmldsig"
+)
+
+const (
+	// samlSessionLifetime is how long a service provider may
+	// consider the user signed in.
+	samlSessionLifetime = time.Hour
+	// samlReplayName is the name used to authenticate samlReplay
+	// tokens.
+	samlReplayName = "nonstick-saml-replay"
+	// samlReplayAge bounds how long the user may take to sign in
+	// before an AuthnRequest is replayed.
+	samlReplayAge = 15 * time.Minute
+)
+
+// samlReplay records when an AuthnRequest first arrived, so it can
+// be replayed once the user has signed in, even though that may take
+// longer than service providers allow for requests to be delivered.
+type samlReplay struct {
+	Received time.Time
+	// Digest is the SHA-256 digest of the request, binding the
+	// token to it.
+	Digest []byte
+}
+
+// samlServiceProviders are the SAML service providers nonstick
+// serves, keyed by entity ID.
+type samlServiceProviders map[string]*saml.EntityDescriptor
+
+// loadServiceProviders reads service provider metadata files.
+func loadServiceProviders(paths []string) (samlServiceProviders, error) {
+	result := make(samlServiceProviders)
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		sp := &saml.EntityDescriptor{}
+		if err := xml.Unmarshal(data, sp); err != nil {
+			return nil, fmt.Errorf("could not parse SAML metadata in %s: %w", path, err)
+		}
+		if sp.EntityID == "" || len(sp.SPSSODescriptors) == 0 {
+			return nil, fmt.Errorf("%s does not describe a SAML service provider", path)
+		}
+		result[sp.EntityID] = sp
+	}
+	return result, nil
+}
+
+func (sps samlServiceProviders) GetServiceProvider(_ *http.Request, id string) (*saml.EntityDescriptor, error) {
+	sp, ok := sps[id]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	return sp, nil
+}
+
+// samlIdP serves nonstick as a SAML 2.0 identity provider. Users
+// sign in with the IdP's PAM service, into the nonstick session,
+// which then stands in for the login of every service provider.
+type samlIdP struct {
+	s      *server
+	idp    *saml.IdentityProvider
+	replay *securecookie.SecureCookie
+}
+
+// newSamlIdP returns a SAML identity provider served at baseURL,
+// signing assertions with the given certificate and key, for the
+// service providers described by the metadata files in spFiles.
+func newSamlIdP(s *server, baseURL, certFile, keyFile string, spFiles []string, secret []byte) (*samlIdP, error) {
+	base, err := url.Parse(baseURL)
+	if err != nil || base.Scheme == "" || base.Host == "" {
+		return nil, fmt.Errorf("SAML base URL %q is not an absolute URL", baseURL)
+	}
+	pair, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("could not load SAML signing key: %w", err)
+	}
+	cert, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+	signer, ok := pair.PrivateKey.(crypto.Signer)
+	if !ok {
+		return nil, errors.New("SAML signing key cannot sign")
+	}
+	method := dsig.RSASHA256SignatureMethod
+	if _, ok := signer.(*ecdsa.PrivateKey); ok {
+		method = dsig.ECDSASHA256SignatureMethod
+	}
+	sps, err := loadServiceProviders(spFiles)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &samlIdP{
+		s:      s,
+		replay: securecookie.New(secret, nil).MaxAge(int(samlReplayAge.Seconds())),
+	}
+	p.idp = &saml.IdentityProvider{
+		Signer:                  signer,
+		Certificate:             cert,
+		Logger:                  stdlog.New(log.Logger, "", 0),
+		MetadataURL:             *base.JoinPath("/saml/metadata"),
+		SSOURL:                  *base.JoinPath("/saml/sso"),
+		ServiceProviderProvider: sps,
+		SessionProvider:         p,
+		SignatureMethod:         method,
+	}
+	return p, nil
+}
+
+// serveSSO handles AuthnRequests, with either the HTTP-Redirect or
+// the HTTP-POST binding. It is saml.IdentityProvider.ServeSSO, except
+// that requests replayed after signing in are checked, and replayed
+// again if need be, as of when they first arrived.
+func (p *samlIdP) serveSSO(w http.ResponseWriter, r *http.Request) {
+	req, err := saml.NewIdpAuthnRequest(p.idp, r)
+	if err != nil {
+		log.Info().Err(err).Msg("Could not parse SAML request")
+		p.s.respondWithError(w, r, "Malformed SAML request.")
+		return
+	}
+	if token := r.URL.Query().Get("replay"); token != "" {
+		replay := &samlReplay{}
+		digest := sha256.Sum256(req.RequestBuffer)
+		if err := p.replay.Decode(samlReplayName, token, replay); err != nil || !bytes.Equal(replay.Digest, digest[:]) {
+			log.Info().Err(err).Msg("Invalid SAML replay token")
+			p.s.respondWithError(w, r, "Your sign-in has expired, please try again.")
+			return
+		}
+		req.Now = replay.Received
+	}
+	if err := req.Validate(); err != nil {
+		log.Info().Err(err).Msg("Rejected SAML request")
+		p.s.respondWithError(w, r, "Invalid SAML request.")
+		return
+	}
+
+	session := p.GetSession(w, r, req)
+	if session == nil {
+		return
+	}
+	req.Now = saml.TimeNow()
+	if err := (saml.DefaultAssertionMaker{}).MakeAssertion(req, session); err != nil {
+		p.s.internalError(w, r, fmt.Errorf("could not make SAML assertion: %w", err))
+		return
+	}
+	if err := req.WriteResponse(w); err != nil {
+		p.s.internalError(w, r, fmt.Errorf("could not send SAML response: %w", err))
+		return
+	}
+	log.Info().Msgf("Issued SAML assertion for %q to %q", session.NameID, req.ServiceProviderMetadata.EntityID)
+}
+
+// replayURL re-encodes an AuthnRequest, whichever binding it arrived
+// with, as an HTTP-Redirect binding URL on this server, so it can be
+// replayed once the user has signed in.
+func (p *samlIdP) replayURL(req *saml.IdpAuthnRequest) (string, error) {
+	digest := sha256.Sum256(req.RequestBuffer)
+	token, err := p.replay.Encode(samlReplayName, &samlReplay{
+		Received: req.Now,
+		Digest:   digest[:],
+	})
+	if err != nil {
+		return "", err
+	}
+	var compressed bytes.Buffer
+	fw, err := flate.NewWriter(&compressed, flate.BestCompression)
+	if err != nil {
+		return "", err
+	}
+	fw.Write(req.RequestBuffer)
+	if err := fw.Close(); err != nil {
+		return "", err
+	}
+	q := url.Values{}
+	q.Set("SAMLRequest", base64.StdEncoding.EncodeToString(compressed.Bytes()))
+	if req.RelayState != "" {
+		q.Set("RelayState", req.RelayState)
+	}
+	q.Set("replay", token)
+	return "/saml/sso?" + q.Encode(), nil
+}
+
+func randomID() string {
+	return "id-" + hex.EncodeToString(securecookie.GenerateRandomKey(16))
+}
+
+// GetSession implements saml.SessionProvider. If the user is not
+// signed in with the IdP's PAM service, or the request has ForceAuthn
+// and they have not signed in since it arrived, they are sent to do
+// so, and nil is returned.
+func (p *samlIdP) GetSession(w http.ResponseWriter, r *http.Request, req *saml.IdpAuthnRequest) *saml.Session {
+	ts := p.s.idpSession(r)
+	userinfo := sessionUser(ts)
+	force := req.Request.ForceAuthn != nil && *req.Request.ForceAuthn
+	if userinfo == nil || (force && !ts.Created.After(req.Now)) {
+		next, err := p.replayURL(req)
+		if err != nil {
+			p.s.internalError(w, r, err)
+			return nil
+		}
+		login := "/sso/login?next=" + url.QueryEscape(next)
+		if force {
+			login += "&renew=1"
+		}
+		http.Redirect(w, r, login, http.StatusSeeOther)
+		return nil
+	}
+	profile, err := lookupProfile(userinfo.Uid)
+	if err != nil {
+		p.s.internalError(w, r, err)
+		return nil
+	}
+	// The assertion's AuthnInstant is when the user signed in.
+	return &saml.Session{
+		ID:             randomID(),
+		CreateTime:     ts.Created,
+		ExpireTime:     saml.TimeNow().Add(samlSessionLifetime),
+		Index:          randomID(),
+		NameID:         profile.Username,
+		NameIDFormat:   "urn:oasis:names:tc:SAML:1.1:nameid-format:unspecified",
+		UserName:       profile.Username,
+		UserCommonName: profile.Name,
+		UserGivenName:  profile.GivenName,
+		UserSurname:    profile.FamilyName,
+		Groups:         profile.Groups,
+	}
+}
@@ -0,0 +1,278 @@
+package commands
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"encoding/xml"
+	"html"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/crewjam/saml"
+	"github.com/gorilla/securecookie"
+)
+
+// writeKeyPair writes a self-signed certificate and its key into
+// dir, and returns their paths, and the key.
+func writeKeyPair(t *testing.T, dir string) (string, string, *rsa.PrivateKey) {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "idp.example"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile, key
+}
+
+// newTestSamlIdP returns a server with a SAML identity provider, and
+// a service provider it serves.
+func newTestSamlIdP(t *testing.T) (*server, *saml.ServiceProvider) {
+	t.Helper()
+	dir := t.TempDir()
+	certFile, keyFile, _ := writeKeyPair(t, dir)
+	sp := &saml.ServiceProvider{
+		EntityID:    "https://sp.example/saml/metadata",
+		MetadataURL: url.URL{Scheme: "https", Host: "sp.example", Path: "/saml/metadata"},
+		AcsURL:      url.URL{Scheme: "https", Host: "sp.example", Path: "/saml/acs"},
+	}
+	data, err := xml.Marshal(sp.Metadata())
+	if err != nil {
+		t.Fatal(err)
+	}
+	spFile := filepath.Join(dir, "sp.xml")
+	if err := os.WriteFile(spFile, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	s := newTestServer(t)
+	s.saml, err = newSamlIdP(s, "https://idp.example", certFile, keyFile, []string{spFile}, securecookie.GenerateRandomKey(32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sp.IDPMetadata = s.saml.idp.Metadata()
+	return s, sp
+}
+
+// authnRequest returns the path and query of an HTTP-Redirect binding
+// AuthnRequest from the service provider, and its ID.
+func authnRequest(t *testing.T, sp *saml.ServiceProvider) (string, string) {
+	t.Helper()
+	req, err := sp.MakeAuthenticationRequest(sp.GetSSOBindingLocation(saml.HTTPRedirectBinding), saml.HTTPRedirectBinding, saml.HTTPPostBinding)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := req.Redirect("state", sp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u.RequestURI(), req.ID
+}
+
+func serveSSO(s *server, target string, cookie *http.Cookie) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("GET", target, nil)
+	if cookie != nil {
+		r.AddCookie(cookie)
+	}
+	w := httptest.NewRecorder()
+	s.saml.serveSSO(w, r)
+	return w
+}
+
+var samlResponseField = regexp.MustCompile(`name="SAMLResponse" value="([^"]*)"`)
+
+// parseAssertion checks the SAML response the way the service
+// provider does, and returns its assertion.
+func parseAssertion(t *testing.T, sp *saml.ServiceProvider, w *httptest.ResponseRecorder, requestID string) *saml.Assertion {
+	t.Helper()
+	match := samlResponseField.FindStringSubmatch(w.Body.String())
+	if w.Code != http.StatusOK || match == nil {
+		t.Fatalf("got %d with body %s, want a SAML response", w.Code, w.Body)
+	}
+	form := url.Values{"SAMLResponse": {html.UnescapeString(match[1])}}
+	r := httptest.NewRequest("POST", sp.AcsURL.String(), strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.ParseForm()
+	assertion, err := sp.ParseResponse(r, []string{requestID})
+	if err != nil {
+		t.Fatalf("Service provider rejected the response: %v", err.(*saml.InvalidResponseError).PrivateErr)
+	}
+	return assertion
+}
+
+func TestLoadServiceProviders(t *testing.T) {
+	dir := t.TempDir()
+	for name, contents := range map[string]string{
+		"garbage.xml": "not XML",
+		"idp.xml":     `<EntityDescriptor xmlns="urn:oasis:names:tc:SAML:2.0:metadata" entityID="https://idp.example"><IDPSSODescriptor protocolSupportEnumeration="urn:oasis:names:tc:SAML:2.0:protocol"></IDPSSODescriptor></EntityDescriptor>`,
+		"noid.xml":    `<EntityDescriptor xmlns="urn:oasis:names:tc:SAML:2.0:metadata"><SPSSODescriptor protocolSupportEnumeration="urn:oasis:names:tc:SAML:2.0:protocol"></SPSSODescriptor></EntityDescriptor>`,
+	} {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(contents), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := loadServiceProviders([]string{path}); err == nil {
+			t.Errorf("Expected %s to be rejected", name)
+		}
+	}
+	if _, err := loadServiceProviders([]string{filepath.Join(dir, "missing.xml")}); err == nil {
+		t.Error("Expected a missing file to be rejected")
+	}
+}
+
+func TestSamlSSO(t *testing.T) {
+	s, sp := newTestSamlIdP(t)
+	target, requestID := authnRequest(t, sp)
+
+	// The user is sent to sign in first, and back to a replay of
+	// the request.
+	w := serveSSO(s, target, nil)
+	location, err := url.Parse(w.Header().Get("Location"))
+	if w.Code != http.StatusSeeOther || err != nil || location.Path != "/sso/login" {
+		t.Fatalf("got %d to %q, want a redirect to sign in", w.Code, w.Header().Get("Location"))
+	}
+	next := location.Query().Get("next")
+	if !strings.HasPrefix(next, "/saml/sso?") || !strings.Contains(next, "replay=") {
+		t.Fatalf("got next %q, want a replay of the request", next)
+	}
+
+	// Only a session of the IdP's PAM service will do.
+	_, other := signIn(t, s, "other")
+	if w := serveSSO(s, next, other); w.Code != http.StatusSeeOther {
+		t.Errorf("got %d for a session of another service, want a redirect to sign in", w.Code)
+	}
+
+	_, cookie := signIn(t, s, testIdpService)
+	assertion := parseAssertion(t, sp, serveSSO(s, next, cookie), requestID)
+	account := currentAccount(t)
+	if got := assertion.Subject.NameID.Value; got != account.Username {
+		t.Errorf("got NameID %q, want %q", got, account.Username)
+	}
+	uid := ""
+	for _, statement := range assertion.AttributeStatements {
+		for _, attribute := range statement.Attributes {
+			if attribute.FriendlyName == "uid" && len(attribute.Values) > 0 {
+				uid = attribute.Values[0].Value
+			}
+		}
+	}
+	if uid != account.Username {
+		t.Errorf("got uid attribute %q, want %q", uid, account.Username)
+	}
+}
+
+func TestSamlSSOReplay(t *testing.T) {
+	s, sp := newTestSamlIdP(t)
+	_, cookie := signIn(t, s, testIdpService)
+	start := time.Now()
+	t.Cleanup(func() { saml.TimeNow = time.Now })
+	saml.TimeNow = func() time.Time { return start }
+	target, requestID := authnRequest(t, sp)
+	w := serveSSO(s, target, nil)
+	next, _ := url.Parse(w.Header().Get("Location"))
+	replay := next.Query().Get("next")
+
+	// Signing in took longer than the request may take to arrive.
+	saml.TimeNow = func() time.Time { return start.Add(5 * time.Minute) }
+	if w := serveSSO(s, target, cookie); w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "Invalid SAML request") {
+		t.Errorf("got %d with body %s, want the stale request rejected", w.Code, w.Body)
+	}
+	parseAssertion(t, sp, serveSSO(s, replay, cookie), requestID)
+
+	// The replay token only goes with its own request.
+	other, _ := authnRequest(t, sp)
+	query, _ := url.ParseQuery(strings.SplitN(replay, "?", 2)[1])
+	if w := serveSSO(s, other+"&replay="+url.QueryEscape(query.Get("replay")), cookie); w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "expired") {
+		t.Errorf("got %d with body %s, want the replay token rejected", w.Code, w.Body)
+	}
+}
+
+func TestSamlSSOInvalid(t *testing.T) {
+	s, sp := newTestSamlIdP(t)
+	_, cookie := signIn(t, s, testIdpService)
+
+	if w := serveSSO(s, "/saml/sso?SAMLRequest=garbage", cookie); w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "Malformed") {
+		t.Errorf("got %d with body %s, want a malformed request", w.Code, w.Body)
+	}
+
+	unknown := *sp
+	unknown.EntityID = "https://unknown.example/saml/metadata"
+	target, _ := authnRequest(t, &unknown)
+	if w := serveSSO(s, target, cookie); w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "Invalid SAML request") {
+		t.Errorf("got %d with body %s, want an unknown service provider rejected", w.Code, w.Body)
+	}
+
+	elsewhere := *sp
+	elsewhere.AcsURL = url.URL{Scheme: "https", Host: "evil.example", Path: "/saml/acs"}
+	target, _ = authnRequest(t, &elsewhere)
+	if w := serveSSO(s, target, cookie); w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "Invalid SAML request") {
+		t.Errorf("got %d with body %s, want an assertion consumer service not in the metadata rejected", w.Code, w.Body)
+	}
+}
+
+func TestSamlForceAuthn(t *testing.T) {
+	s, sp := newTestSamlIdP(t)
+	ts, cookie := signIn(t, s, testIdpService)
+	ts.Created = time.Now().Add(-10 * time.Minute)
+	if err := s.registry.put(ts); err != nil {
+		t.Fatal(err)
+	}
+
+	// Without ForceAuthn, the session stands in for the sign-in,
+	// which is when the assertion says the user authenticated.
+	target, requestID := authnRequest(t, sp)
+	assertion := parseAssertion(t, sp, serveSSO(s, target, cookie), requestID)
+	if len(assertion.AuthnStatements) != 1 || !assertion.AuthnStatements[0].AuthnInstant.Round(time.Second).Equal(ts.Created.Round(time.Second)) {
+		t.Errorf("got AuthnStatements %+v, want the AuthnInstant %v", assertion.AuthnStatements, ts.Created)
+	}
+
+	// With it, the user must sign in again.
+	req, err := sp.MakeAuthenticationRequest(sp.GetSSOBindingLocation(saml.HTTPRedirectBinding), saml.HTTPRedirectBinding, saml.HTTPPostBinding)
+	if err != nil {
+		t.Fatal(err)
+	}
+	force := true
+	req.ForceAuthn = &force
+	u, err := req.Redirect("state", sp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := serveSSO(s, u.RequestURI(), cookie)
+	location, err := url.Parse(w.Header().Get("Location"))
+	if w.Code != http.StatusSeeOther || err != nil || location.Path != "/sso/login" || location.Query().Get("renew") != "1" {
+		t.Fatalf("got %d to %q, want a redirect to sign in again", w.Code, w.Header().Get("Location"))
+	}
+	next := location.Query().Get("next")
+	if w := serveSSO(s, next, cookie); w.Code != http.StatusSeeOther {
+		t.Errorf("got %d for the old session, want a redirect to sign in again", w.Code)
+	}
+	_, cookie = signIn(t, s, testIdpService)
+	parseAssertion(t, sp, serveSSO(s, next, cookie), req.ID)
+}
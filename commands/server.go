@@ -1,19 +1,28 @@
 package commands
 
 import (
+	"crypto/subtle"
+	"crypto/tls"
+	"errors"
+	"expvar"
 	"fmt"
 	"html/template"
 	"io/fs"
+	stdlog "log"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync/atomic"
 
 	"github.com/achernya/nonstick/frontend"
 	"github.com/achernya/nonstick/pamsocket"
+	"github.com/go-webauthn/webauthn/webauthn"
 	"github.com/gorilla/csrf"
 	"github.com/gorilla/mux"
+	"github.com/gorilla/securecookie"
 	"github.com/gorilla/sessions"
 	"github.com/joho/godotenv"
 	"github.com/markbates/goth"
@@ -22,37 +31,118 @@ import (
 	"github.com/rs/zerolog/log"
 	"github.com/urfave/cli/v2"
 
-	tmpls "github.com/achernya/nonstick/template"
 	vueglue "github.com/torenware/vite-go"
+	"layeh.com/radius"
 )
 
-func outboundIP() net.IP {
-	conn, err := net.Dial("udp", "8.8.8.8:80")
+// localIP returns an address of this host on a local interface,
+// preferring IPv4, or else the loopback address. No connection is
+// made, so this works on isolated hosts.
+func localIP() net.IP {
+	addrs, err := net.InterfaceAddrs()
 	if err != nil {
-		log.Fatal().Err(err).Msg("Could not connect to well-known IP, do you have network?")
+		log.Error().Err(err).Msg("Could not list the addresses of local interfaces")
 	}
-	defer conn.Close()
-
-	localAddr := conn.LocalAddr().(*net.UDPAddr)
+	var result net.IP
+	for _, addr := range addrs {
+		ipnet, ok := addr.(*net.IPNet)
+		if !ok || !ipnet.IP.IsGlobalUnicast() {
+			continue
+		}
+		if ipnet.IP.To4() != nil {
+			return ipnet.IP
+		}
+		if result == nil {
+			result = ipnet.IP
+		}
+	}
+	if result == nil {
+		result = net.IPv4(127, 0, 0, 1)
+	}
+	return result
+}
 
-	return localAddr.IP
+// publicURL parses the URL users reach nonstick at, given as raw. If
+// raw is empty, an address of a local interface stands in for it.
+func publicURL(raw, port string, tls bool) (*url.URL, error) {
+	if raw == "" {
+		result := &url.URL{Scheme: "http", Host: net.JoinHostPort(localIP().String(), port)}
+		if tls {
+			result.Scheme = "https"
+		}
+		log.Info().Msgf("No --public_url given, so using %s", result)
+		return result, nil
+	}
+	result, err := url.Parse(raw)
+	if err != nil || (result.Scheme != "http" && result.Scheme != "https") || result.Host == "" || result.RawQuery != "" || result.Fragment != "" {
+		return nil, fmt.Errorf("--public_url %q is not an absolute http(s) URL", raw)
+	}
+	result.Path = strings.TrimSuffix(result.Path, "/")
+	return result, nil
 }
 
 type server struct {
-	port      string
+	port string
+	// publicURL is the URL users reach nonstick at.
+	publicURL *url.URL
 	config    *vueglue.ViteConfig
 	glue      *vueglue.VueGlue
-	templates map[string]*template.Template
 	router    *mux.Router
 	flow      pamsocket.LoginFlow
+	// idpFlow is flow, also recording the sign-in in the
+	// registry, and signing in with an existing session.
+	idpFlow  pamsocket.LoginFlow
+	webauthn *pamsocket.WebAuthn
+	// live holds the settings that may be reloaded, including the
+	// page templates.
+	live atomic.Pointer[liveConfig]
+	// sockets configure each PamSocket for new live settings.
+	sockets []func(*liveConfig)
+	// authenticator runs PAM transactions, if not in this
+	// process.
+	authenticator pamsocket.Authenticator
+	// enroller writes one-time code enrollments, through the PAM
+	// helper if there is one.
+	enroller pamsocket.Enroller
+	// state holds what the replicas share besides sessions: the
+	// one-time code secrets of enrollments not yet confirmed, and
+	// the handoff tokens not yet redeemed.
+	state kvStore
+	// oidcClientID, oidcClientSecret and oidcDiscoveryURL
+	// configure the OpenID Connect test app.
+	oidcClientID     string
+	oidcClientSecret string
+	oidcDiscoveryURL string
+	// directory records which replica runs each conversation, if
+	// there are several, and replicaToken authenticates the
+	// requests they pass on to each other.
+	directory    pamsocket.Directory
+	replicaToken string
+	// sessions holds the session cookie for pages served by
+	// nonstick itself, such as enrollment.
+	sessions sessions.Store
+	// registry holds the sessions the session cookie refers to.
+	registry *sessionRegistry
+	// handoff authenticates tokens passed from the websocket to
+	// /session/complete.
+	handoff *securecookie.SecureCookie
+	// forwardAuth answers reverse proxies, if enabled.
+	forwardAuth *forwardAuth
+	// saml is the SAML identity provider, if enabled.
+	saml *samlIdP
+	// cas is the CAS server, if enabled.
+	cas *casServer
 }
 
-func makeServer(port string, env string) (*server, error) {
+// makeServer returns a server for the environment, reached at
+// public, with the live settings.
+func makeServer(port string, env string, public *url.URL, live *liveConfig) (*server, error) {
 	result := &server{
 		port:      port,
+		publicURL: public,
 		router:    mux.NewRouter(),
-		templates: make(map[string]*template.Template),
 	}
+	result.live.Store(live)
 	// Common initialization to serve Vite/Vue.
 	switch env {
 	case "dev":
@@ -61,7 +151,7 @@ func makeServer(port string, env string) (*server, error) {
 			AssetsPath:      "src/assets",
 			EntryPoint:      "src/main.js",
 			FS:              os.DirFS("frontend"),
-			DevServerDomain: outboundIP().String(),
+			DevServerDomain: public.Hostname(),
 		}
 	case "prod":
 		result.config = &vueglue.ViteConfig{
@@ -78,34 +168,99 @@ func makeServer(port string, env string) (*server, error) {
 	if err != nil {
 		return nil, err
 	}
+	return result, nil
+}
 
-	// Parse all of the templates and make sure they're ready to go.
-	matches, err := fs.Glob(tmpls.Fs, "pages/*")
+// adminHandler guards the operational endpoints of h, served on
+// addr, which can list and revoke anybody's sessions. With a token,
+// every request must carry it as a bearer token; without one, only
+// local processes may reach them, so addr must be a loopback address.
+func adminHandler(addr, token string, h http.Handler) (http.Handler, error) {
+	if token == "" {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid --admin_addr %q: %w", addr, err)
+		}
+		if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+			return nil, fmt.Errorf("--admin_addr %q is not a loopback address; set --admin_token to serve it elsewhere", addr)
+		}
+		return h, nil
+	}
+	want := []byte("Bearer " + token)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), want) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, r)
+	}), nil
+}
+
+// parseTemplates parses all of the page templates, so they're ready
+// to go.
+func parseTemplates(templates fs.FS) (map[string]*template.Template, error) {
+	result := make(map[string]*template.Template)
+	matches, err := fs.Glob(templates, "pages/*")
 	if err != nil {
 		return nil, err
 	}
 	for _, match := range matches {
 		filename := filepath.Base(match)
 		page := strings.TrimSuffix(filename, filepath.Ext(filename))
-		t, err := template.New("").ParseFS(tmpls.Fs, "includes/*.tmpl", match)
+		t, err := template.New("").ParseFS(templates, "includes/*.tmpl", match)
 		if err != nil {
 			return nil, err
 		}
 
-		result.templates[page] = t
+		result[page] = t
 	}
-
 	return result, nil
 }
 
+// pamSocket returns a PamSocket for the login flow, with the settings
+// shared by every PAM transaction, and the PAM service service picks.
+// These follow reloads of the live settings.
+func (s *server) pamSocket(service func(*liveConfig) string, flow pamsocket.LoginFlow) *pamsocket.PamSocket {
+	socket := &pamsocket.PamSocket{
+		ConfDir:       "pam.d/",
+		Authenticator: s.authenticator,
+		Flow:          flow,
+		WebAuthn:      s.webauthn,
+		Directory:     s.directory,
+		ReplicaToken:  s.replicaToken,
+	}
+	configure := func(live *liveConfig) {
+		socket.Reconfigure(func(p *pamsocket.PamSocket) {
+			p.Service = service(live)
+			p.Claims = live.claims
+			p.TrustedProxies = live.trustedProxies
+			p.TTY = live.tty
+			p.XDisplay = live.xdisplay
+		})
+	}
+	configure(s.live.Load())
+	s.sockets = append(s.sockets, configure)
+	return socket
+}
+
 func (s *server) registerUrls(csrfSecret []byte) error {
-	// Enable CSRF protection, for any POST requests.
-	csrfOptions := []csrf.Option{}
-	if s.glue.Environment == "development" {
-		csrfOptions = append(csrfOptions, csrf.Secure(false))
+	// Enable CSRF protection, for any POST requests. Its cookie is
+	// marked Secure in production, or if the client uses HTTPS,
+	// even if a reverse proxy passes requests on over HTTP.
+	secureCsrf := csrf.Protect(csrfSecret)
+	plainCsrf := csrf.Protect(csrfSecret, csrf.Secure(false))
+	csrfMiddleware := func(next http.Handler) http.Handler {
+		secure, plain := secureCsrf(next), plainCsrf(next)
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if s.glue.Environment != "development" || pamsocket.ClientOf(r).Proto == "https" {
+				secure.ServeHTTP(w, r)
+			} else {
+				plain.ServeHTTP(w, r)
+			}
+		})
 	}
-	csrfMiddleware := csrf.Protect(csrfSecret, csrfOptions...)
-	s.router.Use(csrfMiddleware)
+	s.router.Use(s.identifyClient, s.recoverPanics, skipCsrf, csrfMiddleware)
 
 	// Set up a file server for our assets.
 	fsHandler, err := s.glue.FileServer()
@@ -120,17 +275,84 @@ func (s *server) registerUrls(csrfSecret []byte) error {
 	s.router.HandleFunc("/consent", s.getConsent).Methods("GET")
 	s.router.HandleFunc("/consent", s.postConsent).Methods("POST")
 
-	// pamsocket itself
-	s.router.Handle("/api/pamws", &pamsocket.PamSocket{
-		Service: "google-authenticator",
-		ConfDir: "pam.d/",
-		Flow:    s.flow,
-	}).Methods("GET")
+	// OAuth2 device authorization grant. Once the user code is
+	// accepted, the device is signed in with the login and consent
+	// handlers above.
+	if _, ok := s.flow.(deviceFlow); ok {
+		s.router.HandleFunc("/device", s.getDevice).Methods("GET")
+		s.router.HandleFunc("/device", s.postDevice).Methods("POST")
+		s.router.HandleFunc("/device/done", s.deviceDone).Methods("GET")
+	}
+
+	// pamsocket itself, and its fallback for clients that cannot
+	// use WebSockets. Both share the same conversations.
+	s.idpFlow = &sessionFlow{LoginFlow: s.flow, s: s}
+	idpSocket := s.pamSocket(func(live *liveConfig) string { return live.idpService }, s.idpFlow)
+	s.router.Handle("/api/pamws", idpSocket).Methods("GET")
+	s.router.Handle("/api/pamevents", &pamsocket.EventSource{Socket: idpSocket}).Methods("GET", "POST")
+	s.router.PathPrefix(apiPrefix).Handler(http.StripPrefix(apiPrefix, s.api()))
+	idpForm := &formLogin{s: s, socket: idpSocket, key: "form_conversation"}
+	s.router.HandleFunc("/login/form", idpForm.get).Methods("GET")
+	s.router.HandleFunc("/login/form", idpForm.post).Methods("POST")
+
+	// Sign-in for nonstick's own pages, which uses a separate PAM
+	// service, since users may not have set up all of the factors
+	// the IdP itself requires.
+	s.router.HandleFunc("/session/login", s.sessionLogin).Methods("GET")
+	s.router.HandleFunc("/session/complete", s.sessionComplete).Methods("GET")
+	localSocket := s.pamSocket(func(live *liveConfig) string { return live.enrollService }, &localFlow{
+		s:       s,
+		service: func() string { return s.live.Load().enrollService },
+	})
+	s.router.Handle("/api/pamws/local", localSocket).Methods("GET")
+	s.router.Handle("/api/pamevents/local", &pamsocket.EventSource{Socket: localSocket}).Methods("GET", "POST")
+	localForm := &formLogin{s: s, socket: localSocket, key: "form_conversation_local"}
+	s.router.HandleFunc("/session/login/form", localForm.get).Methods("GET")
+	s.router.HandleFunc("/session/login/form", localForm.post).Methods("POST")
+
+	// Sign-in with the IdP's PAM service, into the nonstick session,
+	// which then stands in for the IdP login of protocols other than
+	// OIDC.
+	s.router.HandleFunc("/sso/login", s.ssoLogin).Methods("GET")
+	ssoSocket := s.pamSocket(func(live *liveConfig) string { return live.idpService }, &localFlow{
+		s:       s,
+		service: s.idpService,
+	})
+	s.router.Handle("/api/pamws/sso", ssoSocket).Methods("GET")
+	s.router.Handle("/api/pamevents/sso", &pamsocket.EventSource{Socket: ssoSocket}).Methods("GET", "POST")
+	ssoForm := &formLogin{s: s, socket: ssoSocket, key: "form_conversation_sso"}
+	s.router.HandleFunc("/sso/login/form", ssoForm.get).Methods("GET")
+	s.router.HandleFunc("/sso/login/form", ssoForm.post).Methods("POST")
+
+	// SAML 2.0 identity provider.
+	if s.saml != nil {
+		s.router.HandleFunc("/saml/metadata", s.saml.idp.ServeMetadata).Methods("GET")
+		s.router.HandleFunc("/saml/sso", s.saml.serveSSO).Methods("GET", "POST")
+	}
+
+	// Forward authentication for reverse proxies. This must come
+	// before the OIDC test app's /auth/{provider}.
+	if s.forwardAuth != nil {
+		s.router.HandleFunc("/auth/verify", s.forwardAuth.verify)
+		s.router.HandleFunc("/auth/signin", s.forwardAuth.signIn).Methods("GET")
+	}
+
+	// CAS server.
+	if s.cas != nil {
+		s.router.HandleFunc("/cas/login", s.cas.login).Methods("GET")
+		s.router.HandleFunc("/cas/logout", s.cas.logout).Methods("GET")
+		s.router.HandleFunc("/cas/serviceValidate", s.cas.serviceValidate).Methods("GET")
+		s.router.HandleFunc("/cas/p3/serviceValidate", s.cas.p3ServiceValidate).Methods("GET")
+	}
+
+	// Self-service enrollment
+	s.router.HandleFunc("/enroll/totp", s.getEnrollTotp).Methods("GET")
+	s.router.HandleFunc("/enroll/totp", s.postEnrollTotp).Methods("POST")
 
 	// User management app (primarily a testing app for OIDC)
 	if s.flow.SupportsOidc() {
-		openidConnect, err := openidConnect.New(os.Getenv("OPENID_CONNECT_KEY"), os.Getenv("OPENID_CONNECT_SECRET"),
-			"http://"+outboundIP().String()+":"+s.port+"/auth/openid-connect/callback", os.Getenv("OPENID_CONNECT_DISCOVERY_URL"), "profile")
+		openidConnect, err := openidConnect.New(s.oidcClientID, s.oidcClientSecret,
+			s.absoluteURL("/auth/openid-connect/callback"), s.oidcDiscoveryURL, "profile")
 		if err != nil {
 			return err
 		}
@@ -149,8 +371,7 @@ func (s *server) registerUrls(csrfSecret []byte) error {
 
 	// Pretty 404 pages
 	s.router.NotFoundHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.WriteHeader(http.StatusNotFound)
-		s.renderTemplate("error", map[string]interface{}{
+		s.renderStatus(http.StatusNotFound, "error", map[string]interface{}{
 			"Message": "404 Not found",
 		}, w)
 	})
@@ -158,26 +379,66 @@ func (s *server) registerUrls(csrfSecret []byte) error {
 	return nil
 }
 
+// identifyClient records the client of each request in its context,
+// as trusted proxies (including the other replicas) describe it, for
+// the handlers after it.
+func (s *server) identifyClient(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		trusted := pamsocket.ReplicaTrust(r, s.replicaToken, s.live.Load().trustedProxies)
+		client := pamsocket.ParseClient(r, trusted)
+		next.ServeHTTP(w, r.WithContext(pamsocket.WithClient(r.Context(), client)))
+	})
+}
+
+// apiPrefix is where the REST API for headless clients is served.
+const apiPrefix = "/api/v1/conversations"
+
+// api returns the REST API, which signs in to the IdP without a
+// nonstick session: headless clients have no cookies to keep one in,
+// and since the API is exempt from CSRF protection, a session cookie
+// the browser sends along must not stand in for the sign-in. Its
+// conversations are its own, apart from the browsers' ones.
+func (s *server) api() http.Handler {
+	socket := s.pamSocket(func(live *liveConfig) string { return live.idpService }, s.flow)
+	return &pamsocket.API{Socket: socket}
+}
+
+// skipCsrf exempts some endpoints from CSRF protection. The REST API
+// ignores cookies, so there is nothing to forge, and its clients
+// have no page to get a token from. SAML's HTTP-POST binding is posted
+// by service providers' pages, and carries its own proof of origin.
+// Forward auth only reads the session, whatever the method of the
+// request the proxy asks about.
+func skipCsrf(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == apiPrefix || strings.HasPrefix(r.URL.Path, apiPrefix+"/") || r.URL.Path == "/saml/sso" || r.URL.Path == "/auth/verify" {
+			r = csrf.UnsafeSkipCheck(r)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// absoluteURL returns the URL of path on this server, as users reach
+// it.
+func (s *server) absoluteURL(path string) string {
+	return s.publicURL.JoinPath(path).String()
+}
+
 func (s *server) renderTemplate(page string, tmplArgs map[string]interface{}, w http.ResponseWriter) {
-	t, ok := s.templates[page]
-	if !ok {
-		log.Fatal().Msgf("Could not find page %q", page)
-	}
-	if tmplArgs == nil {
-		tmplArgs = make(map[string]interface{})
-	}
-	tmplArgs["vue"] = s.glue
-	if err := t.ExecuteTemplate(w, "page", tmplArgs); err != nil {
-		log.Fatal().Err(err).Msgf("Could not execute template %q", page)
-	}
+	s.renderStatus(http.StatusOK, page, tmplArgs, w)
 }
 
 func (s *server) idpLogin(w http.ResponseWriter, r *http.Request) {
-	redirect, _ := s.flow.PreLogin(r)
-	if redirect != "" {
-		http.Redirect(w, r, redirect, http.StatusTemporaryRedirect)
+	info, err := s.idpFlow.PreLogin(r)
+	if err == nil && info.Redirect != "" {
+		http.Redirect(w, r, info.Redirect, http.StatusTemporaryRedirect)
+		return
 	}
-	s.renderTemplate("login", nil, w)
+	s.bindBrowser(w, r)
+	s.renderTemplate("login", map[string]interface{}{
+		"CsrfToken": csrf.Token(r),
+		"FormPath":  formPath("/login/form", r),
+	}, w)
 }
 
 func (s *server) renderUserInfo(w http.ResponseWriter, r *http.Request, user goth.User) {
@@ -187,8 +448,7 @@ func (s *server) renderUserInfo(w http.ResponseWriter, r *http.Request, user got
 }
 
 func (s *server) respondWithError(w http.ResponseWriter, r *http.Request, message string) {
-	w.WriteHeader(http.StatusBadRequest)
-	s.renderTemplate("error", map[string]interface{}{
+	s.renderStatus(http.StatusBadRequest, "error", map[string]interface{}{
 		"Message": message,
 	}, w)
 }
@@ -253,29 +513,235 @@ func serve(c *cli.Context) error {
 		}
 	}
 
+	// Settings from the environment and the configuration file
+	// are only applied now, so they include any set by dotenv.
+	applied, err := loadConfig(c)
+	if err != nil {
+		return err
+	}
+	if !c.IsSet("port") {
+		return errors.New("the port to serve on must be set, with --port or listen.port")
+	}
+	if c.String("csrf_secret") == "" {
+		return errors.New("the CSRF secret must be set, with --csrf_secret or secrets.csrf")
+	}
+	// Without it, sessions and handoff tokens cannot be signed, so
+	// no one could sign in.
+	if c.String("session_secret") == "" {
+		return errors.New("the session secret must be set, with --session_secret, SESSION_SECRET or secrets.session")
+	}
+
 	// Avoid an error being printed by gothic if SESSION_SECRET
 	// was set by dotenv, which will run after gothic's init().
-	store := sessions.NewCookieStore([]byte(os.Getenv("SESSION_SECRET")))
+	sessionSecret := []byte(c.String("session_secret"))
+	state, err := openStore(c.String("session_store"), c.String("session_path"), c.String("redis_url"))
+	if err != nil {
+		return err
+	}
+	defer state.Close()
+
+	live, err := loadLiveConfig(c)
+	if err != nil {
+		return err
+	}
+	public, err := publicURL(c.String("public_url"), c.String("port"), c.String("tls_cert") != "")
+	if err != nil {
+		return err
+	}
+	var store sessions.Store
+	if c.String("session_store") == "cookie" {
+		cookies := sessions.NewCookieStore(sessionSecret)
+		cookies.Options = cookieOptions(public.Scheme == "https")
+		store = cookies
+	} else {
+		kv := newKVSessionStore(state, sessionSecret)
+		kv.Options = cookieOptions(public.Scheme == "https")
+		store = kv
+	}
 	gothic.Store = store
 
-	server, err := makeServer(c.String("port"), c.String("env"))
+	server, err := makeServer(c.String("port"), c.String("env"), public, live)
 	if err != nil {
 		return err
 	}
+	server.oidcClientID = c.String("oidc_client_id")
+	server.oidcClientSecret = c.String("oidc_client_secret")
+	server.oidcDiscoveryURL = c.String("oidc_discovery_url")
+	server.sessions = store
+	server.state = state
+	server.registry = newSessionRegistry(state, c.Duration("session_idle_timeout"), c.Duration("session_lifetime"))
+	server.handoff = securecookie.New(sessionSecret, nil).MaxAge(int(handoffLifetime.Seconds()))
+	if replicaURL := c.String("replica_url"); replicaURL != "" {
+		kind := c.String("session_store")
+		if kind != "file" && kind != "redis" {
+			return fmt.Errorf("--replica_url needs a --session_store shared by the replicas (file or redis), not %q", kind)
+		}
+		self, err := url.Parse(replicaURL)
+		if err != nil || (self.Scheme != "http" && self.Scheme != "https") || self.Host == "" {
+			return fmt.Errorf("--replica_url %q is not an absolute http(s) URL", replicaURL)
+		}
+		server.directory = &kvDirectory{kv: state, self: self}
+		server.replicaToken = replicaToken(sessionSecret)
+	}
 
 	switch flowArg := c.String("login_flow"); flowArg {
 	case "hydra":
-		server.flow = NewOryHydraFlow()
+		flow := NewOryHydraFlow(c.String("hydra_admin_url"), live.scopes)
+		flow.SetClaims(live.claims)
+		flow.remembered = state
+		server.flow = flow
 	case "noop":
 		server.flow = &pamsocket.NoopFlow{}
 	}
 
+	server.enroller = pamsocket.LocalEnroller{}
+	if helper := c.String("pam_helper"); helper != "" {
+		server.authenticator = &pamsocket.HelperAuthenticator{Socket: helper}
+		server.enroller = &pamsocket.HelperEnroller{Socket: helper}
+	} else if workers := c.Int("pam_workers"); workers > 0 {
+		server.authenticator, err = workerPool(workers, "pam.d/")
+		if err != nil {
+			return err
+		}
+	}
+
+	policy, err := pamsocket.ParseWebAuthnPolicy(c.String("webauthn"))
+	if err != nil {
+		return err
+	}
+	if policy != pamsocket.WebAuthnDisabled {
+		rp, err := webauthn.New(&webauthn.Config{
+			RPID:          c.String("webauthn_rpid"),
+			RPDisplayName: "Nonstick IdP",
+			RPOrigins:     c.StringSlice("webauthn_origin"),
+		})
+		if err != nil {
+			return err
+		}
+		server.webauthn = &pamsocket.WebAuthn{
+			Policy:       policy,
+			Enroll:       c.Bool("webauthn_enroll"),
+			RelyingParty: rp,
+			Store: &pamsocket.FileCredentialStore{
+				Dir: c.String("webauthn_dir"),
+			},
+		}
+	}
+
+	// Absolute URLs default to being under --public_url, but not
+	// under an address guessed in its absence, which is unlikely to
+	// be what others should use.
+	samlBaseURL := c.String("saml_base_url")
+	signin := c.String("forward_auth_signin")
+	if c.String("public_url") != "" {
+		if samlBaseURL == "" {
+			samlBaseURL = public.String()
+		}
+		if signin == "" {
+			signin = server.absoluteURL("/auth/signin")
+		}
+	}
+
+	if key := c.String("saml_key"); key != "" {
+		server.saml, err = newSamlIdP(server, samlBaseURL, c.String("saml_cert"), key, c.StringSlice("saml_sp"), sessionSecret)
+		if err != nil {
+			return err
+		}
+	}
+
+	if hosts := c.StringSlice("forward_auth_host"); len(hosts) > 0 {
+		rules, err := parseForwardAuthHosts(hosts)
+		if err != nil {
+			return err
+		}
+		if len(live.trustedProxies) == 0 {
+			log.Warn().Msg("Forward auth only answers proxies listed in --trusted_proxy, and none are")
+		}
+		server.forwardAuth = &forwardAuth{
+			s:       server,
+			rules:   rules,
+			signin:  signin,
+			cookies: securecookie.New(sessionSecret, nil).MaxAge(int(c.Duration("session_lifetime").Seconds())),
+			domain:  c.String("cookie_domain"),
+		}
+	}
+
+	if services := c.StringSlice("cas_service"); len(services) > 0 {
+		server.cas, err = newCasServer(server, services, state)
+		if err != nil {
+			return err
+		}
+	}
+
 	server.registerUrls([]byte(c.String("csrf_secret")))
 
+	if addr := c.String("ldap_addr"); addr != "" {
+		ldapServer, err := newLdapServer(server.pamSocket(func(live *liveConfig) string { return live.ldapService }, nil), c.String("ldap_base_dn"), state)
+		if err != nil {
+			return err
+		}
+		var tlsConfig *tls.Config
+		if cert := c.String("ldap_cert"); cert != "" {
+			pair, err := tls.LoadX509KeyPair(cert, c.String("ldap_key"))
+			if err != nil {
+				return fmt.Errorf("could not load LDAP certificate: %w", err)
+			}
+			tlsConfig = &tls.Config{Certificates: []tls.Certificate{pair}}
+		} else if !c.Bool("ldap_insecure") {
+			return errors.New("LDAP binds carry passwords, so --ldap_cert is required, unless --ldap_insecure")
+		} else {
+			log.Warn().Msg("Serving LDAP without TLS, so passwords cross the network in the clear")
+		}
+		go func() {
+			log.Error().Err(ldapServer.Run(addr, tlsConfig)).Msg("LDAP listener failed")
+		}()
+	}
+
+	if addr := c.String("radius_addr"); addr != "" {
+		secret := c.String("radius_secret")
+		if secret == "" {
+			return errors.New("--radius_secret is required with --radius_addr")
+		}
+		radiusServer := &radius.PacketServer{
+			Addr:         addr,
+			Handler:      newRadiusServer(server.pamSocket(func(live *liveConfig) string { return live.radiusService }, nil), state),
+			SecretSource: radius.StaticSecretSource([]byte(secret)),
+			ErrorLog:     stdlog.New(log.Logger, "", 0),
+		}
+		go func() {
+			log.Info().Msgf("Serving RADIUS on %s", addr)
+			log.Error().Err(radiusServer.ListenAndServe()).Msg("RADIUS listener failed")
+		}()
+	}
+
+	if addr := c.String("admin_addr"); addr != "" {
+		// Operational endpoints are served separately, so they
+		// can be kept off the public network.
+		admin := http.NewServeMux()
+		admin.Handle("/debug/vars", expvar.Handler())
+		admin.HandleFunc("GET /sessions", server.registry.serveList)
+		admin.HandleFunc("DELETE /sessions", server.registry.serveRevokeUser)
+		admin.HandleFunc("DELETE /sessions/{id}", server.registry.serveRevoke)
+		handler, err := adminHandler(addr, c.String("admin_token"), admin)
+		if err != nil {
+			return err
+		}
+		go func() {
+			log.Error().Err(http.ListenAndServe(addr, handler)).Msg("Admin listener failed")
+		}()
+	}
+
+	// Every PamSocket exists by now, so all of them follow reloads.
+	reloader := &reloader{c: c, s: server, applied: applied}
+	go reloader.run()
+
 	log.Info().Msgf("Listening on %s", server.port)
 	src := &http.Server{
 		Handler: server.router,
 		Addr:    ":" + server.port,
 	}
+	if cert := c.String("tls_cert"); cert != "" {
+		return src.ListenAndServeTLS(cert, c.String("tls_key"))
+	}
 	return src.ListenAndServe()
 }
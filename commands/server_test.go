@@ -0,0 +1,109 @@
+package commands
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"os/user"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gorilla/securecookie"
+	"github.com/gorilla/sessions"
+)
+
+// testIdpService is the PAM service of the IdP in tests.
+const testIdpService = "google-authenticator"
+
+// newTestServer returns a server with the built-in templates and
+// default settings, reached at https://idp.example, keeping sessions
+// in memory.
+func newTestServer(t *testing.T) *server {
+	t.Helper()
+	live, err := loadLiveConfig(reloadedFlags{"idp_service": {testIdpService}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	public := &url.URL{Scheme: "https", Host: "idp.example"}
+	s, err := makeServer("0", "prod", public, live)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret := securecookie.GenerateRandomKey(32)
+	s.sessions = sessions.NewCookieStore(secret)
+	s.registry = newSessionRegistry(newMemStore(), time.Hour, 24*time.Hour)
+	s.state = newMemStore()
+	s.handoff = securecookie.New(secret, nil).MaxAge(int(handoffLifetime.Seconds()))
+	return s
+}
+
+// currentAccount returns the UNIX account running the tests, which
+// is the one tests sign in as.
+func currentAccount(t *testing.T) *user.User {
+	t.Helper()
+	userinfo, err := user.LookupId(strconv.Itoa(os.Getuid()))
+	if err != nil {
+		t.Skipf("Cannot look up the current user: %v", err)
+	}
+	return userinfo
+}
+
+// signIn records a session of the current account, signed in with
+// the PAM service, and returns its record, and the cookie referring to
+// it.
+func signIn(t *testing.T, s *server, service string) (*trackedSession, *http.Cookie) {
+	t.Helper()
+	userinfo := currentAccount(t)
+	ts, err := s.registry.Create(userinfo.Uid, userinfo.Username, service, nil, "192.0.2.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest("GET", "/", nil)
+	w := httptest.NewRecorder()
+	session, _ := s.sessions.Get(r, sessionName)
+	session.Values["session_id"] = ts.ID
+	if err := session.Save(r, w); err != nil {
+		t.Fatal(err)
+	}
+	return ts, w.Result().Cookies()[0]
+}
+
+func TestAdminHandler(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	for _, addr := range []string{"localhost:9100", "127.0.0.1:9100", "[::1]:9100"} {
+		if _, err := adminHandler(addr, "", ok); err != nil {
+			t.Errorf("adminHandler(%q) without a token: %v", addr, err)
+		}
+	}
+	for _, addr := range []string{":9100", "0.0.0.0:9100", "192.0.2.1:9100", "admin.example:9100", "9100"} {
+		if _, err := adminHandler(addr, "", ok); err == nil {
+			t.Errorf("adminHandler(%q) served without a token", addr)
+		}
+	}
+
+	h, err := adminHandler(":9100", "letmein", ok)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		authorization string
+		want          int
+	}{
+		{"", http.StatusUnauthorized},
+		{"Bearer wrong", http.StatusUnauthorized},
+		{"letmein", http.StatusUnauthorized},
+		{"Bearer letmein", http.StatusOK},
+	} {
+		r := httptest.NewRequest("GET", "/sessions", nil)
+		if tc.authorization != "" {
+			r.Header.Set("Authorization", tc.authorization)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != tc.want {
+			t.Errorf("Authorization %q returned %d, want %d", tc.authorization, w.Code, tc.want)
+		}
+	}
+}
@@ -0,0 +1,392 @@
+package commands
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os/user"
+	"strings"
+	"time"
+
+	"github.com/achernya/nonstick/pamsocket"
+	"github.com/gorilla/csrf"
+	"github.com/gorilla/securecookie"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// sessionName is the name of the cookie holding the session
+	// for pages served by nonstick itself.
+	sessionName = "nonstick"
+	// handoffName is the name used to authenticate handoff
+	// tokens.
+	handoffName = "nonstick-handoff"
+	// handoffPrefix prefixes the nonces of handoff tokens not yet
+	// redeemed in the kvStore.
+	handoffPrefix = "handoff:"
+	// handoffLifetime is how long a handoff token may be redeemed.
+	handoffLifetime = time.Minute
+	// browserCookie is the name of the cookie binding handoff
+	// tokens to the browser that signed in.
+	browserCookie = "nonstick-browser"
+)
+
+// handoffToken carries the result of a PAM conversation from the
+// websocket, which cannot set cookies, to /session/complete, which
+// can.
+type handoffToken struct {
+	Subject string
+	// Service is the PAM service the subject authenticated with.
+	Service string
+	Claims  map[string]string
+	// Next is where to send the user once the session is
+	// recorded. It is checked before the token is issued, so may
+	// point elsewhere (e.g., back to Hydra).
+	Next string
+	// EnrollToken proves to the PAM helper that the subject
+	// authenticated, so they may enroll in one-time codes.
+	EnrollToken string
+	// Nonce is taken from the kvStore when the token is redeemed,
+	// so it is redeemed at most once.
+	Nonce string
+	// Browser is the hash of the browser cookie of the browser
+	// that signed in, which alone may redeem the token, so that
+	// nobody can sign somebody else in to their own account.
+	Browser string
+}
+
+// bindBrowser gives the browser a cookie identifying it, if it has
+// none, before it signs in, so the handoff token can be bound to it.
+// The cookie is also added to r, so the token can be issued while
+// answering r.
+func (s *server) bindBrowser(w http.ResponseWriter, r *http.Request) {
+	if _, err := r.Cookie(browserCookie); err == nil {
+		return
+	}
+	cookie := &http.Cookie{
+		Name:     browserCookie,
+		Value:    base64.RawURLEncoding.EncodeToString(securecookie.GenerateRandomKey(32)),
+		Path:     "/",
+		Secure:   s.glue.Environment != "development" || pamsocket.ClientOf(r).Proto == "https",
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	}
+	http.SetCookie(w, cookie)
+	r.AddCookie(cookie)
+}
+
+// browserOf returns the hash of the browser cookie, or "" if there
+// is none.
+func browserOf(r *http.Request) string {
+	cookie, err := r.Cookie(browserCookie)
+	if err != nil || cookie.Value == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(cookie.Value))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// handoffURL returns the URL of /session/complete, with the token
+// bound to the browser signing in with r, and redeemable once.
+func (s *server) handoffURL(r *http.Request, token *handoffToken) (string, error) {
+	token.Nonce = base64.RawURLEncoding.EncodeToString(securecookie.GenerateRandomKey(16))
+	token.Browser = browserOf(r)
+	if err := s.state.Put(handoffPrefix+token.Nonce, []byte(token.Subject), handoffLifetime); err != nil {
+		return "", fmt.Errorf("could not save handoff token: %w", err)
+	}
+	encoded, err := s.handoff.Encode(handoffName, token)
+	if err != nil {
+		return "", err
+	}
+	return "/session/complete?token=" + url.QueryEscape(encoded), nil
+}
+
+// enrollTokenOf returns the token proving to the PAM helper that the
+// user authenticated, if any.
+func enrollTokenOf(r *http.Request) string {
+	if identity := pamsocket.IdentityOf(r); identity != nil {
+		return identity.EnrollToken
+	}
+	return ""
+}
+
+// localFlow is a LoginFlow for pages served by nonstick itself,
+// rather than on behalf of an OAuth2 client. Once authenticated, the
+// user is sent to /session/complete, which records a session, and
+// refers to it from the nonstick session cookie.
+type localFlow struct {
+	s *server
+	// service returns the PAM service users authenticate with,
+	// which is recorded in the session.
+	service func() string
+}
+
+// safeNext returns next if it is a path on this server, and "/"
+// otherwise, to avoid open redirects.
+func safeNext(next string) string {
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.HasPrefix(next, `/\`) {
+		return "/"
+	}
+	return next
+}
+
+func (*localFlow) PreLogin(*http.Request) (*pamsocket.LoginInfo, error) {
+	return &pamsocket.LoginInfo{}, nil
+}
+
+func (l *localFlow) Authenticated(r *http.Request, subject string, _ map[string]string) (string, error) {
+	return l.s.handoffURL(r, &handoffToken{
+		Subject:     subject,
+		Service:     l.service(),
+		Next:        safeNext(r.URL.Query().Get("next")),
+		EnrollToken: enrollTokenOf(r),
+	})
+}
+
+func (*localFlow) RequestConsent(*http.Request) (*pamsocket.ConsentInfo, error) {
+	return nil, errors.New("consent is not used for nonstick's own pages")
+}
+
+func (*localFlow) AcceptConsent(*http.Request) (string, error) {
+	return "", errors.New("consent is not used for nonstick's own pages")
+}
+
+func (*localFlow) SupportsOidc() bool { return false }
+
+// sessionFlow wraps the IdP's LoginFlow, so that signing in to a
+// relying party also signs the user in to nonstick, with the IdP's
+// PAM service, and an existing such session stands in for the
+// sign-in, unless the relying party asks for a new one.
+type sessionFlow struct {
+	pamsocket.LoginFlow
+	s *server
+}
+
+func (f *sessionFlow) PreLogin(r *http.Request) (*pamsocket.LoginInfo, error) {
+	info, err := f.LoginFlow.PreLogin(r)
+	if err != nil || info.Redirect != "" || info.Reauthenticate {
+		return info, err
+	}
+	ts := f.s.idpSession(r)
+	if ts == nil || (info.MaxAge > 0 && time.Since(ts.Created) > info.MaxAge) {
+		return info, nil
+	}
+	log.Info().Msgf("Signing in %q from %s with their existing session", ts.Username, pamsocket.ClientOf(r).Addr)
+	redirect, err := f.LoginFlow.Authenticated(r, ts.Subject, ts.Claims)
+	if err != nil {
+		return nil, err
+	}
+	return &pamsocket.LoginInfo{Redirect: redirect}, nil
+}
+
+func (f *sessionFlow) Authenticated(r *http.Request, subject string, claims map[string]string) (string, error) {
+	redirect, err := f.LoginFlow.Authenticated(r, subject, claims)
+	if err != nil {
+		return "", err
+	}
+	return f.s.handoffURL(r, &handoffToken{
+		Subject:     subject,
+		Service:     f.s.idpService(),
+		Claims:      claims,
+		Next:        redirect,
+		EnrollToken: enrollTokenOf(r),
+	})
+}
+
+func (s *server) sessionLogin(w http.ResponseWriter, r *http.Request) {
+	s.bindBrowser(w, r)
+	s.renderTemplate("login", map[string]interface{}{
+		"WsPath":     "/api/pamws/local",
+		"EventsPath": "/api/pamevents/local",
+		"CsrfToken":  csrf.Token(r),
+		"FormPath":   formPath("/session/login/form", r),
+	}, w)
+}
+
+// ssoLogin signs the user in with the IdP's PAM service, for
+// protocols (such as SAML) where the nonstick session stands in for
+// the IdP login, and sends them to `next`. With `renew=1`, the user
+// must sign in again even if they already have.
+func (s *server) ssoLogin(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Query().Get("renew") != "1" && s.idpUser(r) != nil {
+		http.Redirect(w, r, safeNext(r.URL.Query().Get("next")), http.StatusSeeOther)
+		return
+	}
+	s.bindBrowser(w, r)
+	s.renderTemplate("login", map[string]interface{}{
+		"WsPath":     "/api/pamws/sso",
+		"EventsPath": "/api/pamevents/sso",
+		"CsrfToken":  csrf.Token(r),
+		"FormPath":   formPath("/sso/login/form", r),
+	}, w)
+}
+
+func (s *server) sessionComplete(w http.ResponseWriter, r *http.Request) {
+	token := &handoffToken{}
+	if err := s.handoff.Decode(handoffName, r.URL.Query().Get("token"), token); err != nil {
+		log.Info().Err(err).Msg("Invalid handoff token")
+		s.respondWithError(w, r, "Your sign-in has expired, please try again.")
+		return
+	}
+	if token.Browser == "" || token.Browser != browserOf(r) {
+		log.Info().Msgf("Refusing handoff token for %q from another browser", token.Subject)
+		s.respondWithError(w, r, "Your sign-in has expired, please try again.")
+		return
+	}
+	if _, err := s.state.Take(handoffPrefix + token.Nonce); errors.Is(err, errNotFound) {
+		log.Info().Msgf("Refusing handoff token for %q, which was already redeemed", token.Subject)
+		s.respondWithError(w, r, "Your sign-in has expired, please try again.")
+		return
+	} else if err != nil {
+		s.internalError(w, r, fmt.Errorf("could not redeem handoff token: %w", err))
+		return
+	}
+	userinfo, err := user.LookupId(token.Subject)
+	if err != nil {
+		s.internalError(w, r, fmt.Errorf("could not look up subject %q: %w", token.Subject, err))
+		return
+	}
+	session, err := s.sessions.Get(r, sessionName)
+	if err != nil {
+		log.Info().Err(err).Msg("Discarding invalid session")
+	}
+	// Signing in again replaces the previous session.
+	if id, ok := session.Values["session_id"].(string); ok {
+		if _, err := s.registry.Revoke(id); err != nil {
+			log.Error().Err(err).Msg("Could not revoke the previous session")
+		}
+	}
+	ts, err := s.registry.Create(token.Subject, userinfo.Username, token.Service, token.Claims, pamsocket.ClientOf(r).Addr)
+	if err != nil {
+		s.internalError(w, r, err)
+		return
+	}
+	if token.EnrollToken != "" {
+		if err := s.state.Put(enrollTokenPrefix+ts.ID, []byte(token.EnrollToken), pamsocket.EnrollTokenLifetime); err != nil {
+			s.internalError(w, r, fmt.Errorf("could not save enrollment token: %w", err))
+			return
+		}
+	}
+	session.Values["session_id"] = ts.ID
+	if err := renewSessionID(session); err != nil {
+		s.internalError(w, r, fmt.Errorf("could not renew session: %w", err))
+		return
+	}
+	if err := session.Save(r, w); err != nil {
+		s.internalError(w, r, fmt.Errorf("could not save session: %w", err))
+		return
+	}
+	next := token.Next
+	if next == "" {
+		next = "/"
+	}
+	http.Redirect(w, r, next, http.StatusSeeOther)
+}
+
+// signOut removes the user from the nonstick session.
+func (s *server) signOut(w http.ResponseWriter, r *http.Request) error {
+	session, err := s.sessions.Get(r, sessionName)
+	if err != nil {
+		log.Info().Err(err).Msg("Discarding invalid session")
+	}
+	if id, ok := session.Values["session_id"].(string); ok {
+		if _, err := s.registry.Revoke(id); err != nil {
+			return fmt.Errorf("could not revoke session: %w", err)
+		}
+	}
+	delete(session.Values, "session_id")
+	if err := renewSessionID(session); err != nil {
+		return fmt.Errorf("could not renew session: %w", err)
+	}
+	if err := session.Save(r, w); err != nil {
+		return fmt.Errorf("could not save session: %w", err)
+	}
+	return nil
+}
+
+// currentSession returns the session of the user signed in to
+// nonstick, or nil if there is none, or it has expired or been
+// revoked.
+func (s *server) currentSession(r *http.Request) *trackedSession {
+	session, err := s.sessions.Get(r, sessionName)
+	if err != nil {
+		return nil
+	}
+	id, ok := session.Values["session_id"].(string)
+	if !ok {
+		return nil
+	}
+	ts, err := s.registry.Touch(id)
+	if err != nil {
+		log.Error().Err(err).Msg("Could not look up session")
+		return nil
+	}
+	return ts
+}
+
+// idpService returns the PAM service users authenticate with to sign
+// in to relying parties.
+func (s *server) idpService() string {
+	return s.live.Load().idpService
+}
+
+// idpSession returns the session of the user signed in to nonstick,
+// but only if they signed in with the IdP's PAM service, so the
+// session may stand in for an IdP login. Otherwise, nil is returned.
+func (s *server) idpSession(r *http.Request) *trackedSession {
+	ts := s.currentSession(r)
+	if ts == nil || ts.Service != s.idpService() {
+		return nil
+	}
+	return ts
+}
+
+// sessionUser returns the UNIX account of the session, or nil if
+// there is none.
+func sessionUser(ts *trackedSession) *user.User {
+	if ts == nil {
+		return nil
+	}
+	userinfo, err := user.LookupId(ts.Subject)
+	if err != nil {
+		log.Error().Err(err).Msgf("Could not look up subject %q", ts.Subject)
+		return nil
+	}
+	return userinfo
+}
+
+// currentUser returns the UNIX account signed in to nonstick's own
+// pages, or nil if there is none.
+func (s *server) currentUser(r *http.Request) *user.User {
+	return sessionUser(s.currentSession(r))
+}
+
+// idpUser returns the UNIX account signed in to nonstick's own
+// pages, but only if they signed in with the IdP's PAM service (see
+// idpSession). Otherwise, nil is returned.
+func (s *server) idpUser(r *http.Request) *user.User {
+	return sessionUser(s.idpSession(r))
+}
+
+// requireSession returns the session signed in to nonstick's own
+// pages, and its UNIX account. If there is none, the request is
+// redirected to sign in, and nils are returned.
+func (s *server) requireSession(w http.ResponseWriter, r *http.Request) (*trackedSession, *user.User) {
+	ts := s.currentSession(r)
+	if userinfo := sessionUser(ts); userinfo != nil {
+		return ts, userinfo
+	}
+	http.Redirect(w, r, "/session/login?next="+url.QueryEscape(r.URL.RequestURI()), http.StatusSeeOther)
+	return nil, nil
+}
+
+// requireUser returns the UNIX account signed in to nonstick's own
+// pages. If there is none, the request is redirected to sign in, and
+// nil is returned.
+func (s *server) requireUser(w http.ResponseWriter, r *http.Request) *user.User {
+	_, userinfo := s.requireSession(w, r)
+	return userinfo
+}
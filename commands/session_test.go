@@ -0,0 +1,212 @@
+package commands
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/achernya/nonstick/pamsocket"
+	"github.com/msteinert/pam/v2"
+)
+
+// newTestSessionFlow returns a server whose IdP flow signs in to a
+// fake Hydra, through a sessionFlow.
+func newTestSessionFlow(t *testing.T) (*server, *sessionFlow, *fakeHydra) {
+	t.Helper()
+	fake := &fakeHydra{}
+	hydra := httptest.NewServer(fake)
+	t.Cleanup(hydra.Close)
+	s := newTestServer(t)
+	flow := NewOryHydraFlow(hydra.URL, defaultScopes)
+	flow.remembered = newMemStore()
+	return s, &sessionFlow{LoginFlow: flow, s: s}, fake
+}
+
+func TestSessionFlowPreLogin(t *testing.T) {
+	s, flow, fake := newTestSessionFlow(t)
+	account := currentAccount(t)
+	ts, cookie := signIn(t, s, testIdpService)
+	_, other := signIn(t, s, "other")
+	ts.Created = time.Now().Add(-10 * time.Minute)
+	if err := s.registry.put(ts); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name     string
+		query    string
+		other    bool
+		signedIn bool
+	}{
+		{"plain", "", false, true},
+		{"other service", "", true, false},
+		{"prompt=login", "?prompt=login", false, false},
+		{"prompt=consent login", "?prompt=consent+login", false, false},
+		{"prompt=consent", "?prompt=consent", false, true},
+		{"max_age=0", "?max_age=0", false, false},
+		{"recent enough", "?max_age=3600", false, true},
+		{"too old", "?max_age=60", false, false},
+		{"invalid max_age", "?max_age=soon", false, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			fake.requestURL = "https://hydra.example/oauth2/auth" + tc.query
+			fake.accepted = nil
+			r := httptest.NewRequest("GET", "/login?login_challenge=challenge", nil)
+			if tc.other {
+				r.AddCookie(other)
+			} else {
+				r.AddCookie(cookie)
+			}
+			info, err := flow.PreLogin(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !tc.signedIn {
+				if info.Redirect != "" || len(fake.accepted) != 0 {
+					t.Errorf("Signed in with the existing session, to %q", info.Redirect)
+				}
+				return
+			}
+			if info.Redirect != "https://hydra.example/next" || len(fake.accepted) != 1 {
+				t.Fatalf("got redirect %q, want the existing session to sign in", info.Redirect)
+			}
+			if subject := fake.accepted[0].Subject; subject != account.Uid {
+				t.Errorf("Signed in as %q, want %q", subject, account.Uid)
+			}
+		})
+	}
+}
+
+func TestSessionFlowAuthenticated(t *testing.T) {
+	s, flow, fake := newTestSessionFlow(t)
+	r := httptest.NewRequest("GET", "/login?login_challenge=challenge", nil)
+	redirect, err := flow.Authenticated(r, "1000", map[string]string{"email": "alice@example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fake.accepted) != 1 {
+		t.Fatal("The login was not accepted")
+	}
+
+	// The user is sent on through /session/complete, to record
+	// the session.
+	u, err := url.Parse(redirect)
+	if err != nil || u.Path != "/session/complete" {
+		t.Fatalf("got redirect %q, want /session/complete", redirect)
+	}
+	token := &handoffToken{}
+	if err := s.handoff.Decode(handoffName, u.Query().Get("token"), token); err != nil {
+		t.Fatal(err)
+	}
+	if token.Subject != "1000" || token.Service != testIdpService || token.Claims["email"] != "alice@example.com" || token.Next != "https://hydra.example/next" {
+		t.Errorf("got handoff token %+v, want the IdP sign-in", token)
+	}
+}
+
+// accountAuthenticator signs the current account in with the
+// password "secret".
+type accountAuthenticator string
+
+func (a accountAuthenticator) Authenticate(req *pamsocket.AuthRequest, conv pam.ConversationHandler) (*pamsocket.AuthResult, error) {
+	password, err := conv.RespondPAM(pam.PromptEchoOff, "Password: ")
+	if err != nil || password != "secret" {
+		return nil, errors.Join(pamsocket.ErrAuthenticationFailed, err)
+	}
+	return &pamsocket.AuthResult{Username: string(a)}, nil
+}
+
+func TestAPIIgnoresSession(t *testing.T) {
+	s, flow, fake := newTestSessionFlow(t)
+	s.flow = flow.LoginFlow
+	s.authenticator = accountAuthenticator(currentAccount(t).Username)
+	_, cookie := signIn(t, s, testIdpService)
+	api := httptest.NewServer(s.identifyClient(s.api()))
+	t.Cleanup(api.Close)
+	post := func(path, body string) map[string]interface{} {
+		t.Helper()
+		r, err := http.NewRequest("POST", api.URL+path, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.AddCookie(cookie)
+		resp, err := http.DefaultClient.Do(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		st := map[string]interface{}{}
+		json.NewDecoder(resp.Body).Decode(&st)
+		return st
+	}
+
+	// The session cookie does not stand in for the sign-in.
+	st := post("/?login_challenge=challenge", "")
+	if st["Status"] != "prompt" || len(fake.accepted) != 0 {
+		t.Fatalf("got %v, want a prompt", st)
+	}
+
+	// Once signed in, the client is sent back to Hydra, not
+	// through the browser's handoff to the session.
+	id, _ := st["ID"].(string)
+	st = post("/"+id+"/answer", `{"Input": "secret"}`)
+	if st["Status"] != "authenticated" || st["Redirect"] != "https://hydra.example/next" || len(fake.accepted) != 1 {
+		t.Errorf("got %v, want a redirect to Hydra", st)
+	}
+}
+
+// handoffRequest returns a request redeeming the handoff token, from
+// the browser it was issued to.
+func handoffRequest(t *testing.T, s *server, token *handoffToken) *http.Request {
+	t.Helper()
+	r := httptest.NewRequest("GET", "/login", nil)
+	s.bindBrowser(httptest.NewRecorder(), r)
+	browser, err := r.Cookie(browserCookie)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := s.handoffURL(r, token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r = httptest.NewRequest("GET", u, nil)
+	r.AddCookie(browser)
+	return r
+}
+
+func TestSessionCompleteHandoff(t *testing.T) {
+	s := newTestServer(t)
+	account := currentAccount(t)
+	complete := func(r *http.Request) int {
+		w := httptest.NewRecorder()
+		s.sessionComplete(w, r)
+		return w.Code
+	}
+
+	// Another browser, or one without the cookie, may not redeem
+	// the token, such as an attacker signing the victim in to
+	// the attacker's account.
+	r := handoffRequest(t, s, &handoffToken{Subject: account.Uid, Service: testIdpService, Next: "/"})
+	other := httptest.NewRequest("GET", r.URL.String(), nil)
+	if code := complete(other); code == http.StatusSeeOther {
+		t.Error("Redeemed the token without the browser cookie")
+	}
+	other.AddCookie(&http.Cookie{Name: browserCookie, Value: "other"})
+	if code := complete(other); code == http.StatusSeeOther {
+		t.Error("Redeemed the token from another browser")
+	}
+
+	// The browser it was issued to may, once.
+	if code := complete(r); code != http.StatusSeeOther {
+		t.Fatalf("got %d, want the token redeemed", code)
+	}
+	replay := httptest.NewRequest("GET", r.URL.String(), nil)
+	replay.AddCookie(r.Cookies()[0])
+	if code := complete(replay); code == http.StatusSeeOther {
+		t.Error("Redeemed the token twice")
+	}
+}
@@ -0,0 +1,124 @@
+package commands
+
+import (
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/securecookie"
+	"github.com/gorilla/sessions"
+)
+
+// sessionKeyPrefix prefixes the keys of sessions in the kvStore.
+const sessionKeyPrefix = "session:"
+
+// kvSessionStore is a sessions.Store keeping the values of sessions in
+// a kvStore, and only their signed ID in the cookie, so they may hold
+// more than fits in a cookie, and are forgotten on the server when
+// they expire.
+type kvSessionStore struct {
+	kv      kvStore
+	codecs  []securecookie.Codec
+	Options *sessions.Options
+}
+
+func newKVSessionStore(kv kvStore, keyPairs ...[]byte) *kvSessionStore {
+	return &kvSessionStore{
+		kv:      kv,
+		codecs:  securecookie.CodecsFromPairs(keyPairs...),
+		Options: cookieOptions(false),
+	}
+}
+
+// cookieOptions returns the options of session cookies, whichever
+// store keeps the sessions. Scripts cannot read them, and other sites
+// cannot have them sent along, except for navigations to nonstick
+// (such as the redirects back from Hydra). With secure, which is set
+// if users reach nonstick over HTTPS, they are only sent over HTTPS.
+func cookieOptions(secure bool) *sessions.Options {
+	return &sessions.Options{
+		Path:     "/",
+		MaxAge:   86400 * 30,
+		Secure:   secure,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	}
+}
+
+func (ks *kvSessionStore) Get(r *http.Request, name string) (*sessions.Session, error) {
+	return sessions.GetRegistry(r).Get(ks, name)
+}
+
+func (ks *kvSessionStore) New(r *http.Request, name string) (*sessions.Session, error) {
+	session := sessions.NewSession(ks, name)
+	opts := *ks.Options
+	session.Options = &opts
+	session.IsNew = true
+	cookie, err := r.Cookie(name)
+	if err != nil {
+		return session, nil
+	}
+	if err := securecookie.DecodeMulti(name, cookie.Value, &session.ID, ks.codecs...); err != nil {
+		return session, err
+	}
+	data, err := ks.kv.Get(sessionKeyPrefix + session.ID)
+	if errors.Is(err, errNotFound) {
+		// The session expired on the server, or never existed;
+		// start over with a new ID, rather than one the client
+		// chose.
+		session.ID = ""
+		return session, nil
+	}
+	if err != nil {
+		return session, err
+	}
+	if err := (securecookie.GobEncoder{}).Deserialize(data, &session.Values); err != nil {
+		return session, err
+	}
+	session.IsNew = false
+	return session, nil
+}
+
+func (ks *kvSessionStore) Save(r *http.Request, w http.ResponseWriter, session *sessions.Session) error {
+	if session.Options.MaxAge <= 0 {
+		if session.ID != "" {
+			if err := ks.kv.Delete(sessionKeyPrefix + session.ID); err != nil {
+				return err
+			}
+		}
+		http.SetCookie(w, sessions.NewCookie(session.Name(), "", session.Options))
+		return nil
+	}
+	if session.ID == "" {
+		session.ID = base64.RawURLEncoding.EncodeToString(securecookie.GenerateRandomKey(32))
+	}
+	data, err := (securecookie.GobEncoder{}).Serialize(session.Values)
+	if err != nil {
+		return err
+	}
+	ttl := time.Duration(session.Options.MaxAge) * time.Second
+	if err := ks.kv.Put(sessionKeyPrefix+session.ID, data, ttl); err != nil {
+		return err
+	}
+	encoded, err := securecookie.EncodeMulti(session.Name(), session.ID, ks.codecs...)
+	if err != nil {
+		return err
+	}
+	http.SetCookie(w, sessions.NewCookie(session.Name(), encoded, session.Options))
+	return nil
+}
+
+// renewSessionID makes the session be saved under a new ID, and
+// forgets it under the old one, so an ID known before the user signed
+// in or out (e.g., planted by an attacker) is of no further use.
+// Sessions kept in cookies have no ID, and are left as they are.
+func renewSessionID(session *sessions.Session) error {
+	if ks, ok := session.Store().(*kvSessionStore); ok && session.ID != "" {
+		if err := ks.kv.Delete(sessionKeyPrefix + session.ID); err != nil {
+			return err
+		}
+	}
+	session.ID = ""
+	return nil
+}
@@ -0,0 +1,137 @@
+package commands
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/securecookie"
+)
+
+// saveSession saves a session with the value, returning its cookie.
+func saveSession(t *testing.T, ks *kvSessionStore, cookie *http.Cookie, value string) *http.Cookie {
+	t.Helper()
+	r := httptest.NewRequest("GET", "/", nil)
+	if cookie != nil {
+		r.AddCookie(cookie)
+	}
+	session, _ := ks.New(r, sessionName)
+	session.Values["value"] = value
+	w := httptest.NewRecorder()
+	if err := session.Save(r, w); err != nil {
+		t.Fatal(err)
+	}
+	return w.Result().Cookies()[0]
+}
+
+// sessionID returns the ID in the session cookie.
+func sessionID(t *testing.T, ks *kvSessionStore, cookie *http.Cookie) string {
+	t.Helper()
+	var id string
+	if err := securecookie.DecodeMulti(sessionName, cookie.Value, &id, ks.codecs...); err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+func TestKVSessionStoreUnknownID(t *testing.T) {
+	ks := newKVSessionStore(newMemStore(), securecookie.GenerateRandomKey(32))
+
+	// A validly signed ID the server never issued, or has since
+	// forgotten, is not adopted.
+	planted, err := securecookie.EncodeMulti(sessionName, "planted", ks.codecs...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cookie := saveSession(t, ks, &http.Cookie{Name: sessionName, Value: planted}, "x")
+	if id := sessionID(t, ks, cookie); id == "planted" || id == "" {
+		t.Errorf("Session was saved under ID %q, want a new one", id)
+	}
+
+	// Known sessions keep their ID.
+	again := saveSession(t, ks, cookie, "y")
+	if sessionID(t, ks, again) != sessionID(t, ks, cookie) {
+		t.Error("Known session was given a new ID")
+	}
+}
+
+func TestRenewSessionID(t *testing.T) {
+	kv := newMemStore()
+	ks := newKVSessionStore(kv, securecookie.GenerateRandomKey(32))
+	cookie := saveSession(t, ks, nil, "x")
+	old := sessionID(t, ks, cookie)
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(cookie)
+	session, err := ks.New(r, sessionName)
+	if err != nil || session.IsNew {
+		t.Fatalf("Could not load the session: %v", err)
+	}
+	if err := renewSessionID(session); err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	if err := session.Save(r, w); err != nil {
+		t.Fatal(err)
+	}
+	if id := sessionID(t, ks, w.Result().Cookies()[0]); id == old {
+		t.Error("Session kept its ID")
+	}
+	if _, err := kv.Get(sessionKeyPrefix + old); err == nil {
+		t.Error("Session is still stored under its old ID")
+	}
+}
+
+func TestSessionCompleteRenewsID(t *testing.T) {
+	s := newTestServer(t)
+	ks := newKVSessionStore(newMemStore(), securecookie.GenerateRandomKey(32))
+	s.sessions = ks
+	account := currentAccount(t)
+
+	// The ID a session had before signing in is not the one
+	// signed in.
+	before := saveSession(t, ks, nil, "x")
+	r := handoffRequest(t, s, &handoffToken{Subject: account.Uid, Service: testIdpService, Next: "/"})
+	r.AddCookie(before)
+	w := httptest.NewRecorder()
+	s.sessionComplete(w, r)
+	if w.Code != http.StatusSeeOther {
+		t.Fatalf("got %d with body %s, want a redirect", w.Code, w.Body)
+	}
+	after := w.Result().Cookies()[0]
+	if sessionID(t, ks, after) == sessionID(t, ks, before) {
+		t.Error("Signing in kept the session ID")
+	}
+	r = httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(before)
+	if s.currentSession(r) != nil {
+		t.Error("The session ID from before signing in is signed in")
+	}
+	r = httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(after)
+	if s.currentSession(r) == nil {
+		t.Error("The new session ID is not signed in")
+	}
+
+	// Nor is the one after signing out.
+	r = httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(after)
+	w = httptest.NewRecorder()
+	if err := s.signOut(w, r); err != nil {
+		t.Fatal(err)
+	}
+	if sessionID(t, ks, w.Result().Cookies()[0]) == sessionID(t, ks, after) {
+		t.Error("Signing out kept the session ID")
+	}
+}
+
+func TestSessionCookieOptions(t *testing.T) {
+	for _, secure := range []bool{false, true} {
+		ks := newKVSessionStore(newMemStore(), securecookie.GenerateRandomKey(32))
+		ks.Options = cookieOptions(secure)
+		cookie := saveSession(t, ks, nil, "x")
+		if !cookie.HttpOnly || cookie.SameSite != http.SameSiteLaxMode || cookie.Secure != secure {
+			t.Errorf("got HttpOnly=%v SameSite=%v Secure=%v, want HttpOnly, SameSite=Lax and Secure=%v", cookie.HttpOnly, cookie.SameSite, cookie.Secure, secure)
+		}
+	}
+}
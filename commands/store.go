@@ -0,0 +1,136 @@
+package commands
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// errNotFound is returned by kvStore.Get if there is no value for the
+// key, or it has expired.
+var errNotFound = errors.New("not found")
+
+// kvStore holds nonstick's own state, such as sessions, outside the
+// browser. Every value expires after the TTL it was put with.
+type kvStore interface {
+	Get(key string) ([]byte, error)
+	Put(key string, value []byte, ttl time.Duration) error
+	Delete(key string) error
+	// Take gets and deletes the value of the key at once, so
+	// only one caller gets it.
+	Take(key string) ([]byte, error)
+	// Scan returns the values of all keys with the prefix.
+	Scan(prefix string) (map[string][]byte, error)
+	Close() error
+}
+
+// openStore opens the kvStore of the given kind: "cookie", for which
+// sessions are kept in cookies, and any other state in memory, "file"
+// or "bolt", which keep state in path, or "redis", which connects to
+// the Redis server at redisURL.
+func openStore(kind, path, redisURL string) (kvStore, error) {
+	switch kind {
+	case "cookie":
+		return newMemStore(), nil
+	case "file":
+		return newFileStore(path)
+	case "bolt":
+		return newBoltStore(path)
+	case "redis":
+		return newRedisStore(redisURL)
+	}
+	return nil, fmt.Errorf("unknown session store %q", kind)
+}
+
+// sweepInterval is how often stores that do not expire values
+// themselves look for expired ones to remove.
+const sweepInterval = 5 * time.Minute
+
+// withExpiry prefixes a value with when it expires, for stores that
+// do not expire values themselves.
+func withExpiry(value []byte, ttl time.Duration) []byte {
+	data := binary.BigEndian.AppendUint64(nil, uint64(time.Now().Add(ttl).UnixNano()))
+	return append(data, value...)
+}
+
+// unexpired returns the value stored by withExpiry, if it has not
+// expired.
+func unexpired(data []byte, now time.Time) ([]byte, bool) {
+	if len(data) < 8 || now.UnixNano() > int64(binary.BigEndian.Uint64(data)) {
+		return nil, false
+	}
+	return data[8:], true
+}
+
+// memStore is a kvStore in memory, for a single nonstick process.
+type memStore struct {
+	mu        sync.Mutex
+	values    map[string][]byte
+	lastSweep time.Time
+}
+
+func newMemStore() *memStore {
+	return &memStore{values: make(map[string][]byte)}
+}
+
+func (m *memStore) Get(key string) ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	value, ok := unexpired(m.values[key], time.Now())
+	if !ok {
+		return nil, errNotFound
+	}
+	return value, nil
+}
+
+func (m *memStore) Put(key string, value []byte, ttl time.Duration) error {
+	now := time.Now()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if now.Sub(m.lastSweep) > sweepInterval {
+		for k, data := range m.values {
+			if _, ok := unexpired(data, now); !ok {
+				delete(m.values, k)
+			}
+		}
+		m.lastSweep = now
+	}
+	m.values[key] = withExpiry(value, ttl)
+	return nil
+}
+
+func (m *memStore) Delete(key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.values, key)
+	return nil
+}
+
+func (m *memStore) Take(key string) ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	value, ok := unexpired(m.values[key], time.Now())
+	delete(m.values, key)
+	if !ok {
+		return nil, errNotFound
+	}
+	return value, nil
+}
+
+func (m *memStore) Scan(prefix string) (map[string][]byte, error) {
+	now := time.Now()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	result := make(map[string][]byte)
+	for key, data := range m.values {
+		if value, ok := unexpired(data, now); ok && strings.HasPrefix(key, prefix) {
+			result[key] = value
+		}
+	}
+	return result, nil
+}
+
+func (m *memStore) Close() error { return nil }
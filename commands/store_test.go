@@ -0,0 +1,154 @@
+package commands
+
+import (
+	"errors"
+	"maps"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+// testStores returns each kind of kvStore, and how to let time pass
+// for it, as values only expire on a Redis server as it sees time.
+func testStores() map[string]func(t *testing.T) (kvStore, func(time.Duration)) {
+	sleep := time.Sleep
+	return map[string]func(t *testing.T) (kvStore, func(time.Duration)){
+		"mem": func(t *testing.T) (kvStore, func(time.Duration)) {
+			return newMemStore(), sleep
+		},
+		"file": func(t *testing.T) (kvStore, func(time.Duration)) {
+			kv, err := newFileStore(filepath.Join(t.TempDir(), "sessions"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			return kv, sleep
+		},
+		"bolt": func(t *testing.T) (kvStore, func(time.Duration)) {
+			kv, err := newBoltStore(filepath.Join(t.TempDir(), "sessions.db"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			return kv, sleep
+		},
+		"redis": func(t *testing.T) (kvStore, func(time.Duration)) {
+			server := miniredis.RunT(t)
+			kv, err := newRedisStore("redis://" + server.Addr())
+			if err != nil {
+				t.Fatal(err)
+			}
+			return kv, server.FastForward
+		},
+	}
+}
+
+func TestStoreConformance(t *testing.T) {
+	for name, open := range testStores() {
+		t.Run(name, func(t *testing.T) {
+			kv, wait := open(t)
+			defer kv.Close()
+
+			if _, err := kv.Get("missing"); !errors.Is(err, errNotFound) {
+				t.Errorf("Get(missing) returned %v, want errNotFound", err)
+			}
+			if _, err := kv.Take("missing"); !errors.Is(err, errNotFound) {
+				t.Errorf("Take(missing) returned %v, want errNotFound", err)
+			}
+			if err := kv.Delete("missing"); err != nil {
+				t.Errorf("Delete(missing) returned %v", err)
+			}
+
+			for key, value := range map[string]string{"a:1": "one", "a:2": "two", "a*:3": "three", "b:1": "other"} {
+				if err := kv.Put(key, []byte(value), time.Hour); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := kv.Put("a:1", []byte("uno"), time.Hour); err != nil {
+				t.Fatal(err)
+			}
+			if value, err := kv.Get("a:1"); err != nil || string(value) != "uno" {
+				t.Errorf("Get(a:1) = %q, %v, want the replaced value", value, err)
+			}
+
+			got, err := kv.Scan("a:")
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := map[string][]byte{"a:1": []byte("uno"), "a:2": []byte("two")}
+			if !maps.EqualFunc(got, want, func(a, b []byte) bool { return string(a) == string(b) }) {
+				t.Errorf("Scan(a:) = %q, want %q", got, want)
+			}
+			// Prefixes are not patterns.
+			if got, err := kv.Scan("a*"); err != nil || len(got) != 1 {
+				t.Errorf("Scan(a*) = %q, %v, want only a*:3", got, err)
+			}
+
+			if value, err := kv.Take("a:2"); err != nil || string(value) != "two" {
+				t.Errorf("Take(a:2) = %q, %v, want two", value, err)
+			}
+			if _, err := kv.Get("a:2"); !errors.Is(err, errNotFound) {
+				t.Errorf("Get(a:2) after Take returned %v, want errNotFound", err)
+			}
+			if err := kv.Delete("b:1"); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := kv.Get("b:1"); !errors.Is(err, errNotFound) {
+				t.Errorf("Get(b:1) after Delete returned %v, want errNotFound", err)
+			}
+
+			// Values expire after their TTL, whether got, taken
+			// or scanned.
+			if err := kv.Put("short:1", []byte("gone"), 50*time.Millisecond); err != nil {
+				t.Fatal(err)
+			}
+			if err := kv.Put("short:2", []byte("gone"), 50*time.Millisecond); err != nil {
+				t.Fatal(err)
+			}
+			if err := kv.Put("short:3", []byte("kept"), time.Hour); err != nil {
+				t.Fatal(err)
+			}
+			wait(100 * time.Millisecond)
+			if _, err := kv.Get("short:1"); !errors.Is(err, errNotFound) {
+				t.Errorf("Get(short:1) after its TTL returned %v, want errNotFound", err)
+			}
+			if _, err := kv.Take("short:2"); !errors.Is(err, errNotFound) {
+				t.Errorf("Take(short:2) after its TTL returned %v, want errNotFound", err)
+			}
+			if got, err := kv.Scan("short:"); err != nil || len(got) != 1 || string(got["short:3"]) != "kept" {
+				t.Errorf("Scan(short:) = %q, %v, want only the unexpired value", got, err)
+			}
+		})
+	}
+}
+
+func TestStoreTakeOnce(t *testing.T) {
+	for name, open := range testStores() {
+		t.Run(name, func(t *testing.T) {
+			kv, _ := open(t)
+			defer kv.Close()
+			if err := kv.Put("ticket", []byte("ST-1"), time.Hour); err != nil {
+				t.Fatal(err)
+			}
+			var wg sync.WaitGroup
+			var mu sync.Mutex
+			taken := 0
+			for i := 0; i < 10; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					if _, err := kv.Take("ticket"); err == nil {
+						mu.Lock()
+						taken++
+						mu.Unlock()
+					}
+				}()
+			}
+			wg.Wait()
+			if taken != 1 {
+				t.Errorf("Value was taken %d times, want once", taken)
+			}
+		})
+	}
+}
@@ -0,0 +1,75 @@
+package commands
+
+import (
+	"encoding/base64"
+	"time"
+
+	"github.com/gorilla/securecookie"
+	"github.com/rs/zerolog/log"
+)
+
+// throttlePrefix prefixes the keys of failures in the kvStore.
+const throttlePrefix = "throttle:"
+
+// failureThrottle slows down password guessing. Once a key (e.g., a
+// username, or a client's address) has failed limit times within the
+// window, it is refused until the oldest of those failures is older
+// than the window. Empty keys (e.g., an unknown address) are ignored.
+// Failures are kept in the kvStore, each expiring after the window,
+// so that all replicas sharing it count them together.
+type failureThrottle struct {
+	kv kvStore
+	// name tells the failures of this throttle apart from those of
+	// others in the kvStore.
+	name   string
+	limit  int
+	window time.Duration
+}
+
+func newFailureThrottle(kv kvStore, name string, limit int, window time.Duration) *failureThrottle {
+	return &failureThrottle{
+		kv:     kv,
+		name:   name,
+		limit:  limit,
+		window: window,
+	}
+}
+
+// prefix returns the prefix of the key's failures in the kvStore. The
+// key is encoded, so no key is a prefix of another (e.g., IPv6
+// addresses).
+func (t *failureThrottle) prefix(key string) string {
+	return throttlePrefix + t.name + ":" + base64.RawURLEncoding.EncodeToString([]byte(key)) + ":"
+}
+
+// Allowed reports whether none of the keys are refused. If the
+// failures cannot be counted, the keys are refused.
+func (t *failureThrottle) Allowed(keys ...string) bool {
+	for _, key := range keys {
+		if key == "" {
+			continue
+		}
+		failures, err := t.kv.Scan(t.prefix(key))
+		if err != nil {
+			log.Error().Err(err).Msg("Could not count failures")
+			return false
+		}
+		if len(failures) >= t.limit {
+			return false
+		}
+	}
+	return true
+}
+
+// Failed records a failure of each of the keys.
+func (t *failureThrottle) Failed(keys ...string) {
+	for _, key := range keys {
+		if key == "" {
+			continue
+		}
+		id := base64.RawURLEncoding.EncodeToString(securecookie.GenerateRandomKey(12))
+		if err := t.kv.Put(t.prefix(key)+id, nil, t.window); err != nil {
+			log.Error().Err(err).Msg("Could not record failure")
+		}
+	}
+}
@@ -0,0 +1,42 @@
+package commands
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFailureThrottle(t *testing.T) {
+	for name, open := range testStores() {
+		t.Run(name, func(t *testing.T) {
+			kv, wait := open(t)
+			defer kv.Close()
+			throttle := newFailureThrottle(kv, "test", 2, time.Second)
+			throttle.Failed("alice", "2001:db8::1")
+			if !throttle.Allowed("alice") {
+				t.Error("Refused after a single failure")
+			}
+			throttle.Failed("alice", "")
+			if throttle.Allowed("alice") || throttle.Allowed("bob", "alice") {
+				t.Error("Allowed after reaching the limit")
+			}
+			if !throttle.Allowed("bob", "2001:db8::1", "2001:db8:", "") {
+				t.Error("Refused keys below the limit")
+			}
+
+			// Other throttles, and other replicas sharing the
+			// store, see the same failures.
+			if !newFailureThrottle(kv, "other", 2, time.Second).Allowed("alice") {
+				t.Error("Another throttle counted the failures")
+			}
+			if newFailureThrottle(kv, "test", 2, time.Second).Allowed("alice") {
+				t.Error("Another replica did not count the failures")
+			}
+
+			// Failures are forgotten after the window.
+			wait(1100 * time.Millisecond)
+			if !throttle.Allowed("alice") {
+				t.Error("Refused after the window")
+			}
+		})
+	}
+}
@@ -0,0 +1,175 @@
+package commands
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"html/template"
+	"image/png"
+	"math/big"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/achernya/nonstick/pamsocket"
+	"github.com/gorilla/csrf"
+	"github.com/pquerna/otp/totp"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// scratchCodes is the number of emergency scratch codes
+	// written, matching the google-authenticator tool.
+	scratchCodes = 5
+	// totpPrefix prefixes the keys of enrollments in the kvStore.
+	totpPrefix = "totp:"
+	// totpEnrollmentLifetime is how long users have to confirm
+	// the secret shown to them.
+	totpEnrollmentLifetime = 10 * time.Minute
+	// enrollTokenPrefix prefixes the keys of the PAM helper's
+	// enrollment tokens of sessions in the kvStore.
+	enrollTokenPrefix = "enroll-token:"
+)
+
+// generateScratchCodes returns n random 8-digit emergency scratch
+// codes.
+func generateScratchCodes(n int) ([]string, error) {
+	var codes []string
+	for i := 0; i < n; i++ {
+		code, err := rand.Int(rand.Reader, big.NewInt(90000000))
+		if err != nil {
+			return nil, err
+		}
+		codes = append(codes, strconv.FormatInt(code.Int64()+10000000, 10))
+	}
+	return codes, nil
+}
+
+// googleAuthenticatorConfig renders the file format understood by
+// pam_google_authenticator, with the same options the
+// google-authenticator tool writes for time-based codes.
+func googleAuthenticatorConfig(secret string, scratch []string) []byte {
+	var b bytes.Buffer
+	fmt.Fprintln(&b, secret)
+	fmt.Fprintln(&b, `" RATE_LIMIT 3 30`)
+	fmt.Fprintln(&b, `" WINDOW_SIZE 3`)
+	fmt.Fprintln(&b, `" DISALLOW_REUSE`)
+	fmt.Fprintln(&b, `" TOTP_AUTH`)
+	for _, code := range scratch {
+		fmt.Fprintln(&b, code)
+	}
+	return b.Bytes()
+}
+
+func (s *server) getEnrollTotp(w http.ResponseWriter, r *http.Request) {
+	ts, userinfo := s.requireSession(w, r)
+	if ts == nil {
+		return
+	}
+	enrolled, err := s.enroller.Enrolled(userinfo.Username)
+	if err != nil {
+		s.internalError(w, r, fmt.Errorf("could not check enrollment of %q: %w", userinfo.Username, err))
+		return
+	}
+	if enrolled {
+		s.respondWithError(w, r, "You are already enrolled in one-time codes.")
+		return
+	}
+
+	key, err := totp.Generate(totp.GenerateOpts{
+		Issuer:      "Nonstick IdP",
+		AccountName: userinfo.Username,
+	})
+	if err != nil {
+		s.internalError(w, r, fmt.Errorf("could not generate TOTP secret: %w", err))
+		return
+	}
+	img, err := key.Image(200, 200)
+	if err != nil {
+		s.internalError(w, r, fmt.Errorf("could not render QR code: %w", err))
+		return
+	}
+	var qr bytes.Buffer
+	if err := png.Encode(&qr, img); err != nil {
+		s.internalError(w, r, fmt.Errorf("could not encode QR code: %w", err))
+		return
+	}
+
+	// Hold on to the secret until the user proves their
+	// authenticator app has it, too. It is kept out of the
+	// session cookie, which is neither encrypted nor necessarily
+	// private to nonstick.
+	if err := s.state.Put(totpPrefix+ts.ID, []byte(key.Secret()), totpEnrollmentLifetime); err != nil {
+		s.internalError(w, r, fmt.Errorf("could not save TOTP secret: %w", err))
+		return
+	}
+
+	s.renderTemplate("enroll_totp", map[string]interface{}{
+		"CsrfField": csrf.TemplateField(r),
+		"User":      userinfo,
+		"Secret":    key.Secret(),
+		"QRCode":    dataURL("image/png", qr.Bytes()),
+	}, w)
+}
+
+func (s *server) postEnrollTotp(w http.ResponseWriter, r *http.Request) {
+	ts, userinfo := s.requireSession(w, r)
+	if ts == nil {
+		return
+	}
+	// Taken, so each secret gets a single attempt.
+	data, err := s.state.Take(totpPrefix + ts.ID)
+	if errors.Is(err, errNotFound) {
+		s.respondWithError(w, r, "Enrollment expired, please start over.")
+		return
+	}
+	if err != nil {
+		s.internalError(w, r, fmt.Errorf("could not look up TOTP secret: %w", err))
+		return
+	}
+	secret := string(data)
+	if !totp.Validate(r.PostFormValue("code"), secret) {
+		s.respondWithError(w, r, "That code is not valid, please start over.")
+		return
+	}
+	scratch, err := generateScratchCodes(scratchCodes)
+	if err != nil {
+		s.internalError(w, r, fmt.Errorf("could not generate scratch codes: %w", err))
+		return
+	}
+	// The PAM helper, if any, needs proof the user authenticated
+	// through it, which only lasts so long after signing in.
+	token, err := s.state.Get(enrollTokenPrefix + ts.ID)
+	if err != nil && !errors.Is(err, errNotFound) {
+		s.internalError(w, r, fmt.Errorf("could not look up enrollment token: %w", err))
+		return
+	}
+	err = s.enroller.Enroll(userinfo.Username, string(token), googleAuthenticatorConfig(secret, scratch))
+	if errors.Is(err, os.ErrExist) {
+		s.respondWithError(w, r, "You are already enrolled in one-time codes.")
+		return
+	}
+	if errors.Is(err, pamsocket.ErrAuthenticationFailed) {
+		log.Info().Err(err).Msgf("PAM helper refused to enroll %q", userinfo.Username)
+		s.respondWithError(w, r, "Your sign-in is too old to enroll, please sign out and sign in again.")
+		return
+	}
+	if err != nil {
+		s.internalError(w, r, fmt.Errorf("could not write %s for %q: %w", pamsocket.GoogleAuthenticatorFile, userinfo.Username, err))
+		return
+	}
+	log.Info().Msgf("Enrolled %q in one-time codes", userinfo.Username)
+
+	s.renderTemplate("enroll_totp", map[string]interface{}{
+		"User":         userinfo,
+		"ScratchCodes": scratch,
+	}, w)
+}
+
+// dataURL returns data inlined as a URL, for use in templates.
+func dataURL(mediaType string, data []byte) template.URL {
+	return template.URL("data:" + mediaType + ";base64," + base64.StdEncoding.EncodeToString(data))
+}
@@ -0,0 +1,95 @@
+package commands
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/achernya/nonstick/pamsocket"
+	"github.com/pquerna/otp/totp"
+)
+
+// tokenEnroller enrolls users given the token "proof", recording
+// their configurations.
+type tokenEnroller map[string][]byte
+
+func (e tokenEnroller) Enrolled(username string) (bool, error) {
+	_, ok := e[username]
+	return ok, nil
+}
+
+func (e tokenEnroller) Enroll(username, token string, config []byte) error {
+	if token != "proof" {
+		return pamsocket.ErrAuthenticationFailed
+	}
+	e[username] = config
+	return nil
+}
+
+// completeSignIn signs in through /session/complete, with the handoff
+// token, and returns the session cookie.
+func completeSignIn(t *testing.T, s *server, token *handoffToken) *http.Cookie {
+	t.Helper()
+	r := handoffRequest(t, s, token)
+	w := httptest.NewRecorder()
+	s.sessionComplete(w, r)
+	if w.Code != http.StatusSeeOther {
+		t.Fatalf("got %d with body %s, want a redirect", w.Code, w.Body)
+	}
+	return w.Result().Cookies()[0]
+}
+
+// enrollTotp runs through the enrollment pages, and returns the
+// final response.
+func enrollTotp(t *testing.T, s *server, cookie *http.Cookie) *httptest.ResponseRecorder {
+	t.Helper()
+	r := httptest.NewRequest("GET", "/enroll/totp", nil)
+	r.AddCookie(cookie)
+	w := httptest.NewRecorder()
+	s.getEnrollTotp(w, r)
+	ts := s.currentSession(r)
+	if w.Code != http.StatusOK || ts == nil {
+		t.Fatalf("got %d with body %s, want the enrollment page", w.Code, w.Body)
+	}
+	secret, err := s.state.Get(totpPrefix + ts.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, err := totp.GenerateCode(string(secret), time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	r = httptest.NewRequest("POST", "/enroll/totp", strings.NewReader(url.Values{"code": {code}}.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.AddCookie(cookie)
+	w = httptest.NewRecorder()
+	s.postEnrollTotp(w, r)
+	return w
+}
+
+func TestEnrollTotpToken(t *testing.T) {
+	s := newTestServer(t)
+	account := currentAccount(t)
+	enroller := tokenEnroller{}
+	s.enroller = enroller
+
+	// Without the PAM helper's proof of the sign-in, it refuses.
+	cookie := completeSignIn(t, s, &handoffToken{Subject: account.Uid, Service: "password", Next: "/"})
+	if w := enrollTotp(t, s, cookie); !strings.Contains(w.Body.String(), "sign in again") {
+		t.Errorf("got %d with body %s, want to be told to sign in again", w.Code, w.Body)
+	}
+	if len(enroller) != 0 {
+		t.Fatal("Enrolled without proof")
+	}
+
+	cookie = completeSignIn(t, s, &handoffToken{Subject: account.Uid, Service: "password", Next: "/", EnrollToken: "proof"})
+	if w := enrollTotp(t, s, cookie); w.Code != http.StatusOK {
+		t.Errorf("got %d with body %s, want enrollment to succeed", w.Code, w.Body)
+	}
+	if _, ok := enroller[account.Username]; !ok {
+		t.Error("Not enrolled with proof")
+	}
+}
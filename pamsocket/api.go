@@ -0,0 +1,179 @@
+package pamsocket
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// apiWait bounds how long an API request waits for the conversation
+// to prompt, before returning a `pending` status.
+const apiWait = 25 * time.Second
+
+// apiStatus is the state of a conversation, as returned by the API.
+type apiStatus struct {
+	// ID identifies the conversation in later requests. Anybody
+	// who knows it can take over the conversation.
+	ID string
+	// Status is `prompt` if Prompt must be answered, `pending` if
+	// PAM is still working, or `authenticated` or `failed` once
+	// the conversation is over.
+	Status string
+	// Messages are the informational and error messages sent since
+	// the last request.
+	Messages []Message `json:",omitempty"`
+	// Prompt is the prompt to answer, like the websocket's prompt
+	// messages.
+	Prompt *Message `json:",omitempty"`
+	// Redirect is where the LoginFlow sends the user once they are
+	// authenticated, exactly as a browser would be. The client
+	// must follow it to complete the sign-in; with Ory Hydra, for
+	// instance, it leads back to Hydra, and only from there (after
+	// consent) to the OAuth2 client's redirect URI with the code.
+	Redirect string `json:",omitempty"`
+	// Error describes why the conversation failed.
+	Error string `json:",omitempty"`
+}
+
+// apiError is the body of an API error response.
+type apiError struct {
+	Error string
+}
+
+// API carries the conversations of a PamSocket as a JSON REST API,
+// for clients without a browser:
+//
+//   - `POST /` starts a conversation, passing its query parameters
+//     (e.g., `login_challenge`) to the LoginFlow.
+//   - `GET /{id}` returns the status of a conversation.
+//   - `POST /{id}/answer` answers its prompt with a JSON-encoded
+//     fromClient, and returns the new status.
+//
+// Each returns an apiStatus, waiting until the conversation prompts
+// or is over, for a while.
+type API struct {
+	// Socket runs the conversations.
+	Socket *PamSocket
+
+	once sync.Once
+	mux  *http.ServeMux
+}
+
+func (api *API) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	api.once.Do(func() {
+		api.mux = http.NewServeMux()
+		api.mux.HandleFunc("POST /{$}", api.start)
+		api.mux.HandleFunc("GET /{id}", api.get)
+		api.mux.HandleFunc("POST /{id}/answer", api.answer)
+	})
+	if r.URL.Path == "" {
+		r.URL.Path = "/"
+	}
+	api.mux.ServeHTTP(w, r)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func (api *API) start(w http.ResponseWriter, r *http.Request) {
+	c, redirect, err := api.Socket.Start(r)
+	if err != nil {
+		report(err)
+		writeJSON(w, http.StatusInternalServerError, apiError{UserMessage(err)})
+		return
+	}
+	if redirect != "" {
+		writeJSON(w, http.StatusOK, apiStatus{
+			Status:   "authenticated",
+			Redirect: redirect,
+		})
+		return
+	}
+	api.status(w, r, c, http.StatusCreated)
+}
+
+// conversation returns the conversation named in the request path.
+// Otherwise, nil is returned, and the request is either passed on to
+// the replica running the conversation, or answered with an error.
+func (api *API) conversation(w http.ResponseWriter, r *http.Request) *Conversation {
+	if api.Socket.Forward(w, r, r.PathValue("id")) {
+		return nil
+	}
+	c := api.Socket.Resume(r.PathValue("id"))
+	if c == nil {
+		writeJSON(w, http.StatusNotFound, apiError{UserMessage(errClientGone)})
+	}
+	return c
+}
+
+func (api *API) get(w http.ResponseWriter, r *http.Request) {
+	if c := api.conversation(w, r); c != nil {
+		api.status(w, r, c, http.StatusOK)
+	}
+}
+
+func (api *API) answer(w http.ResponseWriter, r *http.Request) {
+	c := api.conversation(w, r)
+	if c == nil {
+		return
+	}
+	msg := fromClient{}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxAnswerSize)).Decode(&msg); err != nil {
+		writeJSON(w, http.StatusBadRequest, apiError{"Malformed answer"})
+		return
+	}
+	if err := c.Answer(msg.Input); err != nil {
+		writeJSON(w, http.StatusConflict, apiError{"Not waiting for input"})
+		return
+	}
+	api.status(w, r, c, http.StatusOK)
+}
+
+// status waits for the conversation to prompt or end, and responds
+// with its status.
+func (api *API) status(w http.ResponseWriter, r *http.Request, c *Conversation, code int) {
+	st := apiStatus{
+		ID:     c.ID,
+		Status: "pending",
+	}
+	a := c.Attach()
+	defer a.Detach()
+	ctx, cancel := context.WithTimeout(r.Context(), apiWait)
+	defer cancel()
+	for st.Prompt == nil {
+		msg, err := a.Next(ctx)
+		if errors.Is(err, ErrConversationOver) {
+			redirect, err := api.Socket.Finish(r, c)
+			if err != nil {
+				log.Info().Err(err).Msg("Could not authenticate user")
+				st.Status = "failed"
+				st.Error = UserMessage(err)
+				break
+			}
+			st.Status = "authenticated"
+			st.Redirect = redirect
+			break
+		}
+		if err != nil {
+			// PAM is taking its time; the client should ask
+			// again.
+			break
+		}
+		if isPrompt(msg.Type) {
+			st.Status = "prompt"
+			st.Prompt = &msg
+			continue
+		}
+		st.Messages = append(st.Messages, msg)
+	}
+	writeJSON(w, code, st)
+}
@@ -0,0 +1,87 @@
+package pamsocket
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func apiRequest(t *testing.T, method, url, body string, want int) apiStatus {
+	t.Helper()
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != want {
+		t.Fatalf("%s %s returned %d, want %d", method, url, resp.StatusCode, want)
+	}
+	st := apiStatus{}
+	json.NewDecoder(resp.Body).Decode(&st)
+	return st
+}
+
+func TestAPI(t *testing.T) {
+	ts := httptest.NewServer(&API{
+		Socket: &PamSocket{
+			Authenticator: echoAuthenticator{},
+			Flow:          &NoopFlow{},
+		},
+	})
+	defer ts.Close()
+
+	st := apiRequest(t, "POST", ts.URL+"/", "", http.StatusCreated)
+	if st.Status != "prompt" || st.Prompt.Type != "PromptEchoOn" {
+		t.Fatalf("got %#v, want a prompt", st)
+	}
+	if got := apiRequest(t, "GET", ts.URL+"/"+st.ID, "", http.StatusOK); got.Status != "prompt" {
+		t.Errorf("got %#v, want the prompt again", got)
+	}
+	apiRequest(t, "GET", ts.URL+"/bogus", "", http.StatusNotFound)
+
+	got := apiRequest(t, "POST", ts.URL+"/"+st.ID+"/answer", `{"Input": "root"}`, http.StatusOK)
+	if got.Status != "authenticated" || got.Redirect != "/consent" {
+		t.Errorf("got %#v, want a redirect to /consent", got)
+	}
+	apiRequest(t, "GET", ts.URL+"/"+st.ID, "", http.StatusNotFound)
+}
+
+// skipFlow is a challengeFlow which needs no sign-in for the `skip`
+// query parameter.
+type skipFlow struct{ challengeFlow }
+
+func (*skipFlow) PreLogin(r *http.Request) (*LoginInfo, error) {
+	if r.URL.Query().Get("skip") != "" {
+		return &LoginInfo{Redirect: "/skipped"}, nil
+	}
+	return &LoginInfo{}, nil
+}
+
+func TestAPIFlow(t *testing.T) {
+	ts := httptest.NewServer(&API{
+		Socket: &PamSocket{
+			Authenticator: echoAuthenticator{},
+			Flow:          &skipFlow{},
+		},
+	})
+	defer ts.Close()
+
+	st := apiRequest(t, "POST", ts.URL+"/?skip=1", "", http.StatusOK)
+	if st.Status != "authenticated" || st.Redirect != "/skipped" || st.ID != "" {
+		t.Errorf("got %#v, want a redirect to /skipped", st)
+	}
+
+	// The flow finishes with the query the conversation was
+	// started with.
+	st = apiRequest(t, "POST", ts.URL+"/?login_challenge=abc", "", http.StatusCreated)
+	got := apiRequest(t, "POST", ts.URL+"/"+st.ID+"/answer", `{"Input": "root"}`, http.StatusOK)
+	if got.Status != "authenticated" || got.Redirect != "/abc" {
+		t.Errorf("got %#v, want a redirect to /abc", got)
+	}
+}
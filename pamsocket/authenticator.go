@@ -0,0 +1,129 @@
+package pamsocket
+
+import (
+	"errors"
+	"fmt"
+	"runtime"
+
+	"github.com/msteinert/pam/v2"
+)
+
+// ErrAuthenticationFailed is returned (wrapped) by an Authenticator
+// when PAM ran successfully, but did not authenticate the user. Any
+// other error indicates PAM itself could not be run.
+var ErrAuthenticationFailed = errors.New("authentication failed")
+
+// AuthRequest describes a single PAM transaction.
+type AuthRequest struct {
+	// Service is the PAM service to authenticate against.
+	Service string
+	// User is the username to start the transaction with. If
+	// empty, PAM will prompt for one.
+	User string
+	// Items are additional PAM items (such as PAM_RHOST) to set
+	// before authenticating.
+	Items map[pam.Item]string
+	// Claims are the PAM environment variables and items to
+	// collect once the user is authenticated.
+	Claims map[string]ClaimSource
+}
+
+// AuthResult is the outcome of a successful PAM transaction.
+type AuthResult struct {
+	// Username is the final value of PAM_USER, which modules
+	// may have changed from AuthRequest.User.
+	Username string
+	// Claims are the values collected for AuthRequest.Claims.
+	Claims map[string]string
+	// EnrollToken, set by a Helper that enrolls users, proves to
+	// it that Username authenticated (see HelperEnroller).
+	EnrollToken string `json:",omitempty"`
+}
+
+// Authenticator runs PAM transactions. All interaction with the user
+// happens through the conversation handler.
+type Authenticator interface {
+	Authenticate(req *AuthRequest, conv pam.ConversationHandler) (*AuthResult, error)
+}
+
+// settableItems are the PAM items an AuthRequest may set. The
+// authentication tokens are deliberately absent, so they can only
+// come from the conversation. PAM_RUSER is only set when
+// re-authenticating a user who already did (see
+// LoginInfo.UsernameFixed).
+var settableItems = map[pam.Item]bool{
+	pam.Rhost:    true,
+	pam.Ruser:    true,
+	pam.Tty:      true,
+	pam.Xdisplay: true,
+}
+
+// LocalAuthenticator runs PAM transactions in the calling process.
+type LocalAuthenticator struct {
+	// ConfDir is the directory where the PAM service
+	// configurations live. By default, this is `/etc/pam.d/`.
+	ConfDir string
+}
+
+func (l *LocalAuthenticator) Authenticate(req *AuthRequest, conv pam.ConversationHandler) (*AuthResult, error) {
+	type outcome struct {
+		result *AuthResult
+		err    error
+	}
+	done := make(chan outcome, 1)
+	go func() {
+		// Run the transaction on a dedicated OS thread. The
+		// goroutine exits without unlocking it, so the thread
+		// is discarded, along with any thread-local state a PAM
+		// module left behind.
+		runtime.LockOSThread()
+		defer func() {
+			if v := recover(); v != nil {
+				done <- outcome{nil, fmt.Errorf("panic in PAM transaction: %v", v)}
+			}
+		}()
+		result, err := l.authenticate(req, conv)
+		done <- outcome{result, err}
+	}()
+	o := <-done
+	return o.result, o.err
+}
+
+func (l *LocalAuthenticator) authenticate(req *AuthRequest, conv pam.ConversationHandler) (*AuthResult, error) {
+	t, err := pam.StartConfDir(req.Service, req.User, conv, l.ConfDir)
+	if err != nil {
+		return nil, fmt.Errorf("cannot start PAM session: %w", err)
+	}
+	defer t.End()
+
+	for item, value := range req.Items {
+		if !settableItems[item] {
+			return nil, fmt.Errorf("PAM item %d may not be set", item)
+		}
+		if value == "" {
+			continue
+		}
+		if err := t.SetItem(item, value); err != nil {
+			return nil, fmt.Errorf("could not set PAM item %d: %w", item, err)
+		}
+	}
+
+	for claim, source := range req.Claims {
+		if source.Env == "" && !claimItemAllowed(source.Item) {
+			return nil, fmt.Errorf("PAM item %d may not be used for claim %q", source.Item, claim)
+		}
+	}
+
+	if err := t.Authenticate(0); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrAuthenticationFailed, err)
+	}
+
+	username, err := t.GetItem(pam.User)
+	if err != nil {
+		return nil, fmt.Errorf("could not retrieve username: %w", err)
+	}
+	return &AuthResult{
+		Username: username,
+		Claims:   collectClaims(t, req.Claims),
+	}, nil
+}
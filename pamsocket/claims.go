@@ -0,0 +1,118 @@
+package pamsocket
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/msteinert/pam/v2"
+	"github.com/rs/zerolog/log"
+)
+
+// claimItems are the PAM items that may be exposed as claims. The
+// authentication tokens are deliberately absent.
+var claimItems = map[string]pam.Item{
+	"PAM_SERVICE":  pam.Service,
+	"PAM_USER":     pam.User,
+	"PAM_TTY":      pam.Tty,
+	"PAM_RHOST":    pam.Rhost,
+	"PAM_RUSER":    pam.Ruser,
+	"PAM_XDISPLAY": pam.Xdisplay,
+}
+
+func claimItemAllowed(item pam.Item) bool {
+	for _, allowed := range claimItems {
+		if item == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// reservedClaims are the claims Hydra sets in every ID token, which
+// must not be overridden.
+var reservedClaims = []string{"sub", "iss", "aud", "exp", "iat", "nonce", "auth_time", "acr", "amr", "azp", "sid"}
+
+// ClaimSource identifies a value, available at the end of a PAM
+// transaction, that is passed to the LoginFlow as a claim.
+type ClaimSource struct {
+	// Env is the name of a PAM environment variable (as set by,
+	// e.g., pam_env or pam_krb5). If empty, Item is used.
+	Env string
+	// Item is the PAM item to use if Env is empty.
+	Item pam.Item
+	// Scope is the scope that must be granted for the claim to be
+	// released.
+	Scope string
+}
+
+// ParseClaims parses claim mappings of the form `claim=env:NAME`
+// (for a PAM environment variable) or `claim=item:PAM_RHOST` (for a
+// PAM item), keyed by claim name. The claim is released with the
+// scope of the same name, or with the one given by a `@scope` suffix
+// (e.g., `krb5_principal=env:KRB5_PRINCIPAL@kerberos`).
+func ParseClaims(specs []string) (map[string]ClaimSource, error) {
+	result := make(map[string]ClaimSource)
+	for _, spec := range specs {
+		claim, source, found := strings.Cut(spec, "=")
+		if !found || claim == "" {
+			return nil, fmt.Errorf("claim mapping %q is not of the form claim=source", spec)
+		}
+		if slices.Contains(reservedClaims, claim) {
+			return nil, fmt.Errorf("claim mapping %q overrides reserved claim %q", spec, claim)
+		}
+		source, scope, found := strings.Cut(source, "@")
+		if !found {
+			scope = claim
+		} else if scope == "" || scope == "openid" {
+			return nil, fmt.Errorf("claim mapping %q has invalid scope %q", spec, scope)
+		}
+		kind, name, _ := strings.Cut(source, ":")
+		switch kind {
+		case "env":
+			if name == "" {
+				return nil, fmt.Errorf("claim mapping %q is missing an environment variable", spec)
+			}
+			result[claim] = ClaimSource{Env: name, Scope: scope}
+		case "item":
+			item, ok := claimItems[name]
+			if !ok {
+				return nil, fmt.Errorf("claim mapping %q uses unknown PAM item %q", spec, name)
+			}
+			result[claim] = ClaimSource{Item: item, Scope: scope}
+		default:
+			return nil, fmt.Errorf("claim mapping %q has unknown source %q", spec, kind)
+		}
+	}
+	return result, nil
+}
+
+// collectClaims reads the configured claims from a PAM transaction
+// that has completed authentication. Claims whose value is empty are
+// omitted.
+func collectClaims(t *pam.Transaction, sources map[string]ClaimSource) map[string]string {
+	claims := make(map[string]string)
+	if len(sources) == 0 {
+		return claims
+	}
+	env, err := t.GetEnvList()
+	if err != nil {
+		log.Error().Err(err).Msg("Could not retrieve PAM environment")
+	}
+	for claim, source := range sources {
+		var value string
+		if source.Env != "" {
+			value = env[source.Env]
+		} else {
+			value, err = t.GetItem(source.Item)
+			if err != nil {
+				log.Error().Err(err).Msgf("Could not retrieve PAM item for claim %q", claim)
+				continue
+			}
+		}
+		if value != "" {
+			claims[claim] = value
+		}
+	}
+	return claims
+}
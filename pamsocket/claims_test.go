@@ -0,0 +1,28 @@
+package pamsocket
+
+import (
+	"testing"
+
+	"github.com/msteinert/pam/v2"
+)
+
+func TestParseClaims(t *testing.T) {
+	claims, err := ParseClaims([]string{"krb5_principal=env:KRB5_PRINCIPAL@kerberos", "remote_host=item:PAM_RHOST"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if source := claims["krb5_principal"]; source.Env != "KRB5_PRINCIPAL" || source.Scope != "kerberos" {
+		t.Errorf("Unexpected source for krb5_principal: %#v", source)
+	}
+	if source := claims["remote_host"]; source.Env != "" || source.Item != pam.Rhost || source.Scope != "remote_host" {
+		t.Errorf("Unexpected source for remote_host: %#v", source)
+	}
+}
+
+func TestParseClaimsInvalid(t *testing.T) {
+	for _, spec := range []string{"", "claim", "=env:FOO", "claim=env:", "claim=item:PAM_AUTHTOK", "claim=file:/etc/passwd", "claim=env:FOO@", "claim=env:FOO@openid", "sub=env:FOO", "nonce=item:PAM_RHOST"} {
+		if _, err := ParseClaims([]string{spec}); err == nil {
+			t.Errorf("Expected an error for %q", spec)
+		}
+	}
+}
@@ -0,0 +1,324 @@
+package pamsocket
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/msteinert/pam/v2"
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	// ErrConversationOver is returned by Attachment.Next once the
+	// conversation has ended and every message was delivered.
+	ErrConversationOver = errors.New("conversation is over")
+	// ErrSuperseded is returned by an Attachment once another
+	// client has attached to the same conversation.
+	ErrSuperseded = errors.New("another client attached to the conversation")
+	// ErrNotPrompting is returned by Attachment.Answer if the
+	// conversation is not waiting for input.
+	ErrNotPrompting = errors.New("conversation is not waiting for input")
+)
+
+const (
+	// defaultResumeWindow is how long a conversation is kept
+	// after its client goes away, unless PamSocket.ResumeWindow
+	// says otherwise.
+	defaultResumeWindow = 2 * time.Minute
+	// conversationTimeout bounds how long a conversation may
+	// take, whether or not a client is attached.
+	conversationTimeout = 15 * time.Minute
+)
+
+// isPrompt reports whether messages of the given type must be
+// answered by the client.
+func isPrompt(msgType string) bool {
+	switch msgType {
+	case "PromptEchoOff", "PromptEchoOn", "WebAuthnRegister", "WebAuthnAssert":
+		return true
+	}
+	return false
+}
+
+// Conversation is a PAM conversation (and WebAuthn step, if any)
+// that runs in the background, independently of the connection to
+// the client. A client interacts with it through an Attachment; if
+// the connection drops, the conversation is parked, and a new
+// connection may attach to it again, using its ID.
+type Conversation struct {
+	// ID identifies the conversation, so a client can resume
+	// it. Anybody who knows it can take over the conversation, so
+	// it must only ever be sent to the client.
+	ID string
+
+	mu sync.Mutex
+	// messages is every message sent to the client, in order.
+	messages []Message
+	// delivered is the number of messages delivered to a client.
+	delivered int
+	// prompt is the index in messages of the prompt awaiting an
+	// answer, or -1 if there is none.
+	prompt int
+	// changed is closed, and replaced, whenever the state above
+	// changes.
+	changed chan struct{}
+	// answers carries the answer to the pending prompt.
+	answers chan string
+	// aborted is closed when the conversation is abandoned, which
+	// aborts the PAM transaction.
+	aborted   chan struct{}
+	abortOnce sync.Once
+	// current is the attached client, if any.
+	current *Attachment
+	// park expires the conversation if no client attaches in
+	// time.
+	park     *time.Timer
+	window   time.Duration
+	deadline *time.Timer
+	// forget removes the conversation from its PamSocket.
+	forget func()
+	// query is the query string of the request that started the
+	// conversation.
+	query string
+
+	over     bool
+	identity *Identity
+	err      error
+}
+
+func newConversationID() string {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func newConversation(window time.Duration, forget func(*Conversation)) *Conversation {
+	c := &Conversation{
+		ID:      newConversationID(),
+		prompt:  -1,
+		changed: make(chan struct{}),
+		answers: make(chan string, 1),
+		aborted: make(chan struct{}),
+		window:  window,
+	}
+	c.forget = func() { forget(c) }
+	// Nobody is attached yet.
+	c.park = time.AfterFunc(window, c.expire)
+	c.deadline = time.AfterFunc(conversationTimeout, c.expire)
+	return c
+}
+
+// expire abandons the conversation.
+func (c *Conversation) expire() {
+	log.Info().Msg("Abandoning PAM conversation")
+	c.abortOnce.Do(func() { close(c.aborted) })
+	c.forget()
+}
+
+// broadcast wakes up everybody waiting for a change. c.mu must be
+// held.
+func (c *Conversation) broadcast() {
+	close(c.changed)
+	c.changed = make(chan struct{})
+}
+
+// send queues a message for the client.
+func (c *Conversation) send(msg Message) {
+	log.Info().Msgf("Sending %#v", msg)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.messages = append(c.messages, msg)
+	if isPrompt(msg.Type) {
+		c.prompt = len(c.messages) - 1
+	}
+	c.broadcast()
+}
+
+// ask sends a prompt to the client, and waits for its answer.
+func (c *Conversation) ask(msg Message) (string, error) {
+	c.send(msg)
+	select {
+	case answer := <-c.answers:
+		return answer, nil
+	case <-c.aborted:
+		return "", errClientGone
+	}
+}
+
+// respondPAM is the pam.ConversationHandler for the conversation. It
+// is called by the PAM transaction whenever PAM needs to interact
+// with the user, either to display a message, or request input.
+func (c *Conversation) respondPAM(style pam.Style, m string) (string, error) {
+	msg := Message{
+		Message: m,
+	}
+	switch style {
+	case pam.PromptEchoOff:
+		msg.Type = "PromptEchoOff"
+	case pam.PromptEchoOn:
+		msg.Type = "PromptEchoOn"
+	case pam.ErrorMsg:
+		msg.Type = "Error"
+	case pam.TextInfo:
+		msg.Type = "Info"
+	}
+	// A client response is only needed for prompts.
+	if isPrompt(msg.Type) {
+		return c.ask(msg)
+	}
+	c.send(msg)
+	return "", nil
+}
+
+// challenge sends a JSON-encoded payload to the client as a message
+// of the given type, and waits for the client's response.
+func (c *Conversation) challenge(msgType string, payload interface{}) (string, error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return "", err
+	}
+	return c.ask(Message{
+		Type:    msgType,
+		Message: string(data),
+	})
+}
+
+// finish records the outcome of the conversation.
+func (c *Conversation) finish(identity *Identity, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.over = true
+	c.identity = identity
+	c.err = err
+	c.prompt = -1
+	c.deadline.Stop()
+	c.broadcast()
+}
+
+// Result returns the outcome of the conversation, once
+// Attachment.Next has returned ErrConversationOver.
+func (c *Conversation) Result() (*Identity, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.over {
+		return nil, errors.New("conversation is still in progress")
+	}
+	return c.identity, c.err
+}
+
+// Attach connects a client to the conversation, detaching any
+// previous one. The client first receives the pending prompt again,
+// if there is one, followed by any messages not yet delivered.
+func (c *Conversation) Attach() *Attachment {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.current != nil {
+		close(c.current.superseded)
+	}
+	a := &Attachment{
+		c:          c,
+		superseded: make(chan struct{}),
+		next:       c.delivered,
+	}
+	if c.prompt >= 0 && c.prompt < a.next {
+		a.next = c.prompt
+	}
+	c.current = a
+	c.park.Stop()
+	return a
+}
+
+// Attachment is a client's connection to a Conversation. Only the
+// most recent attachment of a conversation may use it.
+type Attachment struct {
+	c          *Conversation
+	superseded chan struct{}
+	// next is the index of the next message to deliver.
+	next int
+}
+
+// Next waits for the next message for the client.
+func (a *Attachment) Next(ctx context.Context) (Message, error) {
+	c := a.c
+	for {
+		c.mu.Lock()
+		if c.current != a {
+			c.mu.Unlock()
+			return Message{}, ErrSuperseded
+		}
+		if a.next < len(c.messages) {
+			msg := c.messages[a.next]
+			a.next++
+			c.delivered = max(c.delivered, a.next)
+			c.mu.Unlock()
+			return msg, nil
+		}
+		if c.over {
+			c.mu.Unlock()
+			return Message{}, ErrConversationOver
+		}
+		changed := c.changed
+		c.mu.Unlock()
+
+		select {
+		case <-changed:
+		case <-a.superseded:
+			return Message{}, ErrSuperseded
+		case <-ctx.Done():
+			return Message{}, ctx.Err()
+		}
+	}
+}
+
+// Answer answers the pending prompt, which must already have been
+// delivered to this attachment.
+func (a *Attachment) Answer(input string) error {
+	c := a.c
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.current != a {
+		return ErrSuperseded
+	}
+	return c.answer(input, a.next)
+}
+
+// Answer answers the pending prompt, which must already have been
+// delivered to a client. It is for transports that receive answers
+// separately from the attachment delivering messages.
+func (c *Conversation) Answer(input string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.answer(input, c.delivered)
+}
+
+// answer answers the pending prompt, if it is among the first
+// delivered messages. c.mu must be held.
+func (c *Conversation) answer(input string, delivered int) error {
+	if c.prompt < 0 || c.prompt >= delivered {
+		return ErrNotPrompting
+	}
+	c.prompt = -1
+	c.answers <- input
+	c.broadcast()
+	return nil
+}
+
+// Detach disconnects the client. Unless another client attaches
+// within the resume window, the conversation is abandoned.
+func (a *Attachment) Detach() {
+	c := a.c
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.current != a {
+		return
+	}
+	c.current = nil
+	c.park.Reset(c.window)
+}
@@ -0,0 +1,90 @@
+package pamsocket
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+func dialConversation(t *testing.T, s *server, query string) *websocket.Conn {
+	d := &websocket.Dialer{}
+	conn, _, err := d.Dial("ws://localhost:"+fmt.Sprint(s.s.port)+"/ws"+query, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func expect(t *testing.T, conn *websocket.Conn, msgType string) Message {
+	t.Helper()
+	msg := Message{}
+	if err := conn.ReadJSON(&msg); err != nil {
+		t.Fatal(err)
+	}
+	if msg.Type != msgType {
+		t.Fatalf("got %#v, want a %s message", msg, msgType)
+	}
+	return msg
+}
+
+func TestResumeConversation(t *testing.T) {
+	s := &server{
+		s: makeSocket(),
+		ws: &PamSocket{
+			Authenticator: echoAuthenticator{},
+			Flow:          &NoopFlow{},
+		},
+	}
+	go http.Serve(s.s.listener, s.ws)
+
+	conn := dialConversation(t, s, "")
+	id := expect(t, conn, "Resume").Message
+	expect(t, conn, "PromptEchoOn")
+	// The connection drops before the prompt is answered.
+	conn.Close()
+
+	conn = dialConversation(t, s, "?resume="+id)
+	expect(t, conn, "PromptEchoOn")
+	conn.WriteJSON(fromClient{Input: "root"})
+	if got := expect(t, conn, "Redirect").Message; got != "/consent" {
+		t.Errorf("redirected to %q, want /consent", got)
+	}
+
+	// A finished conversation cannot be resumed.
+	conn = dialConversation(t, s, "?resume="+id)
+	expect(t, conn, "Error")
+}
+
+// challengeFlow redirects to the login_challenge it is finished with.
+type challengeFlow struct{ NoopFlow }
+
+func (*challengeFlow) Authenticated(r *http.Request, _ string, _ map[string]string) (string, error) {
+	return "/" + r.URL.Query().Get("login_challenge"), nil
+}
+
+func TestResumeKeepsChallenge(t *testing.T) {
+	s := &server{
+		s: makeSocket(),
+		ws: &PamSocket{
+			Authenticator: echoAuthenticator{},
+			Flow:          &challengeFlow{},
+		},
+	}
+	go http.Serve(s.s.listener, s.ws)
+
+	conn := dialConversation(t, s, "?login_challenge=mine")
+	id := expect(t, conn, "Resume").Message
+	expect(t, conn, "PromptEchoOn")
+	conn.Close()
+
+	// Resuming with another challenge must not finish that one.
+	conn = dialConversation(t, s, "?resume="+id+"&login_challenge=theirs")
+	expect(t, conn, "PromptEchoOn")
+	conn.WriteJSON(fromClient{Input: "root"})
+	if got := expect(t, conn, "Redirect").Message; got != "/mine" {
+		t.Errorf("redirected to %q, want /mine", got)
+	}
+}
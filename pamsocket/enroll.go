@@ -0,0 +1,169 @@
+package pamsocket
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// GoogleAuthenticatorFile is the file pam_google_authenticator reads
+// from the user's home directory by default.
+const GoogleAuthenticatorFile = ".google_authenticator"
+
+// Enroller writes users' pam_google_authenticator configuration,
+// which needs the privileges to write into their home directories.
+type Enroller interface {
+	// Enrolled reports whether the user has a configuration.
+	Enrolled(username string) (bool, error)
+	// Enroll writes the configuration into the user's home
+	// directory, readable only by the user. An existing
+	// configuration is never replaced, as that would let anyone
+	// who knows the password alone replace the second factor;
+	// an error wrapping os.ErrExist is returned instead. token is
+	// the Identity.EnrollToken of the user's sign-in, which
+	// enrollers that do not trust their caller require.
+	Enroll(username, token string, config []byte) error
+}
+
+// LocalEnroller writes configurations from the calling process, which
+// must be able to write into users' home directories (i.e., root). It
+// trusts its caller to have authenticated the user, so ignores the
+// token.
+type LocalEnroller struct{}
+
+func (LocalEnroller) Enrolled(username string) (bool, error) {
+	userinfo, err := user.Lookup(username)
+	if err != nil {
+		return false, err
+	}
+	_, err = os.Lstat(filepath.Join(userinfo.HomeDir, GoogleAuthenticatorFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (LocalEnroller) Enroll(username, _ string, config []byte) error {
+	userinfo, err := user.Lookup(username)
+	if err != nil {
+		return err
+	}
+	uid, err := strconv.Atoi(userinfo.Uid)
+	if err != nil {
+		return err
+	}
+	gid, err := strconv.Atoi(userinfo.Gid)
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(userinfo.HomeDir, GoogleAuthenticatorFile)
+	// The home directory is controlled by the user, so refuse to
+	// follow a symlink planted in place of the file.
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL|syscall.O_NOFOLLOW, 0400)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(config); err != nil {
+		f.Close()
+		os.Remove(path)
+		return err
+	}
+	if err := f.Chown(uid, gid); err != nil {
+		f.Close()
+		os.Remove(path)
+		return err
+	}
+	return f.Close()
+}
+
+// HelperEnroller asks a Helper listening on a UNIX socket to write
+// configurations, so this process needs no special privileges. The
+// Helper only enrolls users who authenticated through it, within
+// EnrollTokenLifetime, so a compromised client cannot plant one-time
+// codes for anyone else. Enroll fails with ErrAuthenticationFailed
+// otherwise.
+type HelperEnroller struct {
+	// Socket is the path of the helper's UNIX socket.
+	Socket string
+}
+
+// call sends a single request to the helper, and returns its answer.
+func (h *HelperEnroller) call(req helperRequest) (*helperMessage, error) {
+	conn, err := net.Dial("unix", h.Socket)
+	if err != nil {
+		return nil, fmt.Errorf("cannot reach PAM helper: %w", err)
+	}
+	defer conn.Close()
+	return exchange(conn, req)
+}
+
+func (h *HelperEnroller) Enrolled(username string) (bool, error) {
+	msg, err := h.call(helperRequest{Op: "enrolled", User: username})
+	if err != nil {
+		return false, err
+	}
+	return msg.Enrolled, nil
+}
+
+func (h *HelperEnroller) Enroll(username, token string, config []byte) error {
+	_, err := h.call(helperRequest{Op: "enroll", User: username, Token: token, Config: config})
+	return err
+}
+
+// EnrollTokenLifetime is how long after authenticating users may
+// enroll through a Helper.
+const EnrollTokenLifetime = time.Hour
+
+// enrollTokens issues and checks the tokens proving to a Helper that
+// users authenticated through it. They are signed with a key only the
+// Helper knows, which changes whenever it restarts.
+type enrollTokens struct {
+	once sync.Once
+	key  []byte
+}
+
+func (e *enrollTokens) mac(username string, expires uint64) []byte {
+	e.once.Do(func() {
+		e.key = make([]byte, 32)
+		if _, err := rand.Read(e.key); err != nil {
+			panic(err)
+		}
+	})
+	m := hmac.New(sha256.New, e.key)
+	m.Write(binary.BigEndian.AppendUint64(nil, expires))
+	m.Write([]byte(username))
+	return m.Sum(nil)
+}
+
+// issue returns a token for the user, valid for EnrollTokenLifetime.
+func (e *enrollTokens) issue(username string) string {
+	expires := uint64(time.Now().Add(EnrollTokenLifetime).Unix())
+	token := binary.BigEndian.AppendUint64(nil, expires)
+	return base64.RawURLEncoding.EncodeToString(append(token, e.mac(username, expires)...))
+}
+
+// valid reports whether the token was issued for the user, and has
+// not expired.
+func (e *enrollTokens) valid(username, token string) bool {
+	data, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil || len(data) != 8+sha256.Size {
+		return false
+	}
+	expires := binary.BigEndian.Uint64(data)
+	if time.Now().Unix() > int64(expires) {
+		return false
+	}
+	return hmac.Equal(data[8:], e.mac(username, expires))
+}
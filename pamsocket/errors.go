@@ -0,0 +1,54 @@
+package pamsocket
+
+import (
+	"errors"
+	"expvar"
+
+	"github.com/rs/zerolog/log"
+)
+
+// errorCount counts conversations that ended with an internal error,
+// keyed by where the error occurred, and is published via expvar.
+var errorCount = expvar.NewMap("pamsocket_errors")
+
+// errClientGone is returned to PAM when the client disconnects while
+// PAM is waiting for an answer, and does not resume in time, aborting
+// the transaction.
+var errClientGone = errors.New("client went away")
+
+// internalError is an error that is not the user's fault, such as
+// PAM or the LoginFlow failing. kind names where it occurred, for
+// metrics.
+type internalError struct {
+	kind string
+	err  error
+}
+
+func (e *internalError) Error() string { return e.err.Error() }
+
+func (e *internalError) Unwrap() error { return e.err }
+
+// report logs err, and counts it in the metrics if it is an internal
+// error. The rest of the server is unaffected.
+func report(err error) {
+	var ie *internalError
+	if errors.As(err, &ie) {
+		errorCount.Add(ie.kind, 1)
+		log.Error().Err(ie.err).Str("kind", ie.kind).Msg("PAM conversation failed")
+		return
+	}
+	log.Info().Err(err).Msg("PAM conversation failed")
+}
+
+// UserMessage returns what to tell the user about an error from a
+// Conversation, without exposing any details of internal errors.
+func UserMessage(err error) string {
+	switch {
+	case errors.Is(err, ErrAuthenticationFailed):
+		return "Authentication failed."
+	case errors.Is(err, errClientGone):
+		return "This sign-in has expired. Please start over."
+	default:
+		return "Internal error"
+	}
+}
@@ -0,0 +1,181 @@
+package pamsocket
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// keepaliveInterval is how often an idle event stream sends a
+// comment, so proxies do not time it out.
+const keepaliveInterval = 30 * time.Second
+
+// maxAnswerSize bounds the size of an answer POSTed to an
+// EventSource. WebAuthn responses are the largest answers.
+const maxAnswerSize = 64 << 10
+
+// eventAnswer answers the pending prompt of a conversation.
+type eventAnswer struct {
+	// Conversation is the ID of the conversation, as sent in its
+	// `Resume` message.
+	Conversation string
+	// The input data from the client.
+	Input string
+}
+
+// EventSource carries the conversations of a PamSocket over plain
+// HTTP, for clients behind proxies that do not pass WebSockets
+// through. A GET starts (or, with the `resume` query parameter or a
+// `Last-Event-ID` header, resumes) a conversation, and streams its
+// messages as Server-Sent Events. The last message is sent as a
+// `final` event, after which the client should not reconnect. Each
+// prompt is answered by POSTing a JSON-encoded eventAnswer.
+type EventSource struct {
+	// Socket runs the conversations, and may also serve them over
+	// a WebSocket.
+	Socket *PamSocket
+}
+
+func (e *EventSource) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost {
+		e.answer(w, r)
+		return
+	}
+	e.stream(w, r)
+}
+
+func (e *EventSource) answer(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxAnswerSize))
+	msg := eventAnswer{}
+	if err == nil {
+		err = json.Unmarshal(body, &msg)
+	}
+	if err != nil {
+		http.Error(w, "Malformed answer", http.StatusBadRequest)
+		return
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	if e.Socket.Forward(w, r, msg.Conversation) {
+		return
+	}
+	c := e.Socket.Resume(msg.Conversation)
+	if c == nil {
+		http.Error(w, UserMessage(errClientGone), http.StatusNotFound)
+		return
+	}
+	if err := c.Answer(msg.Input); err != nil {
+		log.Info().Err(err).Msg("Ignoring input from client")
+		http.Error(w, "Not waiting for input", http.StatusConflict)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// writeEvent writes a message as a Server-Sent Event. Every event
+// carries the conversation ID, which the client sends back as
+// `Last-Event-ID` when it reconnects.
+func writeEvent(w http.ResponseWriter, id, event string, msg Message) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	if id != "" {
+		if _, err := fmt.Fprintf(w, "id: %s\n", id); err != nil {
+			return err
+		}
+	}
+	if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, data); err != nil {
+		return err
+	}
+	w.(http.Flusher).Flush()
+	return nil
+}
+
+func (e *EventSource) stream(w http.ResponseWriter, r *http.Request) {
+	id := r.URL.Query().Get("resume")
+	if id == "" {
+		id = r.Header.Get("Last-Event-ID")
+	}
+	if e.Socket.Forward(w, r, id) {
+		return
+	}
+	if _, ok := w.(http.Flusher); !ok {
+		http.Error(w, "Streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	// Stop nginx from buffering the stream.
+	w.Header().Set("X-Accel-Buffering", "no")
+
+	p := e.Socket
+	var c *Conversation
+	if id != "" {
+		c = p.Resume(id)
+		if c == nil {
+			writeEvent(w, "", "final", Message{Type: "Error", Message: UserMessage(errClientGone)})
+			return
+		}
+		log.Info().Msg("Resuming PAM conversation")
+	} else {
+		var redirect string
+		var err error
+		c, redirect, err = p.Start(r)
+		if err != nil {
+			report(err)
+			writeEvent(w, "", "final", Message{Type: "Error", Message: UserMessage(err)})
+			return
+		}
+		if redirect != "" {
+			writeEvent(w, "", "final", Message{Type: "Redirect", Message: redirect})
+			return
+		}
+		if err := writeEvent(w, c.ID, "message", Message{Type: "Resume", Message: c.ID}); err != nil {
+			return
+		}
+	}
+
+	a := c.Attach()
+	// If the client goes away, the conversation is parked until it
+	// resumes.
+	defer a.Detach()
+	for {
+		ctx, cancel := context.WithTimeout(r.Context(), keepaliveInterval)
+		msg, err := a.Next(ctx)
+		cancel()
+		if errors.Is(err, ErrConversationOver) {
+			break
+		}
+		if errors.Is(err, context.DeadlineExceeded) && r.Context().Err() == nil {
+			if _, err := fmt.Fprint(w, ": keepalive\n\n"); err != nil {
+				return
+			}
+			w.(http.Flusher).Flush()
+			continue
+		}
+		if err != nil {
+			log.Info().Err(err).Msg("Client detached from PAM conversation")
+			return
+		}
+		if err := writeEvent(w, c.ID, "message", msg); err != nil {
+			log.Info().Err(err).Msg("Could not send event")
+			return
+		}
+	}
+
+	redirect, err := p.Finish(r, c)
+	if err != nil {
+		log.Info().Err(err).Msg("Could not authenticate user")
+		writeEvent(w, c.ID, "final", Message{Type: "Error", Message: UserMessage(err)})
+		return
+	}
+	writeEvent(w, c.ID, "final", Message{Type: "Redirect", Message: redirect})
+	log.Info().Msg("Sent redirect")
+}
@@ -0,0 +1,81 @@
+package pamsocket
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// readEvent reads the next Server-Sent Event, skipping comments.
+func readEvent(t *testing.T, r *bufio.Reader) (string, Message) {
+	t.Helper()
+	event := ""
+	msg := Message{}
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case line == "" && event != "":
+			return event, msg
+		case strings.HasPrefix(line, "event: "):
+			event = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &msg); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+}
+
+func TestEventSource(t *testing.T) {
+	ts := httptest.NewServer(&EventSource{
+		Socket: &PamSocket{
+			Authenticator: echoAuthenticator{},
+			Flow:          &NoopFlow{},
+		},
+	})
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	events := bufio.NewReader(resp.Body)
+
+	_, msg := readEvent(t, events)
+	if msg.Type != "Resume" {
+		t.Fatalf("got %#v, want a Resume message", msg)
+	}
+	id := msg.Message
+	if _, msg = readEvent(t, events); msg.Type != "PromptEchoOn" {
+		t.Fatalf("got %#v, want a prompt", msg)
+	}
+
+	post := func(id, input string) int {
+		body, _ := json.Marshal(eventAnswer{Conversation: id, Input: input})
+		resp, err := http.Post(ts.URL, "application/json", strings.NewReader(string(body)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if status := post("bogus", "root"); status != http.StatusNotFound {
+		t.Errorf("answering an unknown conversation returned %d", status)
+	}
+	if status := post(id, "root"); status != http.StatusNoContent {
+		t.Fatalf("answering returned %d", status)
+	}
+
+	event, msg := readEvent(t, events)
+	if event != "final" || msg.Type != "Redirect" || msg.Message != "/consent" {
+		t.Errorf("got %s event %#v, want a final redirect to /consent", event, msg)
+	}
+}
@@ -0,0 +1,299 @@
+package pamsocket
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"slices"
+	"time"
+
+	"github.com/msteinert/pam/v2"
+	"github.com/rs/zerolog/log"
+)
+
+// The helper protocol lets an unprivileged process run PAM
+// transactions in a separate, privileged, process. Each transaction
+// uses its own stream: the client sends a helperRequest, after which
+// the helper sends helperMessages, answering each `Prompt` with a
+// helperAnswer, until a final `Result` or `Error`. Streams may
+// instead carry a single request to an Enroller, answered by `Done`
+// or `Error`.
+
+// helperRequest starts a PAM transaction.
+type helperRequest struct {
+	// Op is empty for a PAM transaction, `enrolled` to ask
+	// whether User is enrolled, or `enroll` to enroll User with
+	// Config, given the Token of their authentication.
+	Op      string `json:",omitempty"`
+	Service string
+	User    string
+	Items   map[pam.Item]string
+	Claims  map[string]ClaimSource
+	Config  []byte `json:",omitempty"`
+	Token   string `json:",omitempty"`
+}
+
+// helperMessage is sent from the helper to the client.
+type helperMessage struct {
+	// Type is one of `Prompt`, which carries Style and Message
+	// and must be answered, `Result`, which carries Result,
+	// `Done`, which carries Enrolled, or `Error`, which carries
+	// Message, AuthFailed and Exists.
+	Type       string
+	Style      pam.Style   `json:",omitempty"`
+	Message    string      `json:",omitempty"`
+	Result     *AuthResult `json:",omitempty"`
+	AuthFailed bool        `json:",omitempty"`
+	Enrolled   bool        `json:",omitempty"`
+	Exists     bool        `json:",omitempty"`
+}
+
+// helperAnswer answers a `Prompt`.
+type helperAnswer struct {
+	Input string
+	// Error, if set, indicates the client could not obtain an
+	// answer (e.g., the user went away), and the transaction
+	// should be aborted.
+	Error string `json:",omitempty"`
+}
+
+// helperTimeout bounds how long a single transaction may take,
+// including the time the user spends answering prompts.
+const helperTimeout = 10 * time.Minute
+
+// helperConversation relays PAM conversation messages over a helper
+// stream.
+type helperConversation struct {
+	enc *json.Encoder
+	dec *json.Decoder
+}
+
+func (h *helperConversation) RespondPAM(style pam.Style, m string) (string, error) {
+	if err := h.enc.Encode(helperMessage{
+		Type:    "Prompt",
+		Style:   style,
+		Message: m,
+	}); err != nil {
+		return "", err
+	}
+	answer := helperAnswer{}
+	if err := h.dec.Decode(&answer); err != nil {
+		return "", err
+	}
+	if answer.Error != "" {
+		return "", errors.New(answer.Error)
+	}
+	return answer.Input, nil
+}
+
+// Helper serves PAM transactions to clients such as
+// HelperAuthenticator, so that only the helper needs the privileges
+// PAM modules require (e.g., to read /etc/shadow).
+type Helper struct {
+	// Authenticator runs the PAM transactions, typically a
+	// LocalAuthenticator.
+	Authenticator Authenticator
+	// Services are the PAM services clients may use. No others
+	// may be, unless AnyService is set.
+	Services []string
+	// AnyService lets clients use any PAM service, for helpers
+	// whose only client is the process that started them.
+	AnyService bool
+	// Enroller, if set, lets clients enroll users in one-time
+	// codes, once they authenticated through the helper.
+	Enroller Enroller
+
+	tokens enrollTokens
+}
+
+// Serve handles helper connections on l until it fails.
+func (h *Helper) Serve(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go h.ServeConn(conn)
+	}
+}
+
+// ServeConn runs a single PAM transaction over conn, and closes it.
+func (h *Helper) ServeConn(conn io.ReadWriteCloser) {
+	defer conn.Close()
+	if c, ok := conn.(net.Conn); ok {
+		c.SetDeadline(time.Now().Add(helperTimeout))
+	}
+	enc := json.NewEncoder(conn)
+	dec := json.NewDecoder(conn)
+
+	req := helperRequest{}
+	if err := dec.Decode(&req); err != nil {
+		log.Error().Err(err).Msg("Could not read helper request")
+		return
+	}
+	if req.Op != "" {
+		h.serveEnroll(enc, &req)
+		return
+	}
+	if !h.AnyService && !slices.Contains(h.Services, req.Service) {
+		log.Warn().Msgf("Refusing PAM service %q", req.Service)
+		enc.Encode(helperMessage{
+			Type:    "Error",
+			Message: fmt.Sprintf("PAM service %q is not permitted", req.Service),
+		})
+		return
+	}
+
+	result, err := h.Authenticator.Authenticate(&AuthRequest{
+		Service: req.Service,
+		User:    req.User,
+		Items:   req.Items,
+		Claims:  req.Claims,
+	}, &helperConversation{enc: enc, dec: dec})
+	if err != nil {
+		enc.Encode(helperMessage{
+			Type:       "Error",
+			Message:    err.Error(),
+			AuthFailed: errors.Is(err, ErrAuthenticationFailed),
+		})
+		return
+	}
+	if h.Enroller != nil {
+		result.EnrollToken = h.tokens.issue(result.Username)
+	}
+	enc.Encode(helperMessage{
+		Type:   "Result",
+		Result: result,
+	})
+}
+
+// serveEnroll answers a request for the Enroller.
+func (h *Helper) serveEnroll(enc *json.Encoder, req *helperRequest) {
+	if h.Enroller == nil {
+		log.Warn().Msgf("Refusing %s request, as enrollment is not enabled", req.Op)
+		enc.Encode(helperMessage{Type: "Error", Message: "enrollment is not enabled in the PAM helper"})
+		return
+	}
+	var err error
+	msg := helperMessage{Type: "Done"}
+	switch req.Op {
+	case "enrolled":
+		msg.Enrolled, err = h.Enroller.Enrolled(req.User)
+	case "enroll":
+		// Without this, whoever can reach the socket could
+		// enroll anyone who has not yet, root included.
+		if !h.tokens.valid(req.User, req.Token) {
+			log.Warn().Msgf("Refusing to enroll %q without a valid token", req.User)
+			enc.Encode(helperMessage{
+				Type:       "Error",
+				Message:    fmt.Sprintf("%q has not recently authenticated", req.User),
+				AuthFailed: true,
+			})
+			return
+		}
+		err = h.Enroller.Enroll(req.User, req.Token, req.Config)
+		if err == nil {
+			log.Info().Msgf("Enrolled %q in one-time codes", req.User)
+		}
+	default:
+		err = fmt.Errorf("unknown request %q", req.Op)
+	}
+	if err != nil {
+		msg = helperMessage{
+			Type:    "Error",
+			Message: err.Error(),
+			Exists:  errors.Is(err, os.ErrExist),
+		}
+	}
+	enc.Encode(msg)
+}
+
+// exchange sends a request other than a PAM transaction over rw, and
+// returns the helper's answer.
+func exchange(rw io.ReadWriter, req helperRequest) (*helperMessage, error) {
+	if err := json.NewEncoder(rw).Encode(req); err != nil {
+		return nil, err
+	}
+	msg := &helperMessage{}
+	if err := json.NewDecoder(rw).Decode(msg); err != nil {
+		return nil, fmt.Errorf("PAM helper went away: %w", err)
+	}
+	switch msg.Type {
+	case "Done":
+		return msg, nil
+	case "Error":
+		if msg.Exists {
+			return nil, fmt.Errorf("%w: %s", os.ErrExist, msg.Message)
+		}
+		if msg.AuthFailed {
+			return nil, fmt.Errorf("%w: %s", ErrAuthenticationFailed, msg.Message)
+		}
+		return nil, errors.New(msg.Message)
+	default:
+		return nil, fmt.Errorf("PAM helper sent unknown message %q", msg.Type)
+	}
+}
+
+// converse runs the client side of the helper protocol over rw.
+func converse(rw io.ReadWriter, req *AuthRequest, conv pam.ConversationHandler) (*AuthResult, error) {
+	enc := json.NewEncoder(rw)
+	dec := json.NewDecoder(rw)
+	if err := enc.Encode(helperRequest{
+		Service: req.Service,
+		User:    req.User,
+		Items:   req.Items,
+		Claims:  req.Claims,
+	}); err != nil {
+		return nil, err
+	}
+	for {
+		msg := helperMessage{}
+		if err := dec.Decode(&msg); err != nil {
+			return nil, fmt.Errorf("PAM helper went away: %w", err)
+		}
+		switch msg.Type {
+		case "Prompt":
+			answer := helperAnswer{}
+			input, err := conv.RespondPAM(msg.Style, msg.Message)
+			if err != nil {
+				answer.Error = err.Error()
+			} else {
+				answer.Input = input
+			}
+			if err := enc.Encode(answer); err != nil {
+				return nil, err
+			}
+		case "Result":
+			if msg.Result == nil {
+				return nil, errors.New("PAM helper sent an empty result")
+			}
+			return msg.Result, nil
+		case "Error":
+			if msg.AuthFailed {
+				return nil, fmt.Errorf("%w: %s", ErrAuthenticationFailed, msg.Message)
+			}
+			return nil, errors.New(msg.Message)
+		default:
+			return nil, fmt.Errorf("PAM helper sent unknown message %q", msg.Type)
+		}
+	}
+}
+
+// HelperAuthenticator runs PAM transactions in a Helper listening on
+// a UNIX socket, so this process needs no special privileges.
+type HelperAuthenticator struct {
+	// Socket is the path of the helper's UNIX socket.
+	Socket string
+}
+
+func (h *HelperAuthenticator) Authenticate(req *AuthRequest, conv pam.ConversationHandler) (*AuthResult, error) {
+	conn, err := net.Dial("unix", h.Socket)
+	if err != nil {
+		return nil, fmt.Errorf("cannot reach PAM helper: %w", err)
+	}
+	defer conn.Close()
+	return converse(conn, req, conv)
+}
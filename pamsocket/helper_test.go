@@ -0,0 +1,204 @@
+package pamsocket
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/msteinert/pam/v2"
+)
+
+// echoAuthenticator authenticates whoever answers its prompt, unless
+// they answer "nobody".
+type echoAuthenticator struct{}
+
+func (echoAuthenticator) Authenticate(req *AuthRequest, conv pam.ConversationHandler) (*AuthResult, error) {
+	username, err := conv.RespondPAM(pam.PromptEchoOn, "login:")
+	if err != nil {
+		return nil, err
+	}
+	if username == "nobody" {
+		return nil, ErrAuthenticationFailed
+	}
+	return &AuthResult{
+		Username: username,
+		Claims:   map[string]string{"rhost": req.Items[pam.Rhost]},
+	}, nil
+}
+
+func startHelper(t *testing.T) *HelperAuthenticator {
+	socket := filepath.Join(t.TempDir(), "helper.sock")
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	helper := &Helper{
+		Authenticator: echoAuthenticator{},
+		Services:      []string{"allowed"},
+	}
+	go helper.Serve(l)
+	return &HelperAuthenticator{Socket: socket}
+}
+
+func answer(input string) pam.ConversationFunc {
+	return func(style pam.Style, msg string) (string, error) {
+		if style != pam.PromptEchoOn || msg != "login:" {
+			return "", errors.New("unexpected prompt")
+		}
+		return input, nil
+	}
+}
+
+func TestHelperAuthenticator(t *testing.T) {
+	auth := startHelper(t)
+	result, err := auth.Authenticate(&AuthRequest{
+		Service: "allowed",
+		Items:   map[pam.Item]string{pam.Rhost: "192.0.2.1"},
+	}, answer("alice"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Username != "alice" || result.Claims["rhost"] != "192.0.2.1" {
+		t.Fatalf("Unexpected result %#v", result)
+	}
+}
+
+func TestHelperAuthenticatorFailure(t *testing.T) {
+	auth := startHelper(t)
+	_, err := auth.Authenticate(&AuthRequest{Service: "allowed"}, answer("nobody"))
+	if !errors.Is(err, ErrAuthenticationFailed) {
+		t.Fatalf("Expected authentication failure, got %v", err)
+	}
+}
+
+func TestHelperAuthenticatorService(t *testing.T) {
+	auth := startHelper(t)
+	_, err := auth.Authenticate(&AuthRequest{Service: "passwd"}, answer("alice"))
+	if err == nil || errors.Is(err, ErrAuthenticationFailed) {
+		t.Fatalf("Expected the service to be refused, got %v", err)
+	}
+}
+
+func TestHelperRefusesUnlistedServices(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "helper.sock")
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go (&Helper{Authenticator: echoAuthenticator{}}).Serve(l)
+	auth := &HelperAuthenticator{Socket: socket}
+	if _, err := auth.Authenticate(&AuthRequest{Service: "login"}, answer("alice")); err == nil || errors.Is(err, ErrAuthenticationFailed) {
+		t.Fatalf("Expected a helper without services to refuse them all, got %v", err)
+	}
+}
+
+// mapEnroller keeps configurations in memory.
+type mapEnroller map[string][]byte
+
+func (m mapEnroller) Enrolled(username string) (bool, error) {
+	_, ok := m[username]
+	return ok, nil
+}
+
+func (m mapEnroller) Enroll(username, _ string, config []byte) error {
+	if _, ok := m[username]; ok {
+		return os.ErrExist
+	}
+	m[username] = config
+	return nil
+}
+
+func TestHelperEnroller(t *testing.T) {
+	for _, enabled := range []bool{true, false} {
+		socket := filepath.Join(t.TempDir(), "helper.sock")
+		l, err := net.Listen("unix", socket)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer l.Close()
+		helper := &Helper{Authenticator: echoAuthenticator{}, Services: []string{"allowed"}}
+		configs := mapEnroller{}
+		if enabled {
+			helper.Enroller = configs
+		}
+		go helper.Serve(l)
+		auth := &HelperAuthenticator{Socket: socket}
+		enroller := &HelperEnroller{Socket: socket}
+		result, err := auth.Authenticate(&AuthRequest{Service: "allowed"}, answer("alice"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !enabled {
+			if result.EnrollToken != "" {
+				t.Error("Helper that does not enroll issued a token")
+			}
+			if err := enroller.Enroll("alice", result.EnrollToken, []byte("SECRET\n")); err == nil {
+				t.Error("Expected enrollment to be refused")
+			}
+			continue
+		}
+		if enrolled, err := enroller.Enrolled("alice"); err != nil || enrolled {
+			t.Errorf("Enrolled() = %v, %v before enrolling", enrolled, err)
+		}
+		// Only the user who authenticated may be enrolled.
+		for _, tc := range []struct{ user, token string }{
+			{"alice", ""},
+			{"alice", "garbage"},
+			{"root", result.EnrollToken},
+		} {
+			if err := enroller.Enroll(tc.user, tc.token, []byte("PLANTED\n")); !errors.Is(err, ErrAuthenticationFailed) {
+				t.Errorf("got %v enrolling %s with token %q, want ErrAuthenticationFailed", err, tc.user, tc.token)
+			}
+		}
+		if len(configs) != 0 {
+			t.Fatalf("Enrolled %v without proof", configs)
+		}
+
+		if err := enroller.Enroll("alice", result.EnrollToken, []byte("SECRET\n")); err != nil {
+			t.Fatal(err)
+		}
+		if string(configs["alice"]) != "SECRET\n" {
+			t.Errorf("got configuration %q", configs["alice"])
+		}
+		if enrolled, err := enroller.Enrolled("alice"); err != nil || !enrolled {
+			t.Errorf("Enrolled() = %v, %v after enrolling", enrolled, err)
+		}
+		if err := enroller.Enroll("alice", result.EnrollToken, []byte("OTHER\n")); !errors.Is(err, os.ErrExist) {
+			t.Errorf("got %v enrolling again, want os.ErrExist", err)
+		}
+	}
+}
+
+func TestEnrollTokens(t *testing.T) {
+	tokens := &enrollTokens{}
+	token := tokens.issue("alice")
+	if !tokens.valid("alice", token) {
+		t.Error("Token was not valid for its user")
+	}
+	if tokens.valid("bob", token) {
+		t.Error("Token was valid for another user")
+	}
+	if (&enrollTokens{}).valid("alice", token) {
+		t.Error("Token was valid for another helper")
+	}
+
+	data, _ := base64.RawURLEncoding.DecodeString(token)
+	expired := uint64(time.Now().Add(-time.Minute).Unix())
+	data = append(binary.BigEndian.AppendUint64(nil, expired), tokens.mac("alice", expired)...)
+	if tokens.valid("alice", base64.RawURLEncoding.EncodeToString(data)) {
+		t.Error("Expired token was valid")
+	}
+	later := uint64(time.Now().Add(24 * time.Hour).Unix())
+	data = append(binary.BigEndian.AppendUint64(nil, later), data[8:]...)
+	if tokens.valid("alice", base64.RawURLEncoding.EncodeToString(data)) {
+		t.Error("Token with a later expiry was valid")
+	}
+}
@@ -2,8 +2,15 @@ package pamsocket
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"net/http"
+	"net/netip"
+	"net/url"
 	"os/user"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/gorilla/websocket"
 	"github.com/msteinert/pam/v2"
@@ -11,25 +18,63 @@ import (
 )
 
 // fromClient is a message sent from the client over the
-// websocket to this server.
+// websocket to this server, answering the pending prompt.
 type fromClient struct {
 	// The input data from the client.
 	Input string
 }
 
-type toClient struct {
+// Message is a message sent from this server to the client.
+type Message struct {
 	// Type indicates the type of message this is. It will be one
 	// of either `PromptEchoOff` requesting user input (e.g., a
 	// password), `PromptEchoOn` requesting user input (e.g., a
 	// username), `Error`, containing an error string, `Info`,
-	// containing an informational message, or `Redirect`,
-	// containing a URL to navigate to next.
+	// containing an informational message, `Redirect`,
+	// containing a URL to navigate to next, or `Username` or
+	// `UsernameFixed`, containing the username the conversation
+	// was started with. A `Username` may be discarded by
+	// reconnecting with the `ignore_hint=1` query parameter; a
+	// `UsernameFixed` may not. If a WebAuthn step is configured,
+	// `WebAuthnRegister` and `WebAuthnAssert` carry JSON-encoded
+	// credential creation and request options, and the client
+	// responds with the JSON-encoded credential. `Resume`
+	// carries the ID of the conversation, which lets the client
+	// reconnect with the `resume` query parameter if the
+	// connection drops, and pick up where it left off.
 	Type string
 	// message is the actual payload. What to do with it depends
 	// on the value of Type.
 	Message string
 }
 
+// LoginInfo describes how a sign-in should proceed, as determined by
+// LoginFlow.PreLogin.
+type LoginInfo struct {
+	// If set, Redirect contains the URL to redirect to
+	// immediately. No sign-in is needed.
+	Redirect string
+	// Username, if set, is the UNIX username the PAM transaction
+	// is started with, so PAM does not need to prompt for
+	// one. This is typically derived from an OpenID Connect
+	// `login_hint`.
+	Username string
+	// UsernameFixed indicates the user must authenticate as
+	// Username, and may not switch to a different account. This
+	// is the case when re-authenticating a known subject. Since
+	// the flow vouches that they authenticated before, Username
+	// is then also passed to PAM as PAM_RUSER, the user asking to
+	// authenticate.
+	UsernameFixed bool
+	// Reauthenticate indicates the user must sign in, even if an
+	// existing session could otherwise stand in for the sign-in
+	// (e.g., because of `prompt=login`).
+	Reauthenticate bool
+	// MaxAge, if set, is how long ago the user may have signed
+	// in, for an existing session to stand in for the sign-in.
+	MaxAge time.Duration
+}
+
 type Scope struct {
 	Name        string
 	Description string
@@ -49,16 +94,18 @@ type ConsentInfo struct {
 type LoginFlow interface {
 	// PreLogin is run before the sign-in flow. It may conclude
 	// the sign-in flow is unnecessary, and return a URL to
-	// redirect to. If an empty URL is returned, the login flow
-	// should proceed.
-	PreLogin(r *http.Request) (string, error)
+	// redirect to. If no redirect is returned, the login flow
+	// should proceed, optionally with a known username.
+	PreLogin(r *http.Request) (*LoginInfo, error)
 	// Authenticated is run after the sign-in flow, to indicate
 	// that the given user has been authenticated. This function
 	// should return a URL to redirect to. This accepts a
 	// `subject`, not a username, so it could be an anonymized
 	// identifier (i.e., the UID) instead of the
-	// username/email/etc. This must be a stable identifier.
-	Authenticated(r *http.Request, subject string) (string, error)
+	// username/email/etc. This must be a stable identifier. The
+	// claims are those configured in PamSocket.Claims, collected
+	// from the PAM transaction.
+	Authenticated(r *http.Request, subject string, claims map[string]string) (string, error)
 	// RequestConsent is called after a user is authenticated to
 	// determine if the target application should be permitted to
 	// learn some information (such as username, or full name, or
@@ -77,11 +124,11 @@ type LoginFlow interface {
 
 type NoopFlow struct{}
 
-func (*NoopFlow) PreLogin(*http.Request) (string, error) {
-	return "", nil
+func (*NoopFlow) PreLogin(*http.Request) (*LoginInfo, error) {
+	return &LoginInfo{}, nil
 }
 
-func (*NoopFlow) Authenticated(*http.Request, string) (string, error) {
+func (*NoopFlow) Authenticated(*http.Request, string, map[string]string) (string, error) {
 	return "/consent", nil
 }
 
@@ -108,9 +155,9 @@ func (*NoopFlow) AcceptConsent(r *http.Request) (string, error) {
 func (*NoopFlow) SupportsOidc() bool { return false }
 
 // PamSocket implements a WebSocket-based PAM session. PAM is
-// transactional, so running it over a WebSocket guarantees that all
-// messages between the client (browser) and server are sent to the
-// same task, without any additional session-based routing.
+// transactional, so each session runs as a Conversation, which
+// outlives the WebSocket: if the connection drops, the client may
+// reconnect and resume it within ResumeWindow.
 type PamSocket struct {
 	// Service is the specific PAM profile to use. This
 	// corresponds to a configuration file of the same name in the
@@ -120,94 +167,317 @@ type PamSocket struct {
 	// generally recommended.
 	Service string
 	// ConfDir is the directory where the PAM service
-	// configurations live. By default, this is `/etc/pam.d/`.
+	// configurations live. By default, this is `/etc/pam.d/`. It
+	// is only used if Authenticator is not set.
 	ConfDir string
+	// Authenticator runs the PAM transactions. If not set, they
+	// run in this process, using ConfDir.
+	Authenticator Authenticator
 	// Flow is a series of functions that are called as part of
 	// the login process. If you do not need to customize the
 	// login process, use NoopFlow.
 	Flow LoginFlow
+	// WebAuthn, if set, is an additional WebAuthn step that runs
+	// after the PAM conversation succeeds, but before Flow is
+	// told the user is authenticated.
+	WebAuthn *WebAuthn
+	// Claims maps claim names to PAM environment variables or
+	// items. Their values at the end of the PAM transaction are
+	// passed to Flow.
+	Claims map[string]ClaimSource
+	// TrustedProxies are the reverse proxies whose `Forwarded`
+	// and `X-Forwarded-*` headers are believed when determining
+	// PAM_RHOST, unless the client is already recorded in the
+	// context of the request (see WithClient).
+	TrustedProxies []netip.Prefix
+	// TTY, if set, is passed to PAM as PAM_TTY, so modules like
+	// pam_access can distinguish web logins.
+	TTY string
+	// XDisplay, if set, is passed to PAM as PAM_XDISPLAY.
+	XDisplay string
+	// ResumeWindow is how long a conversation is kept after its
+	// client goes away, so it can be resumed. By default, this is
+	// 2 minutes.
+	ResumeWindow time.Duration
+	// Directory, if set, records which replica runs each
+	// conversation, so requests reaching other replicas can be
+	// passed on.
+	Directory Directory
+	// ReplicaToken, shared by the replicas, authenticates the
+	// requests they pass on to each other, so they trust each
+	// other as proxies (see ReplicaTrust).
+	ReplicaToken string
+
+	// settings guards Service, Claims, TrustedProxies, TTY and
+	// XDisplay, which may change while the PamSocket is in use.
+	settings      sync.RWMutex
+	mu            sync.Mutex
+	conversations map[string]*Conversation
 }
 
-// session represents a single PAM session, bound to a websocket.Conn
-// connection.
-type session struct {
-	// The active websocket connection with the client.
-	conn *websocket.Conn
-	// A channel that contains messages from the client. Populated
-	// by the `readFromClient` goroutine.
-	clientMsgs chan fromClient
+// Identity is the user a Conversation authenticated.
+type Identity struct {
+	// User is the UNIX user account.
+	User *user.User
+	// Claims are the values collected for PamSocket.Claims.
+	Claims map[string]string
+	// EnrollToken is the proof of the authentication a Helper
+	// requires to enroll the user, if any.
+	EnrollToken string
 }
 
-// readFromClient actively reads all JSON messages from the client,
-// and makes them available in a select'able channel, until cancelled.
-func (s *session) readFromClient(ctx context.Context, conn *websocket.Conn) {
-	for {
-		msg := fromClient{}
-		err := conn.ReadJSON(&msg)
-		select {
-		case <-ctx.Done():
-			return
-		case s.clientMsgs <- msg:
+type identityKey struct{}
+
+// IdentityOf returns the identity a conversation authenticated, to
+// LoginFlow.Authenticated, or nil for other requests.
+func IdentityOf(r *http.Request) *Identity {
+	identity, _ := r.Context().Value(identityKey{}).(*Identity)
+	return identity
+}
+
+func (p *PamSocket) authenticator() Authenticator {
+	if p.Authenticator != nil {
+		return p.Authenticator
+	}
+	return &LocalAuthenticator{ConfDir: p.ConfDir}
+}
+
+func (p *PamSocket) resumeWindow() time.Duration {
+	if p.ResumeWindow > 0 {
+		return p.ResumeWindow
+	}
+	return defaultResumeWindow
+}
+
+// Reconfigure runs fn, which may change Service, Claims,
+// TrustedProxies, TTY and XDisplay, while no new PAM transaction
+// starts. Transactions already running keep the settings they started
+// with.
+func (p *PamSocket) Reconfigure(fn func(p *PamSocket)) {
+	p.settings.Lock()
+	defer p.settings.Unlock()
+	fn(p)
+}
+
+// remoteHost returns the host the request r came from.
+func (p *PamSocket) remoteHost(r *http.Request) string {
+	return p.client(r).Addr
+}
+
+// client returns the client that made r, as recorded in its context by
+// WithClient, or else as ParseClient finds it.
+func (p *PamSocket) client(r *http.Request) *Client {
+	if client, ok := r.Context().Value(clientKey{}).(*Client); ok {
+		return client
+	}
+	p.settings.RLock()
+	defer p.settings.RUnlock()
+	return ParseClient(r, ReplicaTrust(r, p.ReplicaToken, p.TrustedProxies))
+}
+
+// authRequest returns the request for a PAM transaction
+// authenticating user, or asking PAM for a username if empty, from
+// rhost. PAM_RUSER is left unset: user may only be who the client
+// claims to be (e.g., from a login_hint), which modules must not
+// trust. Callers set it where something vouches for the user.
+func (p *PamSocket) authRequest(user, rhost string) *AuthRequest {
+	p.settings.RLock()
+	defer p.settings.RUnlock()
+	return &AuthRequest{
+		Service: p.Service,
+		User:    user,
+		Items: map[pam.Item]string{
+			pam.Rhost:    rhost,
+			pam.Tty:      p.TTY,
+			pam.Xdisplay: p.XDisplay,
+		},
+		Claims: p.Claims,
+	}
+}
+
+func (p *PamSocket) forget(c *Conversation) {
+	p.mu.Lock()
+	delete(p.conversations, c.ID)
+	p.mu.Unlock()
+	p.release(c)
+}
+
+// Start begins a new conversation for the sign-in request r. If
+// LoginFlow.PreLogin concludes no sign-in is needed, no
+// conversation is started, and the URL to redirect to is returned
+// instead.
+func (p *PamSocket) Start(r *http.Request) (*Conversation, string, error) {
+	info, err := p.Flow.PreLogin(r)
+	if err != nil {
+		return nil, "", &internalError{"flow", err}
+	}
+	if info.Redirect != "" {
+		return nil, info.Redirect, nil
+	}
+	hint := info.Username
+	if !info.UsernameFixed && r.URL.Query().Get("ignore_hint") == "1" {
+		hint = ""
+	}
+
+	c := p.register()
+	c.query = r.URL.RawQuery
+
+	if hint != "" {
+		msg := Message{
+			Type:    "Username",
+			Message: hint,
 		}
-		if err != nil {
-			log.Error().Err(err).Msg("ReadJSON failed")
-			conn.Close()
-			return
+		if info.UsernameFixed {
+			msg.Type = "UsernameFixed"
 		}
+		c.send(msg)
+	}
+
+	// If no username is known, PAM will request one, if
+	// needed. Also tell PAM where the user is coming from, for
+	// modules like pam_access and pam_faillock.
+	req := p.authRequest(hint, p.remoteHost(r))
+	if info.UsernameFixed {
+		req.Items[pam.Ruser] = hint
 	}
+	go p.run(c, req, info.UsernameFixed)
+	return c, "", nil
 }
 
-// RespondPAM satisifies the pam.ConversationHandler interface. It is
-// called by the PAM session whenever PAM needs to interact with the
-// user, either to display a message, or request input.
-//
-// This function directly communicates with the client over the
-// websocket and no other concurrent messaging must occur until the
-// PAM conversation has quiesced.
-func (s *session) RespondPAM(style pam.Style, m string) (string, error) {
-	msg := toClient{
-		Message: m,
+// StartUser begins a new conversation authenticating the given
+// user, for protocols without a sign-in request or login flow. rhost,
+// if set, is passed to PAM as PAM_RHOST.
+func (p *PamSocket) StartUser(username, rhost string) *Conversation {
+	c := p.register()
+	go p.run(c, p.authRequest(username, rhost), true)
+	return c
+}
+
+// register creates a new conversation, which may be resumed until it
+// is forgotten.
+func (p *PamSocket) register() *Conversation {
+	c := newConversation(p.resumeWindow(), p.forget)
+	p.mu.Lock()
+	if p.conversations == nil {
+		p.conversations = make(map[string]*Conversation)
+	}
+	p.conversations[c.ID] = c
+	p.mu.Unlock()
+	p.claim(c)
+	return c
+}
+
+// Resume returns the in-progress conversation with the given ID, or
+// nil if there is none.
+func (p *PamSocket) Resume(id string) *Conversation {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.conversations[id]
+}
+
+// run runs the conversation to completion.
+func (p *PamSocket) run(c *Conversation, req *AuthRequest, fixed bool) {
+	var identity *Identity
+	var err error
+	defer func() {
+		if v := recover(); v != nil {
+			identity, err = nil, &internalError{"panic", fmt.Errorf("panic: %v", v)}
+		}
+		if err != nil {
+			report(err)
+		}
+		c.finish(identity, err)
+	}()
+	identity, err = p.authenticate(c, req, fixed)
+}
+
+func (p *PamSocket) authenticate(c *Conversation, req *AuthRequest, fixed bool) (*Identity, error) {
+	result, err := p.authenticator().Authenticate(req, pam.ConversationFunc(c.respondPAM))
+	if errors.Is(err, ErrAuthenticationFailed) {
+		return nil, err
+	}
+	if err != nil {
+		return nil, &internalError{"pam", err}
+	}
+
+	username := result.Username
+	// PAM modules are permitted to change the username, so make
+	// sure that did not allow switching accounts.
+	if fixed && username != req.User {
+		return nil, fmt.Errorf("%w: authenticated %q, but %q was required", ErrAuthenticationFailed, username, req.User)
 	}
-	switch style {
-	case pam.PromptEchoOff:
-		msg.Type = "PromptEchoOff"
-	case pam.PromptEchoOn:
-		msg.Type = "PromptEchoOn"
-	case pam.ErrorMsg:
-		msg.Type = "Error"
-	case pam.TextInfo:
-		msg.Type = "Info"
+	userinfo, err := user.Lookup(username)
+	if err != nil {
+		return nil, &internalError{"user", fmt.Errorf("could not retrieve UNIX user account information: %w", err)}
 	}
+	log.Info().Msgf("Authenticated %q (uid=%q) from %s", username, userinfo.Uid, req.Items[pam.Rhost])
 
-	// Regardless of the type, the client needs to get this message
-	log.Info().Msgf("Sending %#v", msg)
-	s.conn.WriteJSON(msg)
-
-	// However, a client response is only needed in some cases
-	switch style {
-	case pam.PromptEchoOff:
-		fallthrough
-	case pam.PromptEchoOn:
-		response := <-s.clientMsgs
-		return response.Input, nil
-	default:
+	if p.WebAuthn != nil {
+		if err := p.WebAuthn.verify(c, userinfo); err != nil {
+			return nil, fmt.Errorf("%w: WebAuthn failed for %q: %w", ErrAuthenticationFailed, username, err)
+		}
 	}
-	return "", nil
+	return &Identity{
+		User:        userinfo,
+		Claims:      result.Claims,
+		EnrollToken: result.EnrollToken,
+	}, nil
 }
 
-func (s *session) writeErr(message string) {
-	s.conn.WriteJSON(toClient{
-		Type:    "Error",
-		Message: message,
-	})
+// Finish completes a conversation that is over, telling Flow the
+// user is authenticated, and returns the URL to redirect to. The
+// conversation cannot be resumed afterwards. Flow sees r with the
+// query parameters the conversation was started with (e.g., the
+// `login_challenge`), whichever request finishes it, and the
+// identity authenticated in its context (see IdentityOf).
+func (p *PamSocket) Finish(r *http.Request, c *Conversation) (string, error) {
+	identity, err := c.Result()
+	if err != nil {
+		return "", err
+	}
+	p.forget(c)
+	r = r.Clone(context.WithValue(r.Context(), identityKey{}, identity))
+	r.URL.RawQuery = c.query
+	redirect, err := p.Flow.Authenticated(r, string(identity.User.Uid), identity.Claims)
+	if err != nil {
+		err = &internalError{"flow", err}
+		report(err)
+		return "", err
+	}
+	return redirect, nil
 }
 
 var upgrader = websocket.Upgrader{
 	ReadBufferSize:  1024,
 	WriteBufferSize: 1024,
+	CheckOrigin:     checkOrigin,
+}
+
+// checkOrigin allows websockets from pages on the host the client
+// asked for, which may not be the one a reverse proxy passed on.
+func checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(u.Host, ClientOf(r).Host)
+}
+
+// writeFinal sends the last message of a conversation, and closes
+// the websocket normally, so the client knows not to resume.
+func writeFinal(conn *websocket.Conn, msg Message) {
+	conn.WriteJSON(msg)
+	conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
 }
 
 func (p *PamSocket) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if p.Forward(w, r, r.URL.Query().Get("resume")) {
+		return
+	}
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		log.Info().Err(err).Msg("Could not upgrade to websocket")
@@ -215,68 +485,82 @@ func (p *PamSocket) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 	// Ensure the connection is closed when this function ends.
 	defer conn.Close()
+	defer func() {
+		if v := recover(); v != nil {
+			err := &internalError{"panic", fmt.Errorf("panic: %v", v)}
+			report(err)
+			writeFinal(conn, Message{Type: "Error", Message: UserMessage(err)})
+		}
+	}()
 
-	s := &session{
-		conn:       conn,
-		clientMsgs: make(chan fromClient, 1),
-	}
-
-	redirect, err := p.Flow.PreLogin(r)
-	if err != nil {
-		s.writeErr(err.Error())
-		return
-	}
-	if redirect != "" {
-		conn.WriteJSON(toClient{
-			Type:    "Redirect",
-			Message: redirect,
+	var c *Conversation
+	if id := r.URL.Query().Get("resume"); id != "" {
+		c = p.Resume(id)
+		if c == nil {
+			writeFinal(conn, Message{Type: "Error", Message: UserMessage(errClientGone)})
+			return
+		}
+		log.Info().Msg("Resuming PAM conversation")
+	} else {
+		var redirect string
+		c, redirect, err = p.Start(r)
+		if err != nil {
+			report(err)
+			writeFinal(conn, Message{Type: "Error", Message: UserMessage(err)})
+			return
+		}
+		if redirect != "" {
+			writeFinal(conn, Message{Type: "Redirect", Message: redirect})
+			return
+		}
+		conn.WriteJSON(Message{
+			Type:    "Resume",
+			Message: c.ID,
 		})
-		return
 	}
 
+	a := c.Attach()
+	// If the client goes away, the conversation is parked until it
+	// resumes.
+	defer a.Detach()
+
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
+	go func() {
+		defer cancel()
+		for {
+			msg := fromClient{}
+			if err := conn.ReadJSON(&msg); err != nil {
+				log.Info().Err(err).Msg("ReadJSON failed")
+				return
+			}
+			if err := a.Answer(msg.Input); err != nil {
+				log.Info().Err(err).Msg("Ignoring input from client")
+			}
+		}
+	}()
 
-	go s.readFromClient(ctx, conn)
-
-	// Start the PAM conversation, with no username provided. PAM
-	// will request one, if needed.
-	t, err := pam.StartConfDir(p.Service, "", s, p.ConfDir)
-	if err != nil {
-		log.Fatal().Msgf("Cannot start PAM session: %v", err)
-		return
+	for {
+		msg, err := a.Next(ctx)
+		if errors.Is(err, ErrConversationOver) {
+			break
+		}
+		if err != nil {
+			log.Info().Err(err).Msg("Client detached from PAM conversation")
+			return
+		}
+		if err := conn.WriteJSON(msg); err != nil {
+			log.Info().Err(err).Msg("WriteJSON failed")
+			return
+		}
 	}
-	defer t.End()
 
-	err = t.Authenticate(0)
+	redirect, err := p.Finish(r, c)
 	if err != nil {
 		log.Info().Err(err).Msg("Could not authenticate user")
-		s.writeErr("Authentication failed.")
-		return
-	}
-
-	username, err := t.GetItem(pam.User)
-	if err != nil {
-		log.Error().Err(err).Msg("Could not retrieve username")
-		s.writeErr("Internal error")
-		return
-	}
-	userinfo, err := user.Lookup(username)
-	if err != nil {
-		log.Error().Err(err).Msg("Could not retrieve UNIX user account information")
-		s.writeErr("Internal error")
-		return
-	}
-	log.Info().Msgf("Authenticated %q (uid=%q)", username, userinfo.Uid)
-
-	redirect, err = p.Flow.Authenticated(r, string(userinfo.Uid))
-	if err != nil {
-		s.writeErr(err.Error())
+		writeFinal(conn, Message{Type: "Error", Message: UserMessage(err)})
 		return
 	}
-	conn.WriteJSON(toClient{
-		Type:    "Redirect",
-		Message: redirect,
-	})
-	log.Info().Msgf("Sent redirect for %q", username)
+	writeFinal(conn, Message{Type: "Redirect", Message: redirect})
+	log.Info().Msg("Sent redirect")
 }
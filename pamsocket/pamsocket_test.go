@@ -7,11 +7,13 @@ import (
 	"testing"
 
 	"github.com/gorilla/websocket"
+	"github.com/msteinert/pam/v2"
 	"github.com/rs/zerolog/log"
 )
 
 func TestMain(m *testing.M) {
 	log.Logger = log.With().Caller().Logger()
+	runTestWorker()
 	m.Run()
 }
 
@@ -84,8 +86,11 @@ func TestProvideUsername(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	fromServer := toClient{}
+	fromServer := Message{}
 	conn.ReadJSON(&fromServer)
+	if fromServer.Type == "Resume" {
+		conn.ReadJSON(&fromServer)
+	}
 	switch fromServer.Type {
 	case "PromptEchoOn":
 		log.Info().Msg("Sending username to server")
@@ -98,3 +103,29 @@ func TestProvideUsername(t *testing.T) {
 	conn.ReadJSON(&fromServer)
 	log.Info().Msgf("%#v", fromServer)
 }
+
+// serviceAuthenticator accepts anyone, recording the PAM service of
+// each transaction.
+type serviceAuthenticator chan string
+
+func (a serviceAuthenticator) Authenticate(req *AuthRequest, conv pam.ConversationHandler) (*AuthResult, error) {
+	a <- req.Service
+	return &AuthResult{Username: req.User}, nil
+}
+
+func TestReconfigure(t *testing.T) {
+	services := make(serviceAuthenticator, 2)
+	p := &PamSocket{Service: "before", Authenticator: services}
+	if _, err := p.CheckPassword("root", "", ""); err != nil {
+		t.Fatal(err)
+	}
+	p.Reconfigure(func(p *PamSocket) { p.Service = "after" })
+	if _, err := p.CheckPassword("root", "", ""); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"before", "after"} {
+		if got := <-services; got != want {
+			t.Errorf("got service %q, want %q", got, want)
+		}
+	}
+}
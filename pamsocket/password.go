@@ -0,0 +1,69 @@
+package pamsocket
+
+import (
+	"errors"
+	"fmt"
+	"os/user"
+
+	"github.com/msteinert/pam/v2"
+	"github.com/rs/zerolog/log"
+)
+
+// errNotInteractive fails a password conversation when PAM asks for
+// more than the password, since there is nobody to answer.
+var errNotInteractive = errors.New("PAM asked for more than a password")
+
+// passwordConversation answers a PAM conversation on behalf of a
+// user who is not there: the first hidden prompt is answered with the
+// password, and messages are only logged.
+type passwordConversation struct {
+	password string
+	answered bool
+}
+
+func (pc *passwordConversation) RespondPAM(style pam.Style, msg string) (string, error) {
+	switch style {
+	case pam.PromptEchoOff:
+		if pc.answered {
+			return "", errNotInteractive
+		}
+		pc.answered = true
+		return pc.password, nil
+	case pam.PromptEchoOn:
+		return "", errNotInteractive
+	default:
+		log.Info().Msgf("PAM said %q", msg)
+		return "", nil
+	}
+}
+
+// CheckPassword authenticates a user with their password alone, for
+// protocols that cannot carry a conversation. PAM's first hidden
+// prompt is answered with the password, and any further prompt fails
+// the authentication. rhost, if set, is passed to PAM as PAM_RHOST.
+func (p *PamSocket) CheckPassword(username, password, rhost string) (*user.User, error) {
+	req := p.authRequest(username, rhost)
+	// No claims are returned, so none need collecting.
+	req.Claims = nil
+	result, err := p.authenticator().Authenticate(req, &passwordConversation{password: password})
+	if errors.Is(err, ErrAuthenticationFailed) {
+		return nil, err
+	}
+	if err != nil {
+		err = &internalError{"pam", err}
+		report(err)
+		return nil, err
+	}
+	// As with conversations, PAM must not switch accounts.
+	if result.Username != username {
+		return nil, fmt.Errorf("%w: authenticated %q, but %q was required", ErrAuthenticationFailed, result.Username, username)
+	}
+	userinfo, err := user.Lookup(username)
+	if err != nil {
+		err = &internalError{"user", fmt.Errorf("could not retrieve UNIX user account information: %w", err)}
+		report(err)
+		return nil, err
+	}
+	log.Info().Msgf("Authenticated %q (uid=%q) by password", username, userinfo.Uid)
+	return userinfo, nil
+}
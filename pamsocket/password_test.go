@@ -0,0 +1,150 @@
+package pamsocket
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/msteinert/pam/v2"
+)
+
+// otpAuthenticator asks for a password, and then a one-time code.
+type otpAuthenticator struct {
+	otp bool
+}
+
+func (o otpAuthenticator) Authenticate(req *AuthRequest, conv pam.ConversationHandler) (*AuthResult, error) {
+	password, err := conv.RespondPAM(pam.PromptEchoOff, "Password: ")
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrAuthenticationFailed, err)
+	}
+	if password != "secret" {
+		return nil, ErrAuthenticationFailed
+	}
+	if o.otp {
+		if _, err := conv.RespondPAM(pam.PromptEchoOff, "Verification code: "); err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrAuthenticationFailed, err)
+		}
+	}
+	return &AuthResult{Username: req.User}, nil
+}
+
+func TestCheckPassword(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		otp      bool
+		password string
+		ok       bool
+	}{
+		{"correct", false, "secret", true},
+		{"wrong", false, "guess", false},
+		{"interactive", true, "secret", false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			p := &PamSocket{Authenticator: otpAuthenticator{otp: tc.otp}}
+			userinfo, err := p.CheckPassword("root", tc.password, "192.0.2.1")
+			if tc.ok {
+				if err != nil || userinfo.Username != "root" {
+					t.Fatalf("Expected to authenticate root, got %v, %v", userinfo, err)
+				}
+				return
+			}
+			if !errors.Is(err, ErrAuthenticationFailed) {
+				t.Fatalf("Expected authentication failure, got %v", err)
+			}
+		})
+	}
+}
+
+func TestStartUser(t *testing.T) {
+	p := &PamSocket{Authenticator: otpAuthenticator{otp: true}}
+	c := p.StartUser("root", "192.0.2.1")
+	a := c.Attach()
+	defer a.Detach()
+	for _, input := range []string{"secret", "123456"} {
+		msg, err := a.Next(context.Background())
+		if err != nil || msg.Type != "PromptEchoOff" {
+			t.Fatalf("Expected a prompt, got %#v, %v", msg, err)
+		}
+		// Answers may come from anywhere, once the prompt was
+		// delivered.
+		if err := p.Resume(c.ID).Answer(input); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := a.Next(context.Background()); !errors.Is(err, ErrConversationOver) {
+		t.Fatalf("Expected the conversation to be over, got %v", err)
+	}
+	identity, err := c.Result()
+	if err != nil || identity.User.Username != "root" {
+		t.Fatalf("Expected to authenticate root, got %v, %v", identity, err)
+	}
+}
+
+// itemsAuthenticator accepts anyone, recording the PAM items of each
+// transaction.
+type itemsAuthenticator chan map[pam.Item]string
+
+func (a itemsAuthenticator) Authenticate(req *AuthRequest, conv pam.ConversationHandler) (*AuthResult, error) {
+	a <- req.Items
+	return &AuthResult{Username: req.User}, nil
+}
+
+func TestStartUserItems(t *testing.T) {
+	items := make(itemsAuthenticator, 1)
+	p := &PamSocket{Authenticator: items, TTY: "nonstick"}
+	p.StartUser("root", "192.0.2.1")
+	got := <-items
+	if got[pam.Rhost] != "192.0.2.1" || got[pam.Tty] != "nonstick" {
+		t.Errorf("got items %v", got)
+	}
+	if ruser, ok := got[pam.Ruser]; ok {
+		t.Errorf("PAM_RUSER was set to %q", ruser)
+	}
+}
+
+// hintFlow starts conversations for root, who may not switch accounts
+// with the `fixed` query parameter.
+type hintFlow struct{ NoopFlow }
+
+func (*hintFlow) PreLogin(r *http.Request) (*LoginInfo, error) {
+	return &LoginInfo{Username: "root", UsernameFixed: r.URL.Query().Get("fixed") != ""}, nil
+}
+
+func TestStartRuser(t *testing.T) {
+	items := make(itemsAuthenticator, 1)
+	p := &PamSocket{Authenticator: items, Flow: &hintFlow{}}
+
+	// A hint is only who the client claims to be.
+	if _, _, err := p.Start(httptest.NewRequest("GET", "/", nil)); err != nil {
+		t.Fatal(err)
+	}
+	if ruser, ok := (<-items)[pam.Ruser]; ok {
+		t.Errorf("PAM_RUSER was set to %q for a hint", ruser)
+	}
+
+	// A re-authentication is requested by the user who
+	// authenticated before.
+	if _, _, err := p.Start(httptest.NewRequest("GET", "/?fixed=1", nil)); err != nil {
+		t.Fatal(err)
+	}
+	if ruser := (<-items)[pam.Ruser]; ruser != "root" {
+		t.Errorf("got PAM_RUSER %q for a re-authentication, want root", ruser)
+	}
+}
+
+func TestCheckPasswordItems(t *testing.T) {
+	items := make(itemsAuthenticator, 1)
+	p := &PamSocket{Authenticator: items, TTY: "nonstick", XDisplay: ":0"}
+	if _, err := p.CheckPassword("root", "", "192.0.2.1"); err != nil {
+		t.Fatal(err)
+	}
+	want := map[pam.Item]string{pam.Rhost: "192.0.2.1", pam.Tty: "nonstick", pam.Xdisplay: ":0"}
+	if got := <-items; !maps.Equal(got, want) {
+		t.Errorf("got items %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,115 @@
+package pamsocket
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"sync"
+	"time"
+
+	"github.com/msteinert/pam/v2"
+	"github.com/rs/zerolog/log"
+)
+
+// workerTimeout bounds how long a transaction waits for a worker to
+// become available.
+const workerTimeout = 30 * time.Second
+
+// worker is a subprocess that serves a single transaction of the
+// helper protocol on its stdin and stdout.
+type worker struct {
+	cmd *exec.Cmd
+	io.Reader
+	io.WriteCloser
+}
+
+// finish ends the worker, which should already be exiting after its
+// transaction, and reports how it exited.
+func (w *worker) finish() error {
+	w.WriteCloser.Close()
+	done := make(chan error, 1)
+	go func() { done <- w.cmd.Wait() }()
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(time.Second):
+		w.cmd.Process.Kill()
+		return <-done
+	}
+}
+
+// PoolAuthenticator runs each PAM transaction in its own worker
+// subprocess, so a PAM module that crashes, exits or leaks state only
+// affects that one transaction. A number of idle workers are kept
+// ready, and each is replaced as soon as it is used.
+type PoolAuthenticator struct {
+	// Command returns the command to start a worker, which must
+	// serve a single transaction of the helper protocol (see
+	// Helper.ServeConn) on its stdin and stdout.
+	Command func() *exec.Cmd
+	// Size is the number of idle workers kept ready.
+	Size int
+
+	once  sync.Once
+	ready chan *worker
+}
+
+func (p *PoolAuthenticator) start() {
+	p.ready = make(chan *worker, p.Size)
+	for i := 0; i < p.Size; i++ {
+		go p.spawn()
+	}
+}
+
+func (p *PoolAuthenticator) newWorker() (*worker, error) {
+	cmd := p.Command()
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	return &worker{
+		cmd:         cmd,
+		Reader:      stdout,
+		WriteCloser: stdin,
+	}, nil
+}
+
+// spawn adds a worker to the pool, retrying until one starts.
+func (p *PoolAuthenticator) spawn() {
+	for {
+		w, err := p.newWorker()
+		if err == nil {
+			p.ready <- w
+			return
+		}
+		log.Error().Err(err).Msg("Could not start PAM worker")
+		time.Sleep(time.Second)
+	}
+}
+
+func (p *PoolAuthenticator) Authenticate(req *AuthRequest, conv pam.ConversationHandler) (*AuthResult, error) {
+	p.once.Do(p.start)
+	var w *worker
+	select {
+	case w = <-p.ready:
+	case <-time.After(workerTimeout):
+		return nil, errors.New("no PAM worker available")
+	}
+	go p.spawn()
+
+	result, err := converse(w, req, conv)
+	exitErr := w.finish()
+	if err != nil && !errors.Is(err, ErrAuthenticationFailed) && exitErr != nil {
+		log.Error().Err(exitErr).Msgf("PAM worker %d failed", w.cmd.Process.Pid)
+		return nil, fmt.Errorf("PAM worker failed (%v): %w", exitErr, err)
+	}
+	return result, err
+}
@@ -0,0 +1,79 @@
+package pamsocket
+
+import (
+	"errors"
+	"io"
+	"os"
+	"os/exec"
+	"testing"
+
+	"github.com/msteinert/pam/v2"
+)
+
+// crashAuthenticator takes down its whole process mid-conversation,
+// like a misbehaving PAM module might.
+type crashAuthenticator struct{}
+
+func (crashAuthenticator) Authenticate(req *AuthRequest, conv pam.ConversationHandler) (*AuthResult, error) {
+	conv.RespondPAM(pam.PromptEchoOn, "login:")
+	os.Exit(3)
+	return nil, nil
+}
+
+// runTestWorker serves a single transaction over stdin and stdout, if
+// this test binary was started as a worker by testPool.
+func runTestWorker() {
+	var authenticator Authenticator
+	switch os.Getenv("NONSTICK_TEST_WORKER") {
+	case "":
+		return
+	case "crash":
+		authenticator = crashAuthenticator{}
+	default:
+		authenticator = echoAuthenticator{}
+	}
+	helper := &Helper{Authenticator: authenticator, AnyService: true}
+	helper.ServeConn(struct {
+		io.Reader
+		io.WriteCloser
+	}{os.Stdin, os.Stdout})
+	os.Exit(0)
+}
+
+func testPool(mode string) *PoolAuthenticator {
+	return &PoolAuthenticator{
+		Command: func() *exec.Cmd {
+			cmd := exec.Command(os.Args[0])
+			cmd.Env = append(os.Environ(), "NONSTICK_TEST_WORKER="+mode)
+			return cmd
+		},
+		Size: 2,
+	}
+}
+
+func TestPoolAuthenticator(t *testing.T) {
+	pool := testPool("echo")
+	for _, username := range []string{"alice", "bob", "carol"} {
+		result, err := pool.Authenticate(&AuthRequest{Service: "test"}, answer(username))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result.Username != username {
+			t.Fatalf("Expected %q, got %#v", username, result)
+		}
+	}
+	_, err := pool.Authenticate(&AuthRequest{Service: "test"}, answer("nobody"))
+	if !errors.Is(err, ErrAuthenticationFailed) {
+		t.Fatalf("Expected authentication failure, got %v", err)
+	}
+}
+
+func TestPoolAuthenticatorCrash(t *testing.T) {
+	pool := testPool("crash")
+	for i := 0; i < 3; i++ {
+		_, err := pool.Authenticate(&AuthRequest{Service: "test"}, answer("alice"))
+		if err == nil || errors.Is(err, ErrAuthenticationFailed) {
+			t.Fatalf("Expected the worker crash to be reported, got %v", err)
+		}
+	}
+}
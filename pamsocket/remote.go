@@ -0,0 +1,221 @@
+package pamsocket
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+// ParseTrustedProxies parses a list of CIDR ranges (or bare IP
+// addresses) identifying reverse proxies whose forwarding headers
+// may be believed.
+func ParseTrustedProxies(specs []string) ([]netip.Prefix, error) {
+	var result []netip.Prefix
+	for _, spec := range specs {
+		if !strings.Contains(spec, "/") {
+			addr, err := netip.ParseAddr(spec)
+			if err != nil {
+				return nil, fmt.Errorf("trusted proxy %q is not an IP address or CIDR range: %w", spec, err)
+			}
+			result = append(result, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(spec)
+		if err != nil {
+			return nil, fmt.Errorf("trusted proxy %q is not an IP address or CIDR range: %w", spec, err)
+		}
+		result = append(result, prefix.Masked())
+	}
+	return result, nil
+}
+
+func isTrusted(addr netip.Addr, trusted []netip.Prefix) bool {
+	addr = addr.Unmap()
+	for _, prefix := range trusted {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// Client describes the client that made a request, as far as trusted
+// reverse proxies say.
+type Client struct {
+	// Addr is the IP address of the client.
+	Addr string
+	// Proto is the scheme the client used, either `http` or
+	// `https`.
+	Proto string
+	// Host is the host, and maybe port, the client asked for.
+	Host string
+	// Proxied reports whether the request came from a trusted
+	// proxy, whose description of the client this is.
+	Proxied bool
+}
+
+type clientKey struct{}
+
+// WithClient returns a copy of ctx recording the client of a
+// request, so handlers need not parse it again.
+func WithClient(ctx context.Context, client *Client) context.Context {
+	return context.WithValue(ctx, clientKey{}, client)
+}
+
+// ClientOf returns the client that made r, as recorded in its context
+// by WithClient, or else the peer itself.
+func ClientOf(r *http.Request) *Client {
+	if client, ok := r.Context().Value(clientKey{}).(*Client); ok {
+		return client
+	}
+	return ParseClient(r, nil)
+}
+
+// hop is a hop of a request through reverse proxies: the address it
+// came from, and the scheme and host it asked for.
+type hop struct {
+	addr  string
+	proto string
+	host  string
+}
+
+// splitQuoted splits s at sep, other than within quoted strings.
+func splitQuoted(s string, sep rune) []string {
+	var result []string
+	quoted, escaped, start := false, false, 0
+	for i, r := range s {
+		switch {
+		case escaped:
+			escaped = false
+		case quoted && r == '\\':
+			escaped = true
+		case r == '"':
+			quoted = !quoted
+		case !quoted && r == sep:
+			result = append(result, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(result, s[start:])
+}
+
+// forwardedAddr returns the IP address of a `for` parameter of the
+// `Forwarded` header, without any port or brackets.
+func forwardedAddr(value string) string {
+	if host, _, err := net.SplitHostPort(value); err == nil {
+		return host
+	}
+	return strings.TrimSuffix(strings.TrimPrefix(value, "["), "]")
+}
+
+// forwardedHops returns the hops described by the `Forwarded` header
+// of a request, nearest last, or else by the `X-Forwarded-For` header.
+// Those have `X-Forwarded-Proto` and `X-Forwarded-Host` apply to the
+// nearest hop, as most proxies set them for the request they got.
+func forwardedHops(header http.Header) []hop {
+	var hops []hop
+	if values := header.Values("Forwarded"); len(values) > 0 {
+		for _, value := range values {
+			for _, element := range splitQuoted(value, ',') {
+				var h hop
+				for _, pair := range splitQuoted(element, ';') {
+					key, value, _ := strings.Cut(strings.TrimSpace(pair), "=")
+					if unquoted, err := strconv.Unquote(value); err == nil {
+						value = unquoted
+					}
+					switch strings.ToLower(key) {
+					case "for":
+						h.addr = forwardedAddr(value)
+					case "proto":
+						h.proto = value
+					case "host":
+						h.host = value
+					}
+				}
+				hops = append(hops, h)
+			}
+		}
+		return hops
+	}
+
+	for _, value := range header.Values("X-Forwarded-For") {
+		for _, addr := range strings.Split(value, ",") {
+			hops = append(hops, hop{addr: strings.TrimSpace(addr)})
+		}
+	}
+	last := func(name string) string {
+		values := header.Values(name)
+		if len(values) == 0 {
+			return ""
+		}
+		parts := strings.Split(values[len(values)-1], ",")
+		return strings.TrimSpace(parts[len(parts)-1])
+	}
+	if proto, host := last("X-Forwarded-Proto"), last("X-Forwarded-Host"); proto != "" || host != "" {
+		if len(hops) == 0 {
+			hops = append(hops, hop{})
+		}
+		hops[len(hops)-1].proto = proto
+		hops[len(hops)-1].host = host
+	}
+	return hops
+}
+
+// ParseClient returns the client that made r. The `Forwarded` header,
+// or else the `X-Forwarded-For`, `X-Forwarded-Proto` and
+// `X-Forwarded-Host` headers, are only consulted if the request came
+// from a trusted proxy. They are walked from the nearest hop outwards
+// until the first address that is not itself a trusted proxy.
+func ParseClient(r *http.Request, trusted []netip.Prefix) *Client {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	client := &Client{Addr: host, Proto: "http", Host: r.Host}
+	if r.TLS != nil {
+		client.Proto = "https"
+	}
+	peer, err := netip.ParseAddr(host)
+	if err != nil || !isTrusted(peer, trusted) {
+		return client
+	}
+	client.Proxied = true
+
+	hops := forwardedHops(r.Header)
+	for i := len(hops) - 1; i >= 0; i-- {
+		// The scheme and host are those the hop asked the
+		// trusted proxy for, even if its address is unknown.
+		if proto := strings.ToLower(hops[i].proto); proto == "http" || proto == "https" {
+			client.Proto = proto
+		}
+		if hops[i].host != "" && !strings.ContainsAny(hops[i].host, "/\\@ ") {
+			client.Host = hops[i].host
+		}
+		addr, err := netip.ParseAddr(hops[i].addr)
+		if err != nil {
+			// A malformed or obfuscated entry cannot be
+			// trusted, so the last proxy that added one is
+			// the best available answer.
+			break
+		}
+		client.Addr = addr.Unmap().String()
+		if !isTrusted(addr, trusted) {
+			break
+		}
+	}
+	return client
+}
+
+// RemoteHost returns the address of the client that made r, as
+// recorded in its context by WithClient, or else as ParseClient finds
+// it.
+func RemoteHost(r *http.Request, trusted []netip.Prefix) string {
+	if client, ok := r.Context().Value(clientKey{}).(*Client); ok {
+		return client.Addr
+	}
+	return ParseClient(r, trusted).Addr
+}
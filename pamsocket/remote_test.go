@@ -0,0 +1,87 @@
+package pamsocket
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestRemoteHost(t *testing.T) {
+	trusted, err := ParseTrustedProxies([]string{"10.0.0.0/8", "192.168.1.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		remoteAddr string
+		forwarded  []string
+		want       string
+	}{
+		{"203.0.113.5:1234", nil, "203.0.113.5"},
+		{"203.0.113.5:1234", []string{"198.51.100.1"}, "203.0.113.5"},
+		{"10.1.2.3:1234", []string{"198.51.100.1"}, "198.51.100.1"},
+		{"10.1.2.3:1234", []string{"198.51.100.1, 192.168.1.1"}, "198.51.100.1"},
+		{"10.1.2.3:1234", []string{"6.6.6.6, 198.51.100.1", "10.9.9.9"}, "198.51.100.1"},
+		{"10.1.2.3:1234", []string{"garbage, 10.9.9.9"}, "10.9.9.9"},
+		{"10.1.2.3:1234", nil, "10.1.2.3"},
+		{"[::ffff:10.1.2.3]:1234", []string{"2001:db8::1"}, "2001:db8::1"},
+	} {
+		r := &http.Request{
+			RemoteAddr: tc.remoteAddr,
+			Header:     http.Header{},
+		}
+		for _, header := range tc.forwarded {
+			r.Header.Add("X-Forwarded-For", header)
+		}
+		if got := RemoteHost(r, trusted); got != tc.want {
+			t.Errorf("RemoteHost(%q, %q) = %q, want %q", tc.remoteAddr, tc.forwarded, got, tc.want)
+		}
+	}
+}
+
+func TestParseClient(t *testing.T) {
+	trusted, err := ParseTrustedProxies([]string{"10.0.0.0/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		remoteAddr string
+		header     http.Header
+		want       Client
+	}{
+		{"203.0.113.5:1234", http.Header{"X-Forwarded-Proto": {"https"}}, Client{"203.0.113.5", "http", "idp.internal", false}},
+		{"10.1.2.3:1234", http.Header{}, Client{"10.1.2.3", "http", "idp.internal", true}},
+		{"10.1.2.3:1234", http.Header{
+			"X-Forwarded-For":   {"198.51.100.1"},
+			"X-Forwarded-Proto": {"https"},
+			"X-Forwarded-Host":  {"idp.example.com"},
+		}, Client{"198.51.100.1", "https", "idp.example.com", true}},
+		{"10.1.2.3:1234", http.Header{
+			"Forwarded": {`for=6.6.6.6;host=evil.example.com, for=198.51.100.1;proto=https;host=idp.example.com`, `for="10.9.9.9:80";proto=http;host=idp.internal`},
+		}, Client{"198.51.100.1", "https", "idp.example.com", true}},
+		{"10.1.2.3:1234", http.Header{
+			"Forwarded": {`For="[2001:db8::1]:4711";Proto=https;Host="idp.example.com:8443"`},
+		}, Client{"2001:db8::1", "https", "idp.example.com:8443", true}},
+		{"10.1.2.3:1234", http.Header{
+			"Forwarded": {`for=unknown;proto=https;host=idp.example.com`},
+		}, Client{"10.1.2.3", "https", "idp.example.com", true}},
+		{"10.1.2.3:1234", http.Header{
+			"Forwarded": {`for=198.51.100.1;proto=gopher;host="a/b"`},
+		}, Client{"198.51.100.1", "http", "idp.internal", true}},
+	} {
+		r := &http.Request{
+			RemoteAddr: tc.remoteAddr,
+			Host:       "idp.internal",
+			Header:     tc.header,
+		}
+		if got := ParseClient(r, trusted); *got != tc.want {
+			t.Errorf("ParseClient(%q, %v) = %+v, want %+v", tc.remoteAddr, tc.header, *got, tc.want)
+		}
+	}
+}
+
+func TestParseTrustedProxiesInvalid(t *testing.T) {
+	for _, spec := range []string{"", "proxy.example.com", "10.0.0.0/33"} {
+		if _, err := ParseTrustedProxies([]string{spec}); err == nil {
+			t.Errorf("Expected an error for %q", spec)
+		}
+	}
+}
@@ -0,0 +1,141 @@
+package pamsocket
+
+import (
+	"crypto/subtle"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/netip"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// forwardedHeader marks requests passed on by another replica, so
+// they are not passed on again. Its value is the ReplicaToken of the
+// PamSocket.
+const forwardedHeader = "X-Nonstick-Replica"
+
+// forwardingHeaders are those in which proxies describe the client.
+var forwardingHeaders = []string{"Forwarded", "X-Forwarded-For", "X-Forwarded-Proto", "X-Forwarded-Host"}
+
+// ReplicaTrust returns trusted, plus the address r came from if r was
+// passed on by another replica, which shares token: replicas trust
+// each other as proxies.
+func ReplicaTrust(r *http.Request, token string, trusted []netip.Prefix) []netip.Prefix {
+	if token == "" || subtle.ConstantTimeCompare([]byte(r.Header.Get(forwardedHeader)), []byte(token)) != 1 {
+		return trusted
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return trusted
+	}
+	peer, err := netip.ParseAddr(host)
+	if err != nil {
+		return trusted
+	}
+	peer = peer.Unmap()
+	return append(trusted[:len(trusted):len(trusted)], netip.PrefixFrom(peer, peer.BitLen()))
+}
+
+// forwardedElement returns the element of the `Forwarded` header
+// describing the hop of r to this replica.
+func forwardedElement(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+	proto := "http"
+	if r.TLS != nil {
+		proto = "https"
+	}
+	return `for="` + host + `";proto=` + proto + `;host="` + r.Host + `"`
+}
+
+// Directory records which replica runs each conversation, when
+// several replicas share the load. A conversation only runs in the
+// process that started it, so requests for it reaching another
+// replica are passed on.
+type Directory interface {
+	// Claim records that this replica runs the conversation, for
+	// at most ttl.
+	Claim(id string, ttl time.Duration) error
+	// Owner returns the URL of the replica running the
+	// conversation, or nil if it is this replica, or unknown.
+	Owner(id string) (*url.URL, error)
+	// Release forgets the conversation.
+	Release(id string) error
+}
+
+func (p *PamSocket) claim(c *Conversation) {
+	if p.Directory == nil {
+		return
+	}
+	if err := p.Directory.Claim(c.ID, conversationTimeout); err != nil {
+		report(&internalError{"directory", err})
+	}
+}
+
+func (p *PamSocket) release(c *Conversation) {
+	if p.Directory == nil {
+		return
+	}
+	if err := p.Directory.Release(c.ID); err != nil {
+		log.Info().Err(err).Msg("Could not release conversation")
+	}
+}
+
+// Forward passes the request on to the replica running the
+// conversation with the given ID, if it is not this one, and reports
+// whether it did. WebSockets and event streams are passed on for as
+// long as they last.
+func (p *PamSocket) Forward(w http.ResponseWriter, r *http.Request, id string) bool {
+	if p.Directory == nil || id == "" || r.Header.Get(forwardedHeader) != "" || p.Resume(id) != nil {
+		return false
+	}
+	owner, err := p.Directory.Owner(id)
+	if err != nil {
+		report(&internalError{"directory", err})
+		return false
+	}
+	if owner == nil {
+		return false
+	}
+	log.Info().Msgf("Passing conversation on to %s", owner)
+	client := p.client(r)
+	proxy := &httputil.ReverseProxy{
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			pr.SetURL(owner)
+			// Keep the host the client asked for, since it
+			// may be used to build URLs.
+			pr.Out.Host = pr.In.Host
+			// Pass on what trusted proxies said of the
+			// client, which the replica running the
+			// conversation believes of this one.
+			if client.Proxied {
+				for _, name := range forwardingHeaders {
+					if values := pr.In.Header.Values(name); len(values) > 0 {
+						pr.Out.Header[name] = values
+					}
+				}
+			}
+			pr.SetXForwarded()
+			// X-Forwarded-Proto and X-Forwarded-Host describe
+			// the client, not this replica.
+			pr.Out.Header.Set("X-Forwarded-Proto", client.Proto)
+			pr.Out.Header.Set("X-Forwarded-Host", client.Host)
+			if pr.Out.Header.Get("Forwarded") != "" {
+				pr.Out.Header.Add("Forwarded", forwardedElement(pr.In))
+			}
+			pr.Out.Header.Set(forwardedHeader, p.ReplicaToken)
+		},
+		FlushInterval: -1,
+	}
+	proxy.ServeHTTP(w, r)
+	return true
+}
@@ -0,0 +1,128 @@
+package pamsocket
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+)
+
+// mapDirectory is a Directory shared by replicas in the same process.
+type mapDirectory struct {
+	mu     sync.Mutex
+	owners map[string]*url.URL
+}
+
+// replica is the view of a mapDirectory from one replica.
+type replica struct {
+	*mapDirectory
+	self *url.URL
+}
+
+func (r replica) Claim(id string, _ time.Duration) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.owners[id] = r.self
+	return nil
+}
+
+func (r replica) Owner(id string) (*url.URL, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if owner := r.owners[id]; owner != nil && *owner != *r.self {
+		return owner, nil
+	}
+	return nil, nil
+}
+
+func (r replica) Release(id string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.owners, id)
+	return nil
+}
+
+func TestForward(t *testing.T) {
+	dir := &mapDirectory{owners: make(map[string]*url.URL)}
+	var servers []*httptest.Server
+	for range 2 {
+		socket := &PamSocket{
+			Authenticator: echoAuthenticator{},
+			Flow:          &NoopFlow{},
+		}
+		ts := httptest.NewServer(&API{Socket: socket})
+		defer ts.Close()
+		self, _ := url.Parse(ts.URL)
+		socket.Directory = replica{dir, self}
+		servers = append(servers, ts)
+	}
+
+	st := apiRequest(t, "POST", servers[0].URL+"/", "", http.StatusCreated)
+	// The other replica passes the conversation on to the first.
+	if got := apiRequest(t, "GET", servers[1].URL+"/"+st.ID, "", http.StatusOK); got.Status != "prompt" {
+		t.Errorf("got %#v, want the prompt", got)
+	}
+	got := apiRequest(t, "POST", servers[1].URL+"/"+st.ID+"/answer", `{"Input": "root"}`, http.StatusOK)
+	if got.Status != "authenticated" {
+		t.Errorf("got %#v, want to be authenticated", got)
+	}
+	// Once over, the conversation is released.
+	apiRequest(t, "GET", servers[1].URL+"/"+st.ID, "", http.StatusNotFound)
+	if len(dir.owners) != 0 {
+		t.Errorf("got owners %v, want none", dir.owners)
+	}
+}
+
+func TestForwardClient(t *testing.T) {
+	const token = "replica-token"
+	var got *Client
+	var ownerToken string
+	var trusted []netip.Prefix
+	owner := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = ParseClient(r, ReplicaTrust(r, ownerToken, trusted))
+	}))
+	defer owner.Close()
+	ownerURL, _ := url.Parse(owner.URL)
+	self, _ := url.Parse("http://replica.invalid")
+	dir := &mapDirectory{owners: map[string]*url.URL{"id": ownerURL}}
+
+	for _, tc := range []struct {
+		name       string
+		ownerToken string
+		// proxy is whether the request comes from a proxy
+		// the replicas trust.
+		proxy  bool
+		header http.Header
+		want   Client
+	}{
+		{"direct", token, false, http.Header{"X-Forwarded-For": {"198.51.100.1"}}, Client{Addr: "192.0.2.1", Proto: "http", Host: "idp.example", Proxied: true}},
+		{"proxied", token, true, http.Header{"X-Forwarded-For": {"198.51.100.1"}, "X-Forwarded-Proto": {"https"}}, Client{Addr: "198.51.100.1", Proto: "https", Host: "idp.example", Proxied: true}},
+		{"Forwarded", token, true, http.Header{"Forwarded": {`for=198.51.100.1;proto=https;host=login.example`}}, Client{Addr: "198.51.100.1", Proto: "https", Host: "login.example", Proxied: true}},
+		{"other token", "other", true, http.Header{"X-Forwarded-For": {"198.51.100.1"}}, Client{Addr: "127.0.0.1", Proto: "http", Host: "idp.example"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			socket := &PamSocket{
+				Directory:    replica{dir, self},
+				ReplicaToken: token,
+			}
+			trusted = nil
+			if tc.proxy {
+				trusted = []netip.Prefix{netip.MustParsePrefix("192.0.2.1/32")}
+			}
+			socket.TrustedProxies = trusted
+			ownerToken = tc.ownerToken
+			got = nil
+			r := httptest.NewRequest("GET", "http://idp.example/conversation", nil)
+			r.Header = tc.header
+			if !socket.Forward(httptest.NewRecorder(), r, "id") {
+				t.Fatal("The request was not passed on")
+			}
+			if got == nil || *got != tc.want {
+				t.Errorf("The replica running the conversation got client %+v, want %+v", got, tc.want)
+			}
+		})
+	}
+}
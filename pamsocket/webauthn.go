@@ -0,0 +1,256 @@
+package pamsocket
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/rs/zerolog/log"
+)
+
+// WebAuthnPolicy controls whether a WebAuthn credential (e.g., a
+// passkey or security key) must be presented in addition to
+// completing the PAM conversation.
+type WebAuthnPolicy int
+
+const (
+	// WebAuthnDisabled never requests a WebAuthn credential.
+	WebAuthnDisabled WebAuthnPolicy = iota
+	// WebAuthnOptional requests a WebAuthn credential only from
+	// users that have registered one.
+	WebAuthnOptional
+	// WebAuthnRequired requests a WebAuthn credential from every
+	// user, and fails authentication for users without one.
+	WebAuthnRequired
+)
+
+// ParseWebAuthnPolicy converts a policy name (`off`, `optional`, or
+// `required`) to a WebAuthnPolicy.
+func ParseWebAuthnPolicy(name string) (WebAuthnPolicy, error) {
+	switch name {
+	case "off":
+		return WebAuthnDisabled, nil
+	case "optional":
+		return WebAuthnOptional, nil
+	case "required":
+		return WebAuthnRequired, nil
+	}
+	return WebAuthnDisabled, fmt.Errorf("webauthn policy %q not known", name)
+}
+
+// CredentialStore persists WebAuthn credentials, keyed by UNIX
+// username.
+type CredentialStore interface {
+	// Credentials returns all credentials registered by the
+	// user. A user with no credentials is not an error.
+	Credentials(username string) ([]webauthn.Credential, error)
+	// PutCredential adds a new credential for the user, or
+	// replaces an existing one with the same ID (e.g., to update
+	// its signature counter).
+	PutCredential(username string, cred *webauthn.Credential) error
+}
+
+// FileCredentialStore is a CredentialStore that keeps the
+// credentials of each user in a JSON file named after the user,
+// inside Dir.
+type FileCredentialStore struct {
+	Dir string
+
+	mu sync.Mutex
+}
+
+func (f *FileCredentialStore) path(username string) (string, error) {
+	if username == "" || strings.ContainsAny(username, `/\`) || strings.HasPrefix(username, ".") {
+		return "", fmt.Errorf("invalid username %q", username)
+	}
+	return filepath.Join(f.Dir, username+".json"), nil
+}
+
+func (f *FileCredentialStore) read(username string) ([]webauthn.Credential, error) {
+	path, err := f.path(username)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var creds []webauthn.Credential
+	if err := json.Unmarshal(data, &creds); err != nil {
+		return nil, fmt.Errorf("could not parse %q: %w", path, err)
+	}
+	return creds, nil
+}
+
+func (f *FileCredentialStore) Credentials(username string) ([]webauthn.Credential, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.read(username)
+}
+
+func (f *FileCredentialStore) PutCredential(username string, cred *webauthn.Credential) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	creds, err := f.read(username)
+	if err != nil {
+		return err
+	}
+	replaced := false
+	for i := range creds {
+		if string(creds[i].ID) == string(cred.ID) {
+			creds[i] = *cred
+			replaced = true
+		}
+	}
+	if !replaced {
+		creds = append(creds, *cred)
+	}
+	data, err := json.Marshal(creds)
+	if err != nil {
+		return err
+	}
+	path, err := f.path(username)
+	if err != nil {
+		return err
+	}
+	// Write to a temporary file first, so a crash never leaves a
+	// user with a truncated set of credentials.
+	tmp, err := os.CreateTemp(f.Dir, "."+username+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// WebAuthn is an additional authentication step that runs after the
+// PAM conversation succeeds, since PAM modules cannot talk to
+// browser authenticators. It is carried over the same websocket as
+// the PAM conversation, using the `WebAuthnRegister` and
+// `WebAuthnAssert` message types.
+type WebAuthn struct {
+	// Policy determines which users must present a credential.
+	Policy WebAuthnPolicy
+	// Enroll, if true, asks users without any registered
+	// credential to register one right after the PAM
+	// conversation, instead of skipping (WebAuthnOptional) or
+	// failing (WebAuthnRequired) the WebAuthn step.
+	Enroll bool
+	// RelyingParty holds the relying party configuration
+	// (identifier and permitted origins).
+	RelyingParty *webauthn.WebAuthn
+	// Store persists the registered credentials.
+	Store CredentialStore
+}
+
+// webauthnUser adapts a UNIX account to the webauthn.User interface.
+type webauthnUser struct {
+	userinfo *user.User
+	creds    []webauthn.Credential
+}
+
+func (u *webauthnUser) WebAuthnID() []byte {
+	// The UID is the same stable identifier used as the OpenID
+	// Connect subject.
+	return []byte(u.userinfo.Uid)
+}
+
+func (u *webauthnUser) WebAuthnName() string { return u.userinfo.Username }
+
+func (u *webauthnUser) WebAuthnDisplayName() string {
+	if u.userinfo.Name != "" {
+		return u.userinfo.Name
+	}
+	return u.userinfo.Username
+}
+
+func (u *webauthnUser) WebAuthnCredentials() []webauthn.Credential { return u.creds }
+
+// verify runs the WebAuthn step of the login for the given,
+// already PAM-authenticated, user. A nil return means the user has
+// satisfied the policy.
+func (w *WebAuthn) verify(c *Conversation, userinfo *user.User) error {
+	if w.Policy == WebAuthnDisabled {
+		return nil
+	}
+	creds, err := w.Store.Credentials(userinfo.Username)
+	if err != nil {
+		return err
+	}
+	u := &webauthnUser{
+		userinfo: userinfo,
+		creds:    creds,
+	}
+	if len(creds) > 0 {
+		return w.assert(c, u)
+	}
+	if w.Enroll {
+		return w.register(c, u)
+	}
+	if w.Policy == WebAuthnOptional {
+		return nil
+	}
+	return fmt.Errorf("user %q has no WebAuthn credentials", userinfo.Username)
+}
+
+func (w *WebAuthn) register(c *Conversation, u *webauthnUser) error {
+	options, sessionData, err := w.RelyingParty.BeginRegistration(u)
+	if err != nil {
+		return err
+	}
+	response, err := c.challenge("WebAuthnRegister", options)
+	if err != nil {
+		return err
+	}
+	parsed, err := protocol.ParseCredentialCreationResponseBody(strings.NewReader(response))
+	if err != nil {
+		return err
+	}
+	cred, err := w.RelyingParty.CreateCredential(u, *sessionData, parsed)
+	if err != nil {
+		return err
+	}
+	log.Info().Msgf("Registered WebAuthn credential for %q", u.userinfo.Username)
+	return w.Store.PutCredential(u.userinfo.Username, cred)
+}
+
+func (w *WebAuthn) assert(c *Conversation, u *webauthnUser) error {
+	options, sessionData, err := w.RelyingParty.BeginLogin(u)
+	if err != nil {
+		return err
+	}
+	response, err := c.challenge("WebAuthnAssert", options)
+	if err != nil {
+		return err
+	}
+	parsed, err := protocol.ParseCredentialRequestResponseBody(strings.NewReader(response))
+	if err != nil {
+		return err
+	}
+	cred, err := w.RelyingParty.ValidateLogin(u, *sessionData, parsed)
+	if err != nil {
+		return err
+	}
+	if cred.Authenticator.CloneWarning {
+		return fmt.Errorf("WebAuthn credential for %q may have been cloned", u.userinfo.Username)
+	}
+	// Persist the updated signature counter.
+	return w.Store.PutCredential(u.userinfo.Username, cred)
+}
@@ -0,0 +1,43 @@
+package pamsocket
+
+import (
+	"testing"
+
+	"github.com/go-webauthn/webauthn/webauthn"
+)
+
+func TestFileCredentialStore(t *testing.T) {
+	store := &FileCredentialStore{Dir: t.TempDir()}
+	creds, err := store.Credentials("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(creds) != 0 {
+		t.Fatalf("Expected no credentials, got %#v", creds)
+	}
+
+	cred := &webauthn.Credential{ID: []byte("key-1")}
+	if err := store.PutCredential("alice", cred); err != nil {
+		t.Fatal(err)
+	}
+	cred.Authenticator.SignCount = 5
+	if err := store.PutCredential("alice", cred); err != nil {
+		t.Fatal(err)
+	}
+	creds, err = store.Credentials("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(creds) != 1 || creds[0].Authenticator.SignCount != 5 {
+		t.Fatalf("Expected a single updated credential, got %#v", creds)
+	}
+}
+
+func TestFileCredentialStoreRejectsPaths(t *testing.T) {
+	store := &FileCredentialStore{Dir: t.TempDir()}
+	for _, username := range []string{"", "../etc/passwd", ".hidden", `a\b`} {
+		if _, err := store.Credentials(username); err == nil {
+			t.Errorf("Expected an error for username %q", username)
+		}
+	}
+}